@@ -1,19 +1,31 @@
 package packet
 
 import (
+	"bytes"
 	"context"
 	"os"
+	"sync"
 	"testing"
 	"time"
 
+	metrics "github.com/armon/go-metrics"
+	hclog "github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/vault/sdk/logical"
 )
 
 const (
-	envVarRunAccTests = "VAULT_PACKET_ACCEPTANCE_TEST_API"
-	envVarAPIToken    = "PACKET_AUTH_TOKEN"
+	envVarRunAccTests  = "VAULT_PACKET_ACCEPTANCE_TEST_API"
+	envVarAPIToken     = "PACKET_AUTH_TOKEN"
+	envVarDeviceID     = "PACKET_TEST_DEVICE_ID"
+	envVarPoolProject  = "PACKET_TEST_POOL_PROJECT_ID"
+	envVarSpotPlan     = "PACKET_TEST_SPOT_PLAN"
+	envVarSpotFacility = "PACKET_TEST_SPOT_FACILITY"
+	envVarVPNFacility  = "PACKET_TEST_VPN_FACILITY"
 )
 
+// runAcceptanceTests switches the tests from the fake Packet API to the real
+// one. Tests which need resources the fake API doesn't implement only run
+// against the real API.
 var runAcceptanceTests = os.Getenv(envVarRunAccTests) == "1"
 
 type testEnv struct {
@@ -25,13 +37,50 @@ type testEnv struct {
 	Storage logical.Storage
 
 	MostRecentSecret *logical.Secret
+	// EarlierSecret is a secret still outstanding when MostRecentSecret was
+	// read
+	EarlierSecret *logical.Secret
+	// IssuedSecrets holds all API key secrets read so far, for cleanup
+	IssuedSecrets []*logical.Secret
+	// IssuedTokens holds the API tokens of IssuedSecrets
+	IssuedTokens []string
+	// BatchTokens holds the API tokens of the batch read last
+	BatchTokens []string
+	// PooledKeyIDs holds IDs of API keys last seen in the pool of the role
+	PooledKeyIDs []string
+	// StrayKeyID is an API key created outside of the backend
+	StrayKeyID string
+	// SecondToken is a second root token, backed by a user API key with
+	// SecondTokenKeyID
+	SecondToken      string
+	SecondTokenKeyID string
+
+	// Mock is the fake Packet API, nil when running against the real one
+	Mock *packetMock
+	// Webhook receives webhook events once AddWebhookConfig ran
+	Webhook *webhookReceiver
+	// Logs collects everything the backend logs
+	Logs *logBuffer
+	// Metrics collects metrics after CollectMetrics step
+	Metrics *metrics.InmemSink
 
 	TestProjectID string
+	TestDeviceID  string
+
+	TestPoolProjectID string
+	TestSpotPlan      string
+	TestSpotFacility  string
+	TestVPNFacility   string
 }
 
 func newAcceptanceTestEnv(roleName string) (*testEnv, error) {
 	ctx := context.Background()
+	logs := &logBuffer{}
 	conf := &logical.BackendConfig{
+		Logger: hclog.New(&hclog.LoggerOptions{
+			Output: logs,
+			Level:  hclog.Trace,
+		}),
 		System: &logical.StaticSystemView{
 			DefaultLeaseTTLVal: time.Hour,
 			MaxLeaseTTLVal:     time.Hour,
@@ -41,24 +90,64 @@ func newAcceptanceTestEnv(roleName string) (*testEnv, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &testEnv{
+	e := &testEnv{
 		RoleName: roleName,
 		APIToken: os.Getenv(envVarAPIToken),
 		Backend:  b,
 		Context:  ctx,
 		Storage:  &logical.InmemStorage{},
-	}, nil
-}
+		Logs:     logs,
 
-func TestUserBadConfig(t *testing.T) {
+		TestDeviceID:      os.Getenv(envVarDeviceID),
+		TestPoolProjectID: os.Getenv(envVarPoolProject),
+		TestSpotPlan:      os.Getenv(envVarSpotPlan),
+		TestSpotFacility:  os.Getenv(envVarSpotFacility),
+		TestVPNFacility:   os.Getenv(envVarVPNFacility),
+	}
 	if !runAcceptanceTests {
-		t.SkipNow()
+		e.Mock = newPacketMock()
+		e.APIToken = e.Mock.RootToken
+		b.(*backend).apiURL = e.Mock.URL
 	}
+	return e, nil
+}
+
+// logBuffer is a bytes.Buffer safe for concurrent writes of the logger.
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
 
+func (l *logBuffer) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.buf.Write(p)
+}
+
+func (l *logBuffer) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.buf.String()
+}
+
+// Close waits for background work of the backend and shuts down the fake
+// Packet API, if any.
+func (e *testEnv) Close() {
+	e.Backend.Cleanup(e.Context)
+	if e.Mock != nil {
+		e.Mock.Close()
+	}
+	if e.Webhook != nil {
+		e.Webhook.Close()
+	}
+}
+
+func TestUserBadConfig(t *testing.T) {
 	acceptanceTestEnv, err := newAcceptanceTestEnv("testuserrolebadconf")
 	if err != nil {
 		t.Fatal(err)
 	}
+	defer acceptanceTestEnv.Close()
 	t.Run("add bad config", acceptanceTestEnv.AddBadConfig)
 
 	t.Run("add user role", acceptanceTestEnv.AddUserRole)
@@ -69,14 +158,11 @@ func TestUserBadConfig(t *testing.T) {
 }
 
 func TestUserCreds(t *testing.T) {
-	if !runAcceptanceTests {
-		t.SkipNow()
-	}
-
 	acceptanceTestEnv, err := newAcceptanceTestEnv("testuserrole")
 	if err != nil {
 		t.Fatal(err)
 	}
+	defer acceptanceTestEnv.Close()
 	t.Run("add config", acceptanceTestEnv.AddConfig)
 
 	t.Run("add user role", acceptanceTestEnv.AddUserRole)
@@ -88,22 +174,667 @@ func TestUserCreds(t *testing.T) {
 }
 
 func TestProjectCreds(t *testing.T) {
+	acceptanceTestEnv, err := newAcceptanceTestEnv("testprojectrole")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer acceptanceTestEnv.Close()
+	t.Run("add config", acceptanceTestEnv.AddConfig)
+
+	t.Run("create testing project", acceptanceTestEnv.CreatePacketProject)
+	t.Run("add project role", acceptanceTestEnv.AddProjectRole)
+	t.Run("read project role", acceptanceTestEnv.ReadRole)
+	t.Run("read project creds", acceptanceTestEnv.ReadProjectCreds)
+
+	t.Run("renew project creds", acceptanceTestEnv.RenewCreds)
+	t.Run("revoke project creds", acceptanceTestEnv.RevokeCreds)
+	t.Run("remove testing project", acceptanceTestEnv.RemovePacketProject)
+}
+
+func TestCredsFormats(t *testing.T) {
+	acceptanceTestEnv, err := newAcceptanceTestEnv("testformatsrole")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer acceptanceTestEnv.Close()
+	t.Run("add config", acceptanceTestEnv.AddConfig)
+
+	t.Run("create testing project", acceptanceTestEnv.CreatePacketProject)
+	t.Run("add project role", acceptanceTestEnv.AddProjectRole)
+	t.Run("read project creds in all formats", acceptanceTestEnv.ReadProjectCredsFormats)
+	t.Run("check unknown format", acceptanceTestEnv.ReadCredsBadFormat)
+	t.Run("revoke all project creds", acceptanceTestEnv.RevokeAllCreds)
+	t.Run("remove testing project", acceptanceTestEnv.RemovePacketProject)
+}
+
+func TestTemplatedRole(t *testing.T) {
+	acceptanceTestEnv, err := newAcceptanceTestEnv("testtemplatedrole")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer acceptanceTestEnv.Close()
+	t.Run("add config", acceptanceTestEnv.AddConfig)
+
+	t.Run("create testing project", acceptanceTestEnv.CreatePacketProject)
+	t.Run("add templated project role", acceptanceTestEnv.AddTemplatedProjectRole)
+	t.Run("read templated project creds", acceptanceTestEnv.ReadTemplatedCreds)
+	t.Run("check templates fail without entity", acceptanceTestEnv.ReadTemplatedCredsWithoutEntity)
+	t.Run("check templates fail without entity metadata", acceptanceTestEnv.ReadTemplatedCredsUnresolvable)
+	t.Run("revoke all project creds", acceptanceTestEnv.RevokeAllCreds)
+	t.Run("remove testing project", acceptanceTestEnv.RemovePacketProject)
+}
+
+func TestCallerBinding(t *testing.T) {
+	acceptanceTestEnv, err := newAcceptanceTestEnv("testboundrole")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer acceptanceTestEnv.Close()
+	t.Run("add config", acceptanceTestEnv.AddConfig)
+
+	t.Run("check error for bad bound_cidrs", acceptanceTestEnv.AddRoleWithBadCIDR)
+	t.Run("add bound user role", acceptanceTestEnv.AddBoundUserRole)
+	t.Run("read bound user creds", acceptanceTestEnv.ReadBoundCreds)
+	t.Run("check denial outside bound_cidrs", acceptanceTestEnv.ReadBoundCredsOutsideCIDRs)
+	t.Run("check denial without entity", acceptanceTestEnv.ReadBoundCredsWithoutEntity)
+	t.Run("check denial outside allowed groups", acceptanceTestEnv.ReadBoundCredsOutsideGroups)
+	t.Run("check denial from other auth mount", acceptanceTestEnv.ReadBoundCredsFromOtherMount)
+	t.Run("revoke all user creds", acceptanceTestEnv.RevokeAllCreds)
+}
+
+func TestConfigPolicy(t *testing.T) {
+	acceptanceTestEnv, err := newAcceptanceTestEnv("testpolicyrole")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer acceptanceTestEnv.Close()
+	t.Run("add config", acceptanceTestEnv.AddConfig)
+
+	t.Run("create testing project", acceptanceTestEnv.CreatePacketProject)
+	t.Run("add project role", acceptanceTestEnv.AddProjectRole)
+	t.Run("add read-write user role", acceptanceTestEnv.AddReadWriteUserRole)
+	t.Run("tighten policy", acceptanceTestEnv.TightenPolicy)
+	t.Run("check issuance refused for violating role", acceptanceTestEnv.ReadCredsViolatingPolicy)
+	t.Run("check error for role violating policy", acceptanceTestEnv.AddRoleViolatingPolicy)
+	t.Run("allow project and its organization", acceptanceTestEnv.AllowProjectOrganization)
+	t.Run("read project creds", acceptanceTestEnv.ReadProjectCreds)
+	t.Run("revoke project creds", acceptanceTestEnv.RevokeCreds)
+	t.Run("remove testing project", acceptanceTestEnv.RemovePacketProject)
+}
+
+func TestBatchCreds(t *testing.T) {
+	acceptanceTestEnv, err := newAcceptanceTestEnv("testbatchrole")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer acceptanceTestEnv.Close()
+	t.Run("add config", acceptanceTestEnv.AddConfig)
+
+	t.Run("add batch user role", acceptanceTestEnv.AddBatchUserRole)
+	t.Run("check error for count over max_batch_size", acceptanceTestEnv.ReadBatchCredsOverLimit)
+	t.Run("read batch of user creds", acceptanceTestEnv.ReadBatchCreds)
+	t.Run("renew batch of user creds", acceptanceTestEnv.RenewCreds)
+	t.Run("claim API key of batch", acceptanceTestEnv.ClaimBatchCreds)
+	t.Run("renew batch of user creds after claim", acceptanceTestEnv.RenewCreds)
+	t.Run("revoke batch of user creds", acceptanceTestEnv.RevokeBatchCreds)
+	t.Run("revoke claimed API key", acceptanceTestEnv.RevokeClaimedCreds)
 	if !runAcceptanceTests {
+		t.Run("check cleanup of partially failed batch", acceptanceTestEnv.ReadBatchCredsPartialFailure)
+	}
+}
+
+func TestQuotas(t *testing.T) {
+	acceptanceTestEnv, err := newAcceptanceTestEnv("testquotarole")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer acceptanceTestEnv.Close()
+	t.Run("add config", acceptanceTestEnv.AddConfig)
+
+	t.Run("add user role with quotas", acceptanceTestEnv.AddQuotaUserRole)
+	t.Run("read first user creds", acceptanceTestEnv.ReadUserCreds)
+	t.Run("read second user creds", acceptanceTestEnv.ReadUserCreds)
+	t.Run("check max_active_keys", acceptanceTestEnv.ReadUserCredsQuotaExceeded)
+	t.Run("revoke second user creds", acceptanceTestEnv.RevokeCreds)
+	t.Run("read third user creds", acceptanceTestEnv.ReadUserCreds)
+	t.Run("revoke third user creds", acceptanceTestEnv.RevokeCreds)
+	t.Run("check max_issuance_per_hour", acceptanceTestEnv.ReadUserCredsQuotaExceeded)
+	t.Run("revoke all user creds", acceptanceTestEnv.RevokeAllCreds)
+}
+
+func TestQuotasConcurrent(t *testing.T) {
+	acceptanceTestEnv, err := newAcceptanceTestEnv("testquotaconcurrentrole")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer acceptanceTestEnv.Close()
+	t.Run("add config", acceptanceTestEnv.AddConfig)
+
+	t.Run("add user role with quotas", acceptanceTestEnv.AddQuotaUserRole)
+	t.Run("check max_active_keys with concurrent requests", acceptanceTestEnv.ReadUserCredsConcurrently)
+}
+
+func TestStaleSlots(t *testing.T) {
+	if runAcceptanceTests {
+		// Slots are only left behind by interrupted requests
 		t.SkipNow()
 	}
 
-	acceptanceTestEnv, err := newAcceptanceTestEnv("testprojectrole")
+	acceptanceTestEnv, err := newAcceptanceTestEnv("teststaleslotsrole")
 	if err != nil {
 		t.Fatal(err)
 	}
+	defer acceptanceTestEnv.Close()
 	t.Run("add config", acceptanceTestEnv.AddConfig)
 
+	t.Run("add user role with quotas", acceptanceTestEnv.AddQuotaUserRole)
+	t.Run("leave reserved slots behind", acceptanceTestEnv.AddLeakedSlots)
+	t.Run("check max_active_keys", acceptanceTestEnv.ReadUserCredsQuotaExceeded)
+	t.Run("run periodic function", acceptanceTestEnv.RunPeriodic)
+	t.Run("check only stale slots expired", acceptanceTestEnv.CheckStaleSlotsExpired)
+	t.Run("read user creds", acceptanceTestEnv.ReadUserCreds)
+	t.Run("revoke all user creds", acceptanceTestEnv.RevokeAllCreds)
+}
+
+func TestPool(t *testing.T) {
+	acceptanceTestEnv, err := newAcceptanceTestEnv("testpoolrole")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer acceptanceTestEnv.Close()
+	t.Run("add config", acceptanceTestEnv.AddConfig)
+
+	t.Run("add user role with pool", acceptanceTestEnv.AddPoolUserRole)
+	t.Run("fill pool", acceptanceTestEnv.FillPool)
+	t.Run("read user creds from pool", acceptanceTestEnv.ReadUserCredsFromPool)
+	t.Run("check pool is refilled", acceptanceTestEnv.CheckPoolRefilled)
+	t.Run("check pooled key is returned on failed issuance", acceptanceTestEnv.ReadUserCredsFromPoolRecordFailure)
+	t.Run("age pooled keys", acceptanceTestEnv.AgePooledKeys)
+	t.Run("check refill ignores unusable keys", acceptanceTestEnv.ReadUserCredsRefillsUsable)
+	t.Run("disable pool of user role", acceptanceTestEnv.DisablePool)
+	t.Run("check pool is pruned", acceptanceTestEnv.CheckPoolPruned)
+	t.Run("revoke all user creds", acceptanceTestEnv.RevokeAllCreds)
+}
+
+func TestStorageMigration(t *testing.T) {
+	acceptanceTestEnv, err := newAcceptanceTestEnv("testmigrationrole")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer acceptanceTestEnv.Close()
+
+	t.Run("write version 1 entries", acceptanceTestEnv.WriteLegacyEntries)
+	t.Run("initialize backend", acceptanceTestEnv.Initialize)
+	t.Run("check migrated entries", acceptanceTestEnv.CheckMigratedEntries)
+	t.Run("initialize backend again", acceptanceTestEnv.Initialize)
+	t.Run("check migrated entries are unchanged", acceptanceTestEnv.CheckMigratedEntries)
+}
+
+func TestLookup(t *testing.T) {
+	acceptanceTestEnv, err := newAcceptanceTestEnv("testlookuprole")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer acceptanceTestEnv.Close()
+	t.Run("add config", acceptanceTestEnv.AddConfig)
+
+	t.Run("add user role", acceptanceTestEnv.AddUserRole)
+	t.Run("read user creds", acceptanceTestEnv.ReadUserCreds)
+	t.Run("look up creds by token", acceptanceTestEnv.LookupCredsByToken)
+	t.Run("look up creds by fingerprint", acceptanceTestEnv.LookupCredsByFingerprint)
+	t.Run("revoke user creds", acceptanceTestEnv.RevokeCreds)
+	t.Run("check revoked creds can't be looked up", acceptanceTestEnv.LookupRevokedCreds)
+}
+
+func TestRenewCheck(t *testing.T) {
+	acceptanceTestEnv, err := newAcceptanceTestEnv("testrenewrole")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer acceptanceTestEnv.Close()
+	t.Run("add config", acceptanceTestEnv.AddConfig)
+
+	t.Run("add user role", acceptanceTestEnv.AddUserRole)
+	t.Run("read user creds", acceptanceTestEnv.ReadUserCreds)
+	t.Run("renew user creds", acceptanceTestEnv.RenewCreds)
+	t.Run("delete user key outside of Vault", acceptanceTestEnv.DeleteKeyOutsideVault)
+	t.Run("check renewal of deleted user key fails", acceptanceTestEnv.RenewDeletedCreds)
+	t.Run("revoke user creds", acceptanceTestEnv.RevokeCreds)
+
 	t.Run("create testing project", acceptanceTestEnv.CreatePacketProject)
 	t.Run("add project role", acceptanceTestEnv.AddProjectRole)
-	t.Run("read project role", acceptanceTestEnv.ReadRole)
 	t.Run("read project creds", acceptanceTestEnv.ReadProjectCreds)
-
 	t.Run("renew project creds", acceptanceTestEnv.RenewCreds)
+	t.Run("delete project key outside of Vault", acceptanceTestEnv.DeleteKeyOutsideVault)
+	t.Run("check renewal of deleted project key fails", acceptanceTestEnv.RenewDeletedCreds)
+	t.Run("skip renew check", acceptanceTestEnv.SkipRenewCheck)
+	t.Run("renew without check", acceptanceTestEnv.RenewCreds)
 	t.Run("revoke project creds", acceptanceTestEnv.RevokeCreds)
 	t.Run("remove testing project", acceptanceTestEnv.RemovePacketProject)
 }
+
+func TestReconcile(t *testing.T) {
+	acceptanceTestEnv, err := newAcceptanceTestEnv("testreconcilerole")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer acceptanceTestEnv.Close()
+	t.Run("add config", acceptanceTestEnv.AddConfig)
+
+	t.Run("create testing project", acceptanceTestEnv.CreatePacketProject)
+	t.Run("add project role", acceptanceTestEnv.AddProjectRole)
+	t.Run("read two project creds", acceptanceTestEnv.ReadReconcileCreds)
+	t.Run("delete project key outside of Vault", acceptanceTestEnv.DeleteKeyOutsideVault)
+	t.Run("create stray key outside of Vault", acceptanceTestEnv.CreateStrayKey)
+	t.Run("make role read-write", acceptanceTestEnv.MakeRoleReadWrite)
+	t.Run("report drift", acceptanceTestEnv.ReconcileReport)
+	t.Run("apply reconciliation", acceptanceTestEnv.ReconcileApply)
+	t.Run("delete stray key", acceptanceTestEnv.DeleteStrayKey)
+	t.Run("revoke all project creds", acceptanceTestEnv.RevokeAllCreds)
+	t.Run("remove testing project", acceptanceTestEnv.RemovePacketProject)
+}
+
+func TestVerifyKey(t *testing.T) {
+	if runAcceptanceTests {
+		// Propagation delay is simulated by the fake Packet API only
+		t.SkipNow()
+	}
+
+	acceptanceTestEnv, err := newAcceptanceTestEnv("testverifyrole")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer acceptanceTestEnv.Close()
+	t.Run("add config with two tokens", acceptanceTestEnv.AddConfigWithTokens)
+
+	t.Run("create testing project", acceptanceTestEnv.CreatePacketProject)
+	t.Run("add verified project role", acceptanceTestEnv.AddVerifiedProjectRole)
+	t.Run("read creds once usable", acceptanceTestEnv.ReadVerifiedCreds)
+	t.Run("check probes are recorded", acceptanceTestEnv.CheckProbesRecorded)
+	t.Run("check unusable key is deleted", acceptanceTestEnv.ReadUnverifiableCreds)
+	t.Run("revoke all project creds", acceptanceTestEnv.RevokeAllCreds)
+	t.Run("remove testing project", acceptanceTestEnv.RemovePacketProject)
+}
+
+func TestUpstreamFailures(t *testing.T) {
+	if runAcceptanceTests {
+		// Failures are injected by the fake Packet API only
+		t.SkipNow()
+	}
+
+	acceptanceTestEnv, err := newAcceptanceTestEnv("testupstreamfailures")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer acceptanceTestEnv.Close()
+	t.Run("add config", acceptanceTestEnv.AddConfig)
+
+	t.Run("add user role", acceptanceTestEnv.AddUserRole)
+	t.Run("check error when Packet API rate-limits creation", acceptanceTestEnv.ReadUserCredsRateLimited)
+	t.Run("read user creds", acceptanceTestEnv.ReadUserCreds)
+	t.Run("check renewal fails when keys can't be checked", acceptanceTestEnv.RenewCredsUpstreamFailure)
+	t.Run("renew user creds", acceptanceTestEnv.RenewCreds)
+	t.Run("check error when Packet API fails deletion", acceptanceTestEnv.RevokeCredsUpstreamFailure)
+	t.Run("revoke user creds", acceptanceTestEnv.RevokeCreds)
+	t.Run("check api key was deleted", acceptanceTestEnv.CheckAPIKeyDeleted)
+}
+
+func TestRevocationQueue(t *testing.T) {
+	if runAcceptanceTests {
+		// Failures are injected by the fake Packet API only
+		t.SkipNow()
+	}
+
+	acceptanceTestEnv, err := newAcceptanceTestEnv("testrevocationqueue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer acceptanceTestEnv.Close()
+	t.Run("add config", acceptanceTestEnv.AddConfig)
+
+	t.Run("add user role", acceptanceTestEnv.AddUserRole)
+	t.Run("read user creds", acceptanceTestEnv.ReadUserCreds)
+	t.Run("check error when Packet API fails deletion", acceptanceTestEnv.RevokeCredsUpstreamFailure)
+	t.Run("check failed revocation is queued", acceptanceTestEnv.CheckRevocationPending)
+	t.Run("check retry by Vault before due isn't counted", acceptanceTestEnv.RevokeCredsUpstreamFailureNotDue)
+	t.Run("revoke user creds", acceptanceTestEnv.RevokeCreds)
+	t.Run("check revocation is dequeued", acceptanceTestEnv.CheckRevocationQueueEmpty)
+
+	t.Run("read user creds", acceptanceTestEnv.ReadUserCreds)
+	t.Run("fail revocation until given up on", acceptanceTestEnv.DeadLetterRevocation)
+	t.Run("retry failed revocation", acceptanceTestEnv.RetryFailedRevocation)
+
+	t.Run("read user creds", acceptanceTestEnv.ReadUserCreds)
+	t.Run("fail revocation until given up on", acceptanceTestEnv.DeadLetterRevocation)
+	t.Run("acknowledge failed revocation", acceptanceTestEnv.AcknowledgeFailedRevocation)
+}
+
+func TestLogging(t *testing.T) {
+	if runAcceptanceTests {
+		// Failures are injected by the fake Packet API only
+		t.SkipNow()
+	}
+
+	acceptanceTestEnv, err := newAcceptanceTestEnv("testlogging")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer acceptanceTestEnv.Close()
+	t.Run("add config", acceptanceTestEnv.AddConfig)
+
+	t.Run("add user role", acceptanceTestEnv.AddUserRole)
+	t.Run("read user creds", acceptanceTestEnv.ReadUserCreds)
+	t.Run("check error when Packet API fails deletion", acceptanceTestEnv.RevokeCredsUpstreamFailure)
+	t.Run("revoke user creds", acceptanceTestEnv.RevokeCreds)
+	t.Run("check logs", acceptanceTestEnv.CheckLogs)
+}
+
+func TestTelemetry(t *testing.T) {
+	if runAcceptanceTests {
+		// Failures are injected by the fake Packet API only
+		t.SkipNow()
+	}
+
+	acceptanceTestEnv, err := newAcceptanceTestEnv("testtelemetry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer acceptanceTestEnv.Close()
+	t.Run("add config", acceptanceTestEnv.AddConfig)
+
+	t.Run("collect metrics", acceptanceTestEnv.CollectMetrics)
+	t.Run("add user role", acceptanceTestEnv.AddUserRole)
+	t.Run("read user creds", acceptanceTestEnv.ReadUserCreds)
+	t.Run("check error when Packet API fails deletion", acceptanceTestEnv.RevokeCredsUpstreamFailure)
+	t.Run("revoke user creds", acceptanceTestEnv.RevokeCreds)
+	t.Run("check metrics", acceptanceTestEnv.CheckMetrics)
+}
+
+func TestStatus(t *testing.T) {
+	if runAcceptanceTests {
+		// Failures are injected by the fake Packet API only
+		t.SkipNow()
+	}
+
+	acceptanceTestEnv, err := newAcceptanceTestEnv("teststatus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer acceptanceTestEnv.Close()
+
+	t.Run("check status without config", acceptanceTestEnv.CheckStatusWithoutConfig)
+	t.Run("add config", acceptanceTestEnv.AddConfig)
+	t.Run("run periodic function", acceptanceTestEnv.RunPeriodic)
+	t.Run("check status", acceptanceTestEnv.CheckStatus)
+	t.Run("add user role", acceptanceTestEnv.AddUserRole)
+	t.Run("read user creds", acceptanceTestEnv.ReadUserCreds)
+	t.Run("check error when Packet API fails deletion", acceptanceTestEnv.RevokeCredsUpstreamFailure)
+	t.Run("check status after failed call", acceptanceTestEnv.CheckStatusAfterFailure)
+	t.Run("revoke user creds", acceptanceTestEnv.RevokeCreds)
+	t.Run("add bad config", acceptanceTestEnv.AddBadConfig)
+	t.Run("check status with bad config", acceptanceTestEnv.CheckStatusUnauthenticated)
+}
+
+func TestTokenPool(t *testing.T) {
+	if runAcceptanceTests {
+		// The second token is revoked in the fake Packet API only
+		t.SkipNow()
+	}
+
+	acceptanceTestEnv, err := newAcceptanceTestEnv("testtokenpool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer acceptanceTestEnv.Close()
+
+	t.Run("add config with several tokens", acceptanceTestEnv.AddConfigWithTokens)
+	t.Run("read config with several tokens", acceptanceTestEnv.ReadConfigWithTokens)
+	t.Run("add user role", acceptanceTestEnv.AddUserRole)
+	t.Run("read user creds", acceptanceTestEnv.ReadUserCreds)
+	t.Run("read user creds", acceptanceTestEnv.ReadUserCreds)
+	t.Run("check calls use tokens in turns", acceptanceTestEnv.CheckTokensUsedInTurns)
+	t.Run("revoke second token in Packet", acceptanceTestEnv.RevokeSecondToken)
+	t.Run("read user creds with a token rejected", acceptanceTestEnv.ReadUserCreds)
+	t.Run("read user creds with a token rejected", acceptanceTestEnv.ReadUserCreds)
+	t.Run("check rejected token is flagged", acceptanceTestEnv.CheckTokenDisabled)
+	t.Run("revoke user creds", acceptanceTestEnv.RevokeCreds)
+	t.Run("select token by rate limit", acceptanceTestEnv.SelectTokenByRateLimit)
+	t.Run("check rejected token is back after config write", acceptanceTestEnv.CheckTokensActive)
+}
+
+func TestReplication(t *testing.T) {
+	acceptanceTestEnv, err := newAcceptanceTestEnv("testreplication")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer acceptanceTestEnv.Close()
+
+	t.Run("check local storage paths", acceptanceTestEnv.CheckLocalStorage)
+	t.Run("check seal-wrapped storage paths", acceptanceTestEnv.CheckSealWrapStorage)
+	t.Run("add config", acceptanceTestEnv.AddConfig)
+	t.Run("add user role", acceptanceTestEnv.AddUserRole)
+	t.Run("become performance secondary", acceptanceTestEnv.BecomePerfSecondary)
+	t.Run("check config and role writes are forwarded", acceptanceTestEnv.CheckGlobalWritesForwarded)
+	t.Run("read role", acceptanceTestEnv.ReadRole)
+	t.Run("read user creds on secondary", acceptanceTestEnv.ReadUserCreds)
+	t.Run("check periodic jobs skipped on secondary", acceptanceTestEnv.CheckPeriodicSkipped)
+	t.Run("become performance standby", acceptanceTestEnv.BecomePerfStandby)
+	t.Run("check creds reads are forwarded", acceptanceTestEnv.CheckCredsForwarded)
+	t.Run("check periodic jobs skipped on standby", acceptanceTestEnv.CheckPeriodicSkipped)
+	t.Run("become local mount on performance secondary", acceptanceTestEnv.BecomeLocalMountOnPerfSecondary)
+	t.Run("check periodic jobs run on local mount", acceptanceTestEnv.CheckPeriodicRan)
+	t.Run("become primary", acceptanceTestEnv.BecomePrimary)
+	t.Run("revoke user creds", acceptanceTestEnv.RevokeCreds)
+}
+
+func TestWebhooks(t *testing.T) {
+	if runAcceptanceTests {
+		// Failures are injected by the fake Packet API only
+		t.SkipNow()
+	}
+
+	acceptanceTestEnv, err := newAcceptanceTestEnv("testwebhooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer acceptanceTestEnv.Close()
+
+	t.Run("add config", acceptanceTestEnv.AddConfig)
+	t.Run("add batch user role", acceptanceTestEnv.AddBatchUserRole)
+	t.Run("add webhook config", acceptanceTestEnv.AddWebhookConfig)
+	t.Run("read webhook config", acceptanceTestEnv.ReadWebhookConfig)
+	t.Run("read user creds", acceptanceTestEnv.ReadUserCreds)
+	t.Run("check issue event", acceptanceTestEnv.CheckIssueEvent)
+	t.Run("renew user creds", acceptanceTestEnv.RenewCreds)
+	t.Run("check renew event", acceptanceTestEnv.CheckRenewEvent)
+	t.Run("revoke user creds", acceptanceTestEnv.RevokeCreds)
+	t.Run("check revoke event", acceptanceTestEnv.CheckRevokeEvent)
+	t.Run("check failed batch rolls back", acceptanceTestEnv.ReadBatchCredsPartialFailure)
+	t.Run("check rollback event", acceptanceTestEnv.CheckRollbackEvent)
+	t.Run("read user creds", acceptanceTestEnv.ReadUserCreds)
+	t.Run("check failed delivery is retried", acceptanceTestEnv.RetryWebhookDelivery)
+	t.Run("check outbox is bounded", acceptanceTestEnv.CheckOutboxBounded)
+	t.Run("delete webhook config", acceptanceTestEnv.DeleteWebhookConfig)
+	t.Run("revoke user creds", acceptanceTestEnv.RevokeCreds)
+}
+
+func TestRateLimit(t *testing.T) {
+	if runAcceptanceTests {
+		// Rate limit is only controllable in the fake Packet API
+		t.SkipNow()
+	}
+
+	acceptanceTestEnv, err := newAcceptanceTestEnv("testratelimit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer acceptanceTestEnv.Close()
+	t.Run("add config", acceptanceTestEnv.AddConfig)
+
+	t.Run("add user role", acceptanceTestEnv.AddUserRole)
+	t.Run("use up rate limit", acceptanceTestEnv.ExhaustRateLimit)
+	t.Run("check retryable error when quota doesn't reset in time", acceptanceTestEnv.ReadUserCredsThrottled)
+	t.Run("revoke user creds with low quota", acceptanceTestEnv.RevokeCreds)
+	t.Run("read user creds after quota reset", acceptanceTestEnv.ReadUserCreds)
+}
+
+func TestDeviceUnlock(t *testing.T) {
+	if !runAcceptanceTests || os.Getenv(envVarDeviceID) == "" {
+		t.SkipNow()
+	}
+
+	acceptanceTestEnv, err := newAcceptanceTestEnv("testdeviceunlockrole")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer acceptanceTestEnv.Close()
+	t.Run("add config", acceptanceTestEnv.AddConfig)
+
+	t.Run("lock testing device", acceptanceTestEnv.LockPacketDevice)
+	t.Run("add device-unlock role", acceptanceTestEnv.AddDeviceUnlockRole)
+	t.Run("read device-unlock role", acceptanceTestEnv.ReadRole)
+	t.Run("unlock device", acceptanceTestEnv.ReadDeviceUnlockCreds)
+
+	t.Run("renew device unlock", acceptanceTestEnv.RenewCreds)
+	t.Run("revoke device unlock", acceptanceTestEnv.RevokeCreds)
+	t.Run("check device is locked", acceptanceTestEnv.CheckPacketDeviceLocked)
+}
+
+func TestDeviceUnlockLeases(t *testing.T) {
+	if runAcceptanceTests {
+		// Devices are made up by the fake Packet API only
+		t.SkipNow()
+	}
+
+	acceptanceTestEnv, err := newAcceptanceTestEnv("testdeviceunlockleases")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer acceptanceTestEnv.Close()
+	t.Run("add config", acceptanceTestEnv.AddConfig)
+
+	t.Run("add unlocked testing device", acceptanceTestEnv.AddPacketDevice)
+	t.Run("add device-unlock role", acceptanceTestEnv.AddDeviceUnlockRole)
+	t.Run("unlock already unlocked device", acceptanceTestEnv.ReadDeviceUnlockCreds)
+	t.Run("revoke device unlock", acceptanceTestEnv.RevokeCreds)
+	t.Run("check device stays unlocked", acceptanceTestEnv.CheckPacketDeviceUnlocked)
+
+	t.Run("lock testing device", acceptanceTestEnv.LockPacketDevice)
+	t.Run("check failed unlock leaves device alone", acceptanceTestEnv.ReadDeviceUnlockCredsUpstreamFailure)
+	t.Run("unlock device", acceptanceTestEnv.ReadDeviceUnlockCreds)
+	t.Run("check failed unlock keeps earlier lease", acceptanceTestEnv.ReadDeviceUnlockCredsUpstreamFailure)
+	t.Run("unlock device again", acceptanceTestEnv.ReadOverlappingDeviceUnlockCreds)
+	t.Run("revoke earlier device unlock", acceptanceTestEnv.RevokeEarlierCreds)
+	t.Run("check device stays unlocked for later lease", acceptanceTestEnv.CheckPacketDeviceUnlocked)
+	t.Run("revoke later device unlock", acceptanceTestEnv.RevokeCreds)
+	t.Run("check device is locked", acceptanceTestEnv.CheckPacketDeviceLocked)
+}
+
+func TestReservationLoan(t *testing.T) {
+	if !runAcceptanceTests || os.Getenv(envVarPoolProject) == "" {
+		t.SkipNow()
+	}
+
+	acceptanceTestEnv, err := newAcceptanceTestEnv("testreservationrole")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer acceptanceTestEnv.Close()
+	t.Run("add config", acceptanceTestEnv.AddConfig)
+
+	t.Run("create testing project", acceptanceTestEnv.CreatePacketProject)
+	t.Run("add hardware-reservation role", acceptanceTestEnv.AddReservationRole)
+	t.Run("read hardware-reservation role", acceptanceTestEnv.ReadRole)
+	t.Run("loan hardware reservation", acceptanceTestEnv.ReadReservationCreds)
+
+	t.Run("renew hardware reservation loan", acceptanceTestEnv.RenewCreds)
+	t.Run("revoke hardware reservation loan", acceptanceTestEnv.RevokeCreds)
+	t.Run("remove testing project", acceptanceTestEnv.RemovePacketProject)
+}
+
+func TestReservationLoanRecords(t *testing.T) {
+	if runAcceptanceTests {
+		// Needs a pool project with a single free reservation
+		t.SkipNow()
+	}
+
+	acceptanceTestEnv, err := newAcceptanceTestEnv("testreservationloanrecords")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer acceptanceTestEnv.Close()
+	t.Run("add config", acceptanceTestEnv.AddConfig)
+
+	t.Run("create testing project", acceptanceTestEnv.CreatePacketProject)
+	t.Run("add hardware reservation to pool project", acceptanceTestEnv.AddPacketReservation)
+	t.Run("add hardware-reservation role", acceptanceTestEnv.AddReservationRole)
+	t.Run("loan the only reservation twice at once", acceptanceTestEnv.ReadReservationCredsConcurrently)
+	t.Run("check loaned reservation isn't loaned again", acceptanceTestEnv.ReadReservationCredsStaleList)
+	t.Run("revoke hardware reservation loan", acceptanceTestEnv.RevokeCreds)
+	t.Run("check reservation is returned", acceptanceTestEnv.CheckReservationReturned)
+	t.Run("loan returned reservation", acceptanceTestEnv.ReadReservationCreds)
+	t.Run("revoke returned reservation loan", acceptanceTestEnv.RevokeCreds)
+}
+
+func TestSpotMarketRequest(t *testing.T) {
+	if !runAcceptanceTests || os.Getenv(envVarSpotPlan) == "" || os.Getenv(envVarSpotFacility) == "" {
+		t.SkipNow()
+	}
+
+	acceptanceTestEnv, err := newAcceptanceTestEnv("testspotmarketrole")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer acceptanceTestEnv.Close()
+	t.Run("add config", acceptanceTestEnv.AddConfig)
+
+	t.Run("create testing project", acceptanceTestEnv.CreatePacketProject)
+	t.Run("add spot-market-request role", acceptanceTestEnv.AddSpotMarketRole)
+	t.Run("read spot-market-request role", acceptanceTestEnv.ReadRole)
+	t.Run("check bid price cap", acceptanceTestEnv.ReadSpotMarketCredsOverBid)
+	t.Run("create spot market request", acceptanceTestEnv.ReadSpotMarketCreds)
+
+	t.Run("renew spot market request", acceptanceTestEnv.RenewCreds)
+	t.Run("revoke spot market request", acceptanceTestEnv.RevokeCreds)
+	t.Run("remove testing project", acceptanceTestEnv.RemovePacketProject)
+}
+
+func TestSpotMarketLimits(t *testing.T) {
+	if runAcceptanceTests {
+		// Covered by TestSpotMarketRequest against the real API
+		t.SkipNow()
+	}
+
+	acceptanceTestEnv, err := newAcceptanceTestEnv("testspotmarketlimits")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer acceptanceTestEnv.Close()
+	acceptanceTestEnv.TestSpotPlan = "c3.small.x86"
+	acceptanceTestEnv.TestSpotFacility = "sjc1"
+	t.Run("add config", acceptanceTestEnv.AddConfig)
+
+	t.Run("create testing project", acceptanceTestEnv.CreatePacketProject)
+	t.Run("check error for bad max_bid_price of role", acceptanceTestEnv.AddSpotMarketRoleBadBid)
+	t.Run("add spot-market-request role", acceptanceTestEnv.AddSpotMarketRole)
+	t.Run("check bid price cap", acceptanceTestEnv.ReadSpotMarketCredsOverBid)
+	t.Run("check NaN and infinite bids", acceptanceTestEnv.ReadSpotMarketCredsBadBid)
+	t.Run("check device count limits", acceptanceTestEnv.ReadSpotMarketCredsOverDevices)
+}
+
+func TestVPN(t *testing.T) {
+	if !runAcceptanceTests || os.Getenv(envVarVPNFacility) == "" {
+		t.SkipNow()
+	}
+
+	acceptanceTestEnv, err := newAcceptanceTestEnv("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer acceptanceTestEnv.Close()
+	t.Run("add config", acceptanceTestEnv.AddConfig)
+
+	t.Run("read vpn config", acceptanceTestEnv.ReadVPNCreds)
+	t.Run("renew vpn config", acceptanceTestEnv.RenewCreds)
+	t.Run("revoke vpn config", acceptanceTestEnv.RevokeCreds)
+}
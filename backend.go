@@ -5,8 +5,13 @@ import (
 	"fmt"
 	"strings"
 	"sync"
+	"time"
 
+	multierror "github.com/hashicorp/go-multierror"
+	retryablehttp "github.com/hashicorp/go-retryablehttp"
 	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/consts"
+	"github.com/hashicorp/vault/sdk/helper/locksutil"
 	"github.com/hashicorp/vault/sdk/logical"
 
 	"github.com/packethost/packngo"
@@ -25,25 +30,62 @@ func Factory(ctx context.Context, conf *logical.BackendConfig) (logical.Backend,
 func NewBackend(system logical.SystemView) *backend {
 	var b backend
 	b.system = system
+	b.httpClient = newHTTPClient()
+	b.roleLocks = locksutil.CreateLocks()
+	b.poolLocks = locksutil.CreateLocks()
 	b.Backend = &framework.Backend{
 		Help: strings.TrimSpace(backendHelp),
 
 		PathsSpecial: &logical.Paths{
+			// Entries are exact keys, unless they end with a slash
 			SealWrapStorage: []string{
 				"config",
+				webhookConfigKey,
+				poolPrefix,
+			},
+
+			// State of API keys issued or created by this cluster isn't
+			// replicated, as performance secondaries hold their own leases
+			LocalStorage: []string{
+				issuedKeyPrefix,
+				issuanceLogPrefix,
+				fingerprintPrefix,
+				poolPrefix,
+				revocationsPrefix,
+				webhookOutboxPrefix,
 			},
 		},
 
 		Paths: []*framework.Path{
 			b.pathRole(),
 			b.pathConfig(),
+			b.pathConfigWebhooks(),
 			b.pathCredentials(),
+			b.pathCredentialsBatch(),
+			b.pathCredentialsClaim(),
+			b.pathVPN(),
+			b.pathStatus(),
+			b.pathLookup(),
+			b.pathReconcile(),
+			b.pathRevocationsList(),
+			b.pathRevocation(),
+			b.pathRevocationAction(),
 		},
 
 		Secrets: []*framework.Secret{
 			b.pathSecrets(),
+			b.pathSecretsDeviceUnlock(),
+			b.pathSecretsReservation(),
+			b.pathSecretsSpotMarket(),
+			b.pathSecretsVPN(),
+			b.pathSecretsBatch(),
 		},
 
+		InitializeFunc: b.initialize,
+		PeriodicFunc:   b.periodicFunc,
+		Clean:          b.clean,
+		Invalidate:     b.invalidate,
+
 		BackendType: logical.TypeLogical,
 	}
 	return &b
@@ -51,54 +93,171 @@ func NewBackend(system logical.SystemView) *backend {
 
 type backend struct {
 	*framework.Backend
-	client *packngo.Client
-	lock   sync.RWMutex
 	system logical.SystemView
-}
 
-func (b *backend) Client(ctx context.Context, s logical.Storage) (*packngo.Client, error) {
-	b.lock.RLock()
+	// lock guards clients, one per configured API token, and the state of
+	// picking among them
+	lock           sync.RWMutex
+	clients        []*apiClient
+	nextClient     int
+	tokenSelection string
 
-	// If we already have a client, return it
-	if b.client != nil {
-		b.lock.RUnlock()
-		return b.client, nil
-	}
+	// httpClient is shared by all Packet API clients
+	httpClient *retryablehttp.Client
+
+	// apiURL overrides the Packet API endpoint, e.g. for testing against
+	// a fake API. Empty means the default packngo endpoint.
+	apiURL string
+
+	// health records outcomes of API calls and periodic runs for status
+	health health
+
+	// roleLocks serialize checking and updating of per-role issuance limits
+	roleLocks []*locksutil.LockEntry
+
+	// poolLocks serialize taking keys from and pruning of per-role pools,
+	// poolRefills holds names of roles whose pools are being refilled
+	poolLocks   []*locksutil.LockEntry
+	poolRefills sync.Map
+
+	// background tracks goroutines outliving the request which started them
+	background sync.WaitGroup
 
+	// revocationLock serializes updates of the revocation retry queue.
+	revocationLock sync.Mutex
+
+	// outboxLock serializes adding events to the webhook outbox, and
+	// deliveryLock deliveries of them. deliveryQueued is set while a
+	// delivery waits for deliveryLock.
+	outboxLock     sync.Mutex
+	deliveryLock   sync.Mutex
+	deliveryQueued int32
+
+	// vpnLock serializes enabling and disabling of VPN against the
+	// bookkeeping of outstanding VPN leases.
+	vpnLock sync.Mutex
+
+	// deviceLock serializes unlocking and locking of devices against the
+	// bookkeeping of outstanding device-unlock leases.
+	deviceLock sync.Mutex
+
+	// reservationLock serializes loaning and returning of hardware
+	// reservations against the records of loaned ones.
+	reservationLock sync.Mutex
+
+	// batchLock serializes claiming of API keys out of batch leases against
+	// revocation of batch leases.
+	batchLock sync.Mutex
+}
+
+// Client returns a client of the Packet API for the next call, picked
+// among the configured API tokens which weren't rejected by Packet.
+func (b *backend) Client(ctx context.Context, s logical.Storage) (*apiClient, error) {
+	b.lock.RLock()
+	clients := b.clients
 	b.lock.RUnlock()
 
-	// Otherwise, attempt to make connection
-	entry, err := s.Get(ctx, "config")
-	if err != nil {
-		return nil, err
-	}
-	if entry == nil {
-		return nil, fmt.Errorf("setup the config first")
+	// If we don't have clients yet, attempt to make them
+	if clients == nil {
+		conf, err := readConfig(ctx, s)
+		if err != nil {
+			return nil, err
+		}
+		if conf == nil {
+			return nil, fmt.Errorf("setup the config first")
+		}
+
+		b.lock.Lock()
+		// If the clients were created during the lock switch, use them
+		if b.clients == nil {
+			b.clients = newClients(conf)
+			b.tokenSelection = conf.TokenSelection
+		}
+		clients = b.clients
+		b.lock.Unlock()
 	}
+	return b.pickClient(clients)
+}
 
-	var conf packetSecretsEngineConfig
-	if err := entry.DecodeJSON(&conf); err != nil {
-		return nil, err
+// tokenClient returns a client of the Packet API authenticating with given
+// token. Clients share the HTTP client of the backend, and with it the
+// connections to the API.
+func (b *backend) tokenClient(token string) (*packngo.Client, error) {
+	if b.apiURL != "" {
+		return packngo.NewClientWithBaseURL("Hashicorp Vault", token, b.httpClient, b.apiURL)
 	}
+	return packngo.NewClientWithAuth("Hashicorp Vault", token, b.httpClient), nil
+}
+
+// newHTTPClient returns an HTTP client with the retry policy packngo uses
+// for clients it makes itself.
+func newHTTPClient() *retryablehttp.Client {
+	c := retryablehttp.NewClient()
+	c.RetryWaitMin = time.Second
+	c.RetryWaitMax = 30 * time.Second
+	c.RetryMax = 10
+	c.CheckRetry = packngo.PacketRetryPolicy
+	return c
+}
 
+// resetClient makes Client() read the config again next time it's called.
+// Tokens taken out of rotation are put back.
+func (b *backend) resetClient(_ context.Context) {
 	b.lock.Lock()
 	defer b.lock.Unlock()
 
-	// If the client was created during the lock switch, return it
-	if b.client != nil {
-		return b.client, nil
+	b.clients = nil
+	b.nextClient = 0
+}
+
+func (b *backend) initialize(ctx context.Context, req *logical.InitializationRequest) error {
+	if b.replicatedReadOnly() {
+		// Config and roles are migrated by the primary and replicated
+		return nil
 	}
+	return b.migrateStorage(ctx, req.Storage)
+}
 
-	b.client = packngo.NewClientWithAuth("Hashicorp Vault", conf.APIToken, nil)
-	return b.client, nil
+// replicatedReadOnly reports whether replicated storage is read-only on this
+// node, i.e. it's a performance standby or in a performance secondary
+// cluster, unless the mount is local.
+func (b *backend) replicatedReadOnly() bool {
+	state := b.System().ReplicationState()
+	return state.HasState(consts.ReplicationPerformanceStandby) ||
+		(!b.System().LocalMount() && state.HasState(consts.ReplicationPerformanceSecondary))
 }
 
-// resetClient forces a connection next time Client() is called.
-func (b *backend) resetClient(_ context.Context) {
-	b.lock.Lock()
-	defer b.lock.Unlock()
+// periodicFunc runs the jobs only on the active node of the primary cluster,
+// so that two clusters never both sweep or delete keys. Local mounts exist on
+// one cluster only, so their jobs run on its active node.
+func (b *backend) periodicFunc(ctx context.Context, req *logical.Request) error {
+	state := b.System().ReplicationState()
+	if state.HasState(consts.ReplicationPerformanceStandby) {
+		// Standbys can't write storage, the active node runs the jobs
+		return nil
+	}
+	if state.HasState(consts.ReplicationPerformanceSecondary) && !b.System().LocalMount() {
+		return nil
+	}
+	var result error
+	if err := b.retryRevocations(ctx, req.Storage); err != nil {
+		result = multierror.Append(result, err)
+	}
+	if err := b.expireSlots(ctx, req.Storage); err != nil {
+		result = multierror.Append(result, err)
+	}
+	if err := b.maintainPools(ctx, req.Storage); err != nil {
+		result = multierror.Append(result, err)
+	}
+	if err := b.deliverWebhooks(ctx, req.Storage); err != nil {
+		result = multierror.Append(result, err)
+	}
+	b.health.recordPeriodicRun(result)
+	return result
+}
 
-	b.client = nil
+func (b *backend) clean(_ context.Context) {
+	b.background.Wait()
 }
 
 func (b *backend) invalidate(ctx context.Context, key string) {
@@ -0,0 +1,105 @@
+package packet
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/hashicorp/vault/sdk/helper/cidrutil"
+	"github.com/hashicorp/vault/sdk/helper/strutil"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// remoteIP returns the IP address of the client of the request, empty if
+// the request doesn't carry it.
+func remoteIP(req *logical.Request) string {
+	if req.Connection == nil {
+		return ""
+	}
+	addr := req.Connection.RemoteAddr
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	return addr
+}
+
+// checkCaller checks the request against the caller bindings of the role. It
+// fails closed: a binding which can't be checked, e.g. for a request without
+// client address or entity, denies the request. The returned error explains
+// the denial.
+func (b *backend) checkCaller(req *logical.Request, role *roleEntry) error {
+	if len(role.BoundCIDRs) > 0 {
+		ip := remoteIP(req)
+		if ip == "" {
+			return fmt.Errorf("role is bound to CIDR blocks, but the request has no client address")
+		}
+		belongs, err := cidrutil.IPBelongsToCIDRBlocksSlice(ip, role.BoundCIDRs)
+		if err != nil {
+			return fmt.Errorf("failed to check client address %s against bound_cidrs of the role: %v", ip, err)
+		}
+		if !belongs {
+			return fmt.Errorf("client address %s isn't in bound_cidrs of the role", ip)
+		}
+	}
+
+	if len(role.AllowedEntityIDs) == 0 && len(role.AllowedGroupNames) == 0 && len(role.AllowedAliasMountAccessors) == 0 {
+		return nil
+	}
+	if req.EntityID == "" {
+		return fmt.Errorf("role is bound to identities, but the request has no entity")
+	}
+	if len(role.AllowedEntityIDs) > 0 && !strutil.StrListContains(role.AllowedEntityIDs, req.EntityID) {
+		return fmt.Errorf("entity %s isn't in allowed_entity_ids of the role", req.EntityID)
+	}
+
+	if len(role.AllowedGroupNames) > 0 {
+		groups, err := b.system.GroupsForEntity(req.EntityID)
+		if err != nil {
+			return fmt.Errorf("failed to look up groups of entity %s: %v", req.EntityID, err)
+		}
+		var names []string
+		for _, g := range groups {
+			names = append(names, g.Name)
+		}
+		if !intersects(role.AllowedGroupNames, names) {
+			return fmt.Errorf("entity %s isn't a member of any of allowed_group_names of the role", req.EntityID)
+		}
+	}
+
+	// Plugins aren't told which auth mount the token of the request came
+	// from, so the binding only requires the entity to have an alias on
+	// one of the mounts
+	if len(role.AllowedAliasMountAccessors) > 0 {
+		entity, err := b.system.EntityInfo(req.EntityID)
+		if err != nil {
+			return fmt.Errorf("failed to look up entity %s: %v", req.EntityID, err)
+		}
+		if entity == nil {
+			return fmt.Errorf("entity %s doesn't exist", req.EntityID)
+		}
+		var accessors []string
+		for _, alias := range entity.Aliases {
+			accessors = append(accessors, alias.MountAccessor)
+		}
+		if !intersects(role.AllowedAliasMountAccessors, accessors) {
+			return fmt.Errorf("entity %s has no alias on any of allowed_alias_mount_accessors of the role", req.EntityID)
+		}
+	}
+	return nil
+}
+
+func intersects(a, b []string) bool {
+	for _, s := range a {
+		if strutil.StrListContains(b, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// callerDeniedResponse logs the denial of a request by caller bindings of a
+// role and returns the permission denied response.
+func (b *backend) callerDeniedResponse(req *logical.Request, roleName string, err error) (*logical.Response, error) {
+	b.Logger().Warn("caller denied by role bindings", "role", roleName, "operation", req.Operation,
+		"entity_id", req.EntityID, "error", err)
+	return logical.ErrorResponse(err.Error()), logical.ErrPermissionDenied
+}
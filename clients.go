@@ -0,0 +1,141 @@
+package packet
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/packethost/packngo"
+)
+
+// apiClient is one of the configured API tokens with its rate limit. Calls
+// get a Packet API client of their own from tokenClient.
+type apiClient struct {
+	token string
+
+	// index is the position of the token in config, fingerprint identifies
+	// the token in status without revealing it, by the first 8 characters of
+	// the fingerprint of the token
+	index       int
+	fingerprint string
+
+	// limiter throttles calls made with the token
+	limiter rateLimiter
+
+	// disabled is set when Packet rejects the token, which takes it out of
+	// rotation until the config is written again. Guarded by backend.lock.
+	disabled      bool
+	disabledAt    time.Time
+	disabledError string
+}
+
+// newClients makes a client for every configured API token.
+func newClients(conf *packetSecretsEngineConfig) []*apiClient {
+	var clients []*apiClient
+	for i, token := range conf.tokens() {
+		clients = append(clients, &apiClient{token: token, index: i, fingerprint: fingerprint(token)[:8]})
+	}
+	return clients
+}
+
+// checkTokenOwners checks that all tokens belong to the same Packet user.
+// Calls for a lease may use any of the tokens, so each of them has to see
+// the API keys created with the others.
+func (b *backend) checkTokenOwners(tokens []string) error {
+	var owner *packngo.User
+	for i, token := range tokens {
+		short := fingerprint(token)[:8]
+		c, err := b.tokenClient(token)
+		if err != nil {
+			return err
+		}
+		user, _, err := c.Users.Current()
+		if err != nil {
+			return fmt.Errorf("failed to look up the user of api_tokens entry %d, fingerprint %s: %v", i, short, err)
+		}
+		if owner == nil {
+			owner = user
+			continue
+		}
+		if user.ID != owner.ID {
+			return fmt.Errorf("api_tokens must belong to the same user, entry %d, fingerprint %s, belongs to %s and entry 0 to %s",
+				i, short, user.Email, owner.Email)
+		}
+	}
+	return nil
+}
+
+// pickClient returns the client for the next call, by turns or the one with
+// most remaining requests, depending on token_selection in config. Tokens of
+// unknown rate-limit state count as having most remaining requests.
+func (b *backend) pickClient(clients []*apiClient) (*apiClient, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	n := len(clients)
+	var picked *apiClient
+	best := -1
+	for i := 0; i < n; i++ {
+		c := clients[(b.nextClient+i)%n]
+		if c.disabled {
+			continue
+		}
+		if b.tokenSelection != selectionRateLimit {
+			picked = c
+			break
+		}
+		known, remaining, _ := c.limiter.state()
+		if !known {
+			remaining = math.MaxInt32
+		}
+		if remaining > best {
+			picked, best = c, remaining
+		}
+	}
+	if picked == nil {
+		return nil, errors.New("all configured API tokens were rejected by Packet, write valid ones to config")
+	}
+	b.nextClient = (picked.index + 1) % n
+	return picked, nil
+}
+
+// disableClient takes the token of a client rejected by Packet out of
+// rotation, unless it's the last one in rotation. It reports whether the
+// call can be retried with another token.
+func (b *backend) disableClient(c *apiClient, cause error) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if c.disabled {
+		// Another call got rejected with the same token meanwhile
+		return true
+	}
+	current := false
+	active := 0
+	for _, other := range b.clients {
+		current = current || other == c
+		if !other.disabled {
+			active++
+		}
+	}
+	if !current {
+		// The config was written meanwhile, retry with the new tokens
+		return true
+	}
+	if active <= 1 {
+		return false
+	}
+	c.disabled = true
+	c.disabledAt = time.Now()
+	c.disabledError = cause.Error()
+	b.Logger().Warn("API token rejected by Packet, taking it out of rotation", "token_index", c.index,
+		"token_fingerprint", c.fingerprint, "error", cause)
+	return true
+}
+
+func isUnauthorized(err error) bool {
+	errResp, ok := err.(*packngo.ErrorResponse)
+	return ok && errResp.Response != nil && errResp.Response.StatusCode == http.StatusUnauthorized
+}
@@ -3,13 +3,27 @@ package main
 import (
 	"os"
 
+	metrics "github.com/armon/go-metrics"
 	"github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/vault/api"
 	"github.com/hashicorp/vault/sdk/plugin"
 	packet "github.com/t0mk/vault-plugin-secrets-packet"
 )
 
+// envStatsdAddr sets the statsd address for metrics of the plugin. Vault
+// doesn't forward metrics of external plugins to its telemetry sinks.
+const envStatsdAddr = "PACKET_PLUGIN_STATSD_ADDR"
+
 func main() {
+	if addr := os.Getenv(envStatsdAddr); addr != "" {
+		sink, err := metrics.NewStatsdSink(addr)
+		if err != nil {
+			hclog.New(&hclog.LoggerOptions{}).Error("failed to set up statsd sink", "error", err)
+			os.Exit(1)
+		}
+		metrics.NewGlobal(metrics.DefaultConfig("vault"), sink)
+	}
+
 	apiClientMeta := &api.PluginAPIClientMeta{}
 	flags := apiClientMeta.FlagSet()
 	flags.Parse(os.Args[1:])
@@ -0,0 +1,75 @@
+package packet
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Output formats of user and project credentials, rendered into the config
+// field of the response.
+const (
+	// FormatEnv renders shell export lines.
+	FormatEnv = "env"
+	// FormatPacketCLI renders a Packet CLI config file.
+	FormatPacketCLI = "packet-cli"
+	// FormatTerraform renders a Terraform variables file for the Packet
+	// provider.
+	FormatTerraform = "terraform"
+	// FormatKubernetes renders the JSON secret of the Packet
+	// cloud-controller-manager and CSI driver.
+	FormatKubernetes = "kubernetes"
+)
+
+var credsFormats = []string{FormatEnv, FormatPacketCLI, FormatTerraform, FormatKubernetes}
+
+func validCredsFormat(format string) bool {
+	for _, f := range credsFormats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+// renderCreds renders an API token, and the project ID of project roles, in
+// given format. Tokens and project IDs are alphanumeric with dashes, quoting
+// is still applied so that the output stays valid for any value.
+func renderCreds(format, token, projectID string) (string, error) {
+	var b strings.Builder
+	switch format {
+	case FormatEnv:
+		fmt.Fprintf(&b, "export PACKET_AUTH_TOKEN=%s\n", shellQuote(token))
+		if projectID != "" {
+			fmt.Fprintf(&b, "export PACKET_PROJECT_ID=%s\n", shellQuote(projectID))
+		}
+	case FormatPacketCLI:
+		fmt.Fprintf(&b, "token: %s\n", strconv.Quote(token))
+		if projectID != "" {
+			fmt.Fprintf(&b, "project-id: %s\n", strconv.Quote(projectID))
+		}
+	case FormatTerraform:
+		fmt.Fprintf(&b, "packet_auth_token = %s\n", strconv.Quote(token))
+		if projectID != "" {
+			fmt.Fprintf(&b, "packet_project_id = %s\n", strconv.Quote(projectID))
+		}
+	case FormatKubernetes:
+		out, err := json.Marshal(struct {
+			APIKey    string `json:"apiKey"`
+			ProjectID string `json:"projectID,omitempty"`
+		}{token, projectID})
+		if err != nil {
+			return "", err
+		}
+		b.Write(out)
+	default:
+		return "", fmt.Errorf("format should be one of %s, was %s", strings.Join(credsFormats, ", "), format)
+	}
+	return b.String(), nil
+}
+
+// shellQuote quotes s for POSIX shells.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
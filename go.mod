@@ -3,9 +3,13 @@ module github.com/t0mk/vault-plugin-secrets-packet
 go 1.13
 
 require (
+	github.com/armon/go-metrics v0.3.3
 	github.com/armon/go-radix v1.0.0 // indirect
 	github.com/golang/protobuf v1.3.3 // indirect
 	github.com/hashicorp/go-hclog v0.12.0
+	github.com/hashicorp/go-multierror v1.0.0
+	github.com/hashicorp/go-retryablehttp v0.6.2
+	github.com/hashicorp/go-uuid v1.0.2
 	github.com/hashicorp/go-version v1.2.0 // indirect
 	github.com/hashicorp/vault/api v1.0.5-0.20200215224050-f6547fa8e820
 	github.com/hashicorp/vault/sdk v0.1.14-0.20200215224050-f6547fa8e820
@@ -0,0 +1,598 @@
+package packet
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/packethost/packngo"
+)
+
+// packetMock is a fake Packet API for running the test steps offline. It
+// keeps API keys, projects, SSH keys and devices in memory, authenticates requests by
+// the X-Auth-Token header, and can inject failures and latency.
+type packetMock struct {
+	*httptest.Server
+
+	mu sync.Mutex
+
+	RootToken string
+	User      packngo.User
+	// OtherRootToken authenticates as OtherUser, a user of another account
+	OtherRootToken string
+	OtherUser      packngo.User
+	// OrganizationID is the default organization of User, which projects
+	// are created in unless the request names one
+	OrganizationID string
+
+	apiKeys  map[string]*mockAPIKey
+	projects map[string]*packngo.Project
+	sshKeys  map[string]*packngo.SSHKey
+	devices  map[string]*packngo.DeviceRaw
+
+	reservations map[string]*mockReservation
+	// staleReservations makes lists of hardware reservations report them
+	// in the project they were added to, as Packet may do for a while
+	// after a reservation moved
+	staleReservations bool
+
+	failures    []*mockFailure
+	latency     time.Duration
+	propagation time.Duration
+
+	RateLimit     int
+	RateRemaining int
+	RateReset     time.Time
+
+	// Calls counts requests by "METHOD /path"
+	Calls map[string]int
+	// TokenCalls counts requests by the X-Auth-Token they were made with
+	TokenCalls map[string]int
+}
+
+type mockAPIKey struct {
+	packngo.APIKey
+	projectID string
+	createdAt time.Time
+}
+
+type mockReservation struct {
+	packngo.HardwareReservation
+	addedProjectID string
+}
+
+type mockFailure struct {
+	method     string
+	pathPrefix string
+	status     int
+	times      int
+}
+
+func newPacketMock() *packetMock {
+	m := &packetMock{
+		RootToken: mockUUID(),
+		User: packngo.User{
+			ID:       mockUUID(),
+			FullName: "Vault Test",
+			Email:    "vault-test@example.com",
+		},
+		OtherRootToken: mockUUID(),
+		OtherUser: packngo.User{
+			ID:       mockUUID(),
+			FullName: "Someone Else",
+			Email:    "someone-else@example.com",
+		},
+		OrganizationID: mockUUID(),
+		apiKeys:        map[string]*mockAPIKey{},
+		projects:       map[string]*packngo.Project{},
+		sshKeys:        map[string]*packngo.SSHKey{},
+		devices:        map[string]*packngo.DeviceRaw{},
+		reservations:   map[string]*mockReservation{},
+		RateLimit:      5000,
+		RateRemaining:  5000,
+		RateReset:      time.Now().Add(time.Hour),
+		Calls:          map[string]int{},
+		TokenCalls:     map[string]int{},
+	}
+	m.Server = httptest.NewServer(http.HandlerFunc(m.serveHTTP))
+	return m
+}
+
+// mockUUID generates random UUID in the version 4 format the Packet API uses.
+func mockUUID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// FailNext makes the next times requests with given method and path prefix
+// fail with given HTTP status. Empty method matches any method.
+func (m *packetMock) FailNext(method, pathPrefix string, status, times int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.failures = append(m.failures, &mockFailure{
+		method:     method,
+		pathPrefix: pathPrefix,
+		status:     status,
+		times:      times,
+	})
+}
+
+// SetLatency delays every response by d.
+func (m *packetMock) SetLatency(d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.latency = d
+}
+
+// SetPropagation makes new API keys fail authentication for d after they're
+// created.
+func (m *packetMock) SetPropagation(d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.propagation = d
+}
+
+// SetRateLimit sets the rate-limit state reported in response headers.
+func (m *packetMock) SetRateLimit(remaining int, reset time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.RateRemaining = remaining
+	m.RateReset = reset
+}
+
+// TokenCallCount returns how many requests were made with token.
+func (m *packetMock) TokenCallCount(token string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.TokenCalls[token]
+}
+
+// CallCount returns how many requests were made with method to path.
+func (m *packetMock) CallCount(method, path string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.Calls[method+" "+path]
+}
+
+// APIKeyExists reports whether API key with given ID exists.
+func (m *packetMock) APIKeyExists(id string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.apiKeys[id]
+	return ok
+}
+
+// APIKeyCount returns the number of existing API keys.
+func (m *packetMock) APIKeyCount() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.apiKeys)
+}
+
+// AddAPIKey creates an API key directly in the mock, bypassing the API.
+func (m *packetMock) AddAPIKey(projectID, description string, readOnly bool) packngo.APIKey {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.createAPIKey(projectID, description, readOnly)
+}
+
+// DeleteAPIKey deletes an API key directly in the mock, bypassing the API.
+func (m *packetMock) DeleteAPIKey(id string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.apiKeys, id)
+}
+
+// AddDevice creates a device directly in the mock, bypassing the API.
+func (m *packetMock) AddDevice(projectID string, locked bool) packngo.DeviceRaw {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	d := &packngo.DeviceRaw{
+		ID:       mockUUID(),
+		Hostname: "vault-test",
+		Locked:   locked,
+		Project:  &packngo.Project{ID: projectID},
+	}
+	m.devices[d.ID] = d
+	return *d
+}
+
+// AddReservation creates a provisionable hardware reservation directly in the
+// mock, bypassing the API.
+func (m *packetMock) AddReservation(projectID string) packngo.HardwareReservation {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r := &mockReservation{
+		HardwareReservation: packngo.HardwareReservation{
+			ID:            mockUUID(),
+			Facility:      packngo.Facility{Code: "ewr1"},
+			Plan:          packngo.Plan{Slug: "baremetal_0"},
+			Provisionable: true,
+			Project:       packngo.Project{ID: projectID},
+		},
+		addedProjectID: projectID,
+	}
+	m.reservations[r.ID] = r
+	return r.HardwareReservation
+}
+
+// ReservationProjectID returns the project of hardware reservation with given
+// ID.
+func (m *packetMock) ReservationProjectID(id string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.reservations[id].Project.ID
+}
+
+// SetStaleReservations makes lists of hardware reservations report them in
+// the project they were added to, regardless of moves.
+func (m *packetMock) SetStaleReservations(stale bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.staleReservations = stale
+}
+
+// DeviceLocked reports whether device with given ID is locked.
+func (m *packetMock) DeviceLocked(id string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.devices[id].Locked
+}
+
+func (m *packetMock) createAPIKey(projectID, description string, readOnly bool) packngo.APIKey {
+	k := &mockAPIKey{
+		APIKey: packngo.APIKey{
+			ID:          mockUUID(),
+			Description: description,
+			Token:       strings.Replace(mockUUID(), "-", "", -1),
+			ReadOnly:    readOnly,
+			Created:     time.Now().UTC().Format(time.RFC3339),
+		},
+		projectID: projectID,
+		createdAt: time.Now(),
+	}
+	if projectID != "" {
+		k.Project = &packngo.Project{ID: projectID}
+	} else {
+		u := m.User
+		k.User = &u
+	}
+	m.apiKeys[k.ID] = k
+	return k.APIKey
+}
+
+func (m *packetMock) writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if v != nil {
+		json.NewEncoder(w).Encode(v)
+	}
+}
+
+func (m *packetMock) writeError(w http.ResponseWriter, status int, msg string) {
+	m.writeJSON(w, status, map[string][]string{"errors": {msg}})
+}
+
+// authenticate returns the API key used by the request. Root token is
+// represented by a read-write user key.
+func (m *packetMock) authenticate(r *http.Request) *mockAPIKey {
+	token := r.Header.Get("X-Auth-Token")
+	if token == "" {
+		return nil
+	}
+	if token == m.RootToken {
+		return &mockAPIKey{}
+	}
+	if token == m.OtherRootToken {
+		u := m.OtherUser
+		return &mockAPIKey{APIKey: packngo.APIKey{User: &u}}
+	}
+	for _, k := range m.apiKeys {
+		if k.Token == token && time.Since(k.createdAt) >= m.propagation {
+			return k
+		}
+	}
+	return nil
+}
+
+func (m *packetMock) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	latency := m.latency
+	m.mu.Unlock()
+	if latency > 0 {
+		time.Sleep(latency)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	path := strings.TrimSuffix(r.URL.Path, "/")
+	m.Calls[r.Method+" "+path]++
+	m.TokenCalls[r.Header.Get("X-Auth-Token")]++
+
+	if time.Now().After(m.RateReset) {
+		m.RateRemaining = m.RateLimit
+		m.RateReset = time.Now().Add(time.Hour)
+	}
+	w.Header().Set("X-Request-Id", mockUUID())
+	w.Header().Set("X-RateLimit-Limit", strconv.Itoa(m.RateLimit))
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(m.RateRemaining))
+	w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(m.RateReset.Unix(), 10))
+	if m.RateRemaining > 0 {
+		m.RateRemaining--
+	}
+
+	for i, f := range m.failures {
+		if (f.method == "" || f.method == r.Method) && strings.HasPrefix(path, f.pathPrefix) {
+			f.times--
+			if f.times <= 0 {
+				m.failures = append(m.failures[:i], m.failures[i+1:]...)
+			}
+			m.writeError(w, f.status, fmt.Sprintf("injected failure %d", f.status))
+			return
+		}
+	}
+
+	key := m.authenticate(r)
+	if key == nil {
+		m.writeError(w, http.StatusUnauthorized, "Invalid authentication token")
+		return
+	}
+	if key.ReadOnly && r.Method != http.MethodGet {
+		m.writeError(w, http.StatusForbidden, "You are not authorized to perform this action")
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	if key.projectID != "" && (parts[0] != "projects" || len(parts) < 2 || parts[1] != key.projectID) {
+		m.writeError(w, http.StatusForbidden, "You are not authorized to perform this action")
+		return
+	}
+
+	switch parts[0] {
+	case "user":
+		m.serveUser(w, r, key, parts[1:])
+	case "projects":
+		m.serveProjects(w, r, parts[1:])
+	case "ssh-keys":
+		m.serveSSHKeys(w, r, "", parts[1:])
+	case "devices":
+		m.serveDevices(w, r, parts[1:])
+	case "hardware-reservations":
+		m.serveReservations(w, r, parts[1:])
+	default:
+		m.writeError(w, http.StatusNotFound, "Not found")
+	}
+}
+
+func (m *packetMock) serveUser(w http.ResponseWriter, r *http.Request, key *mockAPIKey, parts []string) {
+	switch {
+	case len(parts) == 0 && r.Method == http.MethodGet:
+		if key.User != nil {
+			m.writeJSON(w, http.StatusOK, key.User)
+			return
+		}
+		m.writeJSON(w, http.StatusOK, m.User)
+	case len(parts) >= 1 && parts[0] == "api-keys":
+		m.serveAPIKeys(w, r, "", parts[1:])
+	default:
+		m.writeError(w, http.StatusNotFound, "Not found")
+	}
+}
+
+func (m *packetMock) serveAPIKeys(w http.ResponseWriter, r *http.Request, projectID string, parts []string) {
+	switch {
+	case len(parts) == 0 && r.Method == http.MethodGet:
+		keys := []packngo.APIKey{}
+		for _, k := range m.apiKeys {
+			if k.projectID == projectID {
+				keys = append(keys, k.APIKey)
+			}
+		}
+		m.writeJSON(w, http.StatusOK, map[string]interface{}{"api_keys": keys})
+	case len(parts) == 0 && r.Method == http.MethodPost:
+		var cr packngo.APIKeyCreateRequest
+		if err := json.NewDecoder(r.Body).Decode(&cr); err != nil {
+			m.writeError(w, http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+		m.writeJSON(w, http.StatusCreated, m.createAPIKey(projectID, cr.Description, cr.ReadOnly))
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		if _, ok := m.apiKeys[parts[0]]; !ok {
+			m.writeError(w, http.StatusNotFound, "Not found")
+			return
+		}
+		delete(m.apiKeys, parts[0])
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		m.writeError(w, http.StatusNotFound, "Not found")
+	}
+}
+
+func (m *packetMock) serveProjects(w http.ResponseWriter, r *http.Request, parts []string) {
+	if len(parts) == 0 {
+		switch r.Method {
+		case http.MethodGet:
+			projects := []packngo.Project{}
+			for _, p := range m.projects {
+				projects = append(projects, *p)
+			}
+			m.writeJSON(w, http.StatusOK, map[string]interface{}{"projects": projects})
+		case http.MethodPost:
+			var cr packngo.ProjectCreateRequest
+			if err := json.NewDecoder(r.Body).Decode(&cr); err != nil {
+				m.writeError(w, http.StatusUnprocessableEntity, err.Error())
+				return
+			}
+			if cr.OrganizationID == "" {
+				cr.OrganizationID = m.OrganizationID
+			}
+			p := &packngo.Project{
+				ID:           mockUUID(),
+				Name:         cr.Name,
+				Organization: packngo.Organization{ID: cr.OrganizationID},
+			}
+			m.projects[p.ID] = p
+			m.writeJSON(w, http.StatusCreated, p)
+		default:
+			m.writeError(w, http.StatusNotFound, "Not found")
+		}
+		return
+	}
+
+	p, ok := m.projects[parts[0]]
+	if !ok {
+		m.writeError(w, http.StatusNotFound, "Not found")
+		return
+	}
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		m.writeJSON(w, http.StatusOK, p)
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		delete(m.projects, p.ID)
+		for id, k := range m.apiKeys {
+			if k.projectID == p.ID {
+				delete(m.apiKeys, id)
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case len(parts) >= 2 && parts[1] == "api-keys":
+		m.serveAPIKeys(w, r, p.ID, parts[2:])
+	case len(parts) >= 2 && parts[1] == "ssh-keys":
+		m.serveSSHKeys(w, r, p.ID, parts[2:])
+	case len(parts) == 2 && parts[1] == "hardware-reservations" && r.Method == http.MethodGet:
+		reservations := []packngo.HardwareReservation{}
+		for _, hr := range m.reservations {
+			listed := hr.Project
+			if m.staleReservations {
+				listed = packngo.Project{ID: hr.addedProjectID}
+			}
+			if listed.ID == p.ID {
+				item := hr.HardwareReservation
+				item.Project = listed
+				reservations = append(reservations, item)
+			}
+		}
+		m.writeJSON(w, http.StatusOK, map[string]interface{}{"hardware_reservations": reservations})
+	default:
+		m.writeError(w, http.StatusNotFound, "Not found")
+	}
+}
+
+func (m *packetMock) serveSSHKeys(w http.ResponseWriter, r *http.Request, projectID string, parts []string) {
+	switch {
+	case len(parts) == 0 && r.Method == http.MethodGet:
+		keys := []packngo.SSHKey{}
+		for _, k := range m.sshKeys {
+			if projectID == "" || k.Owner.Href == "/projects/"+projectID {
+				keys = append(keys, *k)
+			}
+		}
+		m.writeJSON(w, http.StatusOK, map[string]interface{}{"ssh_keys": keys})
+	case len(parts) == 0 && r.Method == http.MethodPost:
+		var cr packngo.SSHKeyCreateRequest
+		if err := json.NewDecoder(r.Body).Decode(&cr); err != nil {
+			m.writeError(w, http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+		k := &packngo.SSHKey{
+			ID:    mockUUID(),
+			Label: cr.Label,
+			Key:   cr.Key,
+			Owner: packngo.Href{Href: "/users/" + m.User.ID},
+		}
+		if projectID != "" {
+			k.Owner.Href = "/projects/" + projectID
+		}
+		m.sshKeys[k.ID] = k
+		m.writeJSON(w, http.StatusCreated, k)
+	case len(parts) == 1:
+		k, ok := m.sshKeys[parts[0]]
+		if !ok {
+			m.writeError(w, http.StatusNotFound, "Not found")
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			m.writeJSON(w, http.StatusOK, k)
+		case http.MethodDelete:
+			delete(m.sshKeys, k.ID)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			m.writeError(w, http.StatusNotFound, "Not found")
+		}
+	default:
+		m.writeError(w, http.StatusNotFound, "Not found")
+	}
+}
+
+func (m *packetMock) serveDevices(w http.ResponseWriter, r *http.Request, parts []string) {
+	if len(parts) != 1 {
+		m.writeError(w, http.StatusNotFound, "Not found")
+		return
+	}
+	d, ok := m.devices[parts[0]]
+	if !ok {
+		m.writeError(w, http.StatusNotFound, "Not found")
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		m.writeJSON(w, http.StatusOK, d)
+	case http.MethodPatch:
+		var ur packngo.DeviceUpdateRequest
+		if err := json.NewDecoder(r.Body).Decode(&ur); err != nil {
+			m.writeError(w, http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+		if ur.Locked != nil {
+			d.Locked = *ur.Locked
+		}
+		m.writeJSON(w, http.StatusOK, d)
+	default:
+		m.writeError(w, http.StatusNotFound, "Not found")
+	}
+}
+
+func (m *packetMock) serveReservations(w http.ResponseWriter, r *http.Request, parts []string) {
+	if len(parts) == 0 {
+		m.writeError(w, http.StatusNotFound, "Not found")
+		return
+	}
+	hr, ok := m.reservations[parts[0]]
+	if !ok {
+		m.writeError(w, http.StatusNotFound, "Not found")
+		return
+	}
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		m.writeJSON(w, http.StatusOK, hr.HardwareReservation)
+	case len(parts) == 2 && parts[1] == "move" && r.Method == http.MethodPost:
+		var mr struct {
+			ProjectID string `json:"project_id"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&mr); err != nil {
+			m.writeError(w, http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+		if _, ok := m.projects[mr.ProjectID]; !ok {
+			m.writeError(w, http.StatusUnprocessableEntity, "Project not found")
+			return
+		}
+		hr.Project = packngo.Project{ID: mr.ProjectID}
+		m.writeJSON(w, http.StatusOK, hr.HardwareReservation)
+	default:
+		m.writeError(w, http.StatusNotFound, "Not found")
+	}
+}
@@ -3,9 +3,12 @@ package packet
 import (
 	"context"
 	"errors"
+	"fmt"
+	"sort"
 	"strings"
 
 	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/strutil"
 	"github.com/hashicorp/vault/sdk/logical"
 )
 
@@ -15,42 +18,211 @@ func (b *backend) pathConfig() *framework.Path {
 		Fields: map[string]*framework.FieldSchema{
 			"api_token": {
 				Type:        framework.TypeString,
-				Description: "User API token with read-write permissions",
+				Description: "User API token with read-write permissions. Required when the config is first written, unless api_tokens is given.",
+			},
+			"api_tokens": {
+				Type:        framework.TypeCommaStringSlice,
+				Description: "Several user API tokens of the same user with read-write permissions, used in turns. Replaces api_token. Tokens of different users are refused.",
+			},
+			"token_selection": {
+				Type:        framework.TypeString,
+				Description: "How a token is picked from api_tokens for each call, round-robin or rate-limit, i.e. the token with most remaining requests. Defaults to round-robin.",
+			},
+			"allowed_organization_ids": {
+				Type:        framework.TypeCommaStringSlice,
+				Description: "Organizations whose projects roles may target. Defaults to any organization.",
+			},
+			"allowed_project_ids": {
+				Type:        framework.TypeCommaStringSlice,
+				Description: "Projects which roles may target. Defaults to any project.",
+			},
+			"allow_read_write": {
+				Type:        framework.TypeBool,
+				Description: "Whether user and project roles may have read_only=false.",
+				Default:     true,
+			},
+			"allow_user_roles": {
+				Type:        framework.TypeBool,
+				Description: "Whether user roles are allowed. User API keys carry the full privileges of the owner of api_token.",
+				Default:     true,
+			},
+			"max_role_ttl": {
+				Type:        framework.TypeDurationSecond,
+				Description: "Ceiling in seconds on ttl and max_ttl of roles. Defaults to 0, which means no ceiling.",
 			},
 		},
-		Callbacks: map[logical.Operation]framework.OperationFunc{
-			logical.UpdateOperation: b.operationConfigUpdate,
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ReadOperation: &framework.PathOperation{Callback: b.operationConfigRead},
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback:                    b.operationConfigUpdate,
+				ForwardPerformanceStandby:   true,
+				ForwardPerformanceSecondary: true,
+			},
 		},
 		HelpSynopsis:    pathConfigRootHelpSyn,
 		HelpDescription: pathConfigRootHelpDesc,
 	}
 }
 
+const (
+	selectionRoundRobin = "round-robin"
+	selectionRateLimit  = "rate-limit"
+)
+
 type packetSecretsEngineConfig struct {
+	Version  int    `json:"version"`
 	APIToken string `json:"api_token"`
+	// APITokens holds all tokens if several are configured. APIToken is
+	// then the first of them.
+	APITokens      []string   `json:"api_tokens,omitempty"`
+	TokenSelection string     `json:"token_selection,omitempty"`
+	Policy         rolePolicy `json:"policy"`
+}
+
+// tokens returns the configured API tokens.
+func (c *packetSecretsEngineConfig) tokens() []string {
+	if len(c.APITokens) > 0 {
+		return c.APITokens
+	}
+	return []string{c.APIToken}
 }
 
 func (b *backend) operationConfigUpdate(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
-	apiToken := ""
-	if apiTokenIfc, ok := data.GetOk("api_token"); ok {
-		apiToken = strings.TrimSpace(apiTokenIfc.(string))
-	} else {
+	conf, err := readConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if conf == nil {
+		conf = &packetSecretsEngineConfig{}
+	}
+	apiTokenIfc, tokenOk := data.GetOk("api_token")
+	apiTokensIfc, tokensOk := data.GetOk("api_tokens")
+	switch {
+	case tokenOk && tokensOk:
+		return nil, errors.New("api_token and api_tokens are mutually exclusive")
+	case tokenOk:
+		conf.APIToken = strings.TrimSpace(apiTokenIfc.(string))
+		conf.APITokens = nil
+	case tokensOk:
+		conf.APITokens = nil
+		for _, token := range apiTokensIfc.([]string) {
+			token = strings.TrimSpace(token)
+			if token == "" {
+				continue
+			}
+			if strutil.StrListContains(conf.APITokens, token) {
+				return nil, errors.New("api_tokens must not repeat a token")
+			}
+			conf.APITokens = append(conf.APITokens, token)
+		}
+		conf.APIToken = ""
+		if len(conf.APITokens) > 0 {
+			conf.APIToken = conf.APITokens[0]
+		}
+	}
+	if conf.APIToken == "" {
 		return nil, errors.New("api_token is required")
 	}
-	entry, err := logical.StorageEntryJSON("config",
-		packetSecretsEngineConfig{
-			APIToken: apiToken,
-		})
+	if tokensOk && len(conf.APITokens) > 1 {
+		if err := b.checkTokenOwners(conf.APITokens); err != nil {
+			return nil, err
+		}
+	}
+	if raw, ok := data.GetOk("token_selection"); ok {
+		conf.TokenSelection = raw.(string)
+		if conf.TokenSelection != selectionRoundRobin && conf.TokenSelection != selectionRateLimit {
+			return nil, fmt.Errorf("token_selection must be %s or %s", selectionRoundRobin, selectionRateLimit)
+		}
+	}
+
+	if raw, ok := data.GetOk("allowed_organization_ids"); ok {
+		conf.Policy.AllowedOrganizationIDs = raw.([]string)
+	}
+	if raw, ok := data.GetOk("allowed_project_ids"); ok {
+		conf.Policy.AllowedProjectIDs = raw.([]string)
+		for _, projectID := range conf.Policy.AllowedProjectIDs {
+			if !IsValidUUID(projectID) {
+				return nil, fmt.Errorf("allowed_project_ids must be Packet API project IDs, %q isn't", projectID)
+			}
+		}
+	}
+	if raw, ok := data.GetOk("allow_read_write"); ok {
+		conf.Policy.DenyReadWrite = !raw.(bool)
+	}
+	if raw, ok := data.GetOk("allow_user_roles"); ok {
+		conf.Policy.DenyUserRoles = !raw.(bool)
+	}
+	if raw, ok := data.GetOk("max_role_ttl"); ok {
+		conf.Policy.MaxRoleTTL = int64(raw.(int))
+		if conf.Policy.MaxRoleTTL < 0 {
+			return nil, errors.New("max_role_ttl can't be negative")
+		}
+	}
+
+	if err := writeConfig(ctx, req.Storage, conf); err != nil {
+		return nil, err
+	}
+	b.resetClient(ctx)
+
+	// Roles written before the policy was tightened refuse to issue, report
+	// them so that they get fixed
+	violations, err := b.policyViolations(ctx, req.Storage, &conf.Policy)
+	if err != nil {
+		return nil, err
+	}
+	if len(violations) == 0 {
+		return nil, nil
+	}
+	resp := &logical.Response{}
+	for _, roleName := range sortedKeys(violations) {
+		resp.AddWarning(fmt.Sprintf("role %s violates the mount policy and won't issue credentials: %s", roleName, violations[roleName]))
+	}
+	return resp, nil
+}
+
+func (b *backend) operationConfigRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	conf, err := readConfig(ctx, req.Storage)
 	if err != nil {
 		return nil, err
 	}
-	if err := req.Storage.Put(ctx, entry); err != nil {
+	if conf == nil {
+		return nil, nil
+	}
+	violations, err := b.policyViolations(ctx, req.Storage, &conf.Policy)
+	if err != nil {
 		return nil, err
 	}
-	b.resetClient(ctx)
-	return nil, nil
+	tokenSelection := conf.TokenSelection
+	if tokenSelection == "" {
+		tokenSelection = selectionRoundRobin
+	}
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"api_token_count":          len(conf.tokens()),
+			"token_selection":          tokenSelection,
+			"allowed_organization_ids": conf.Policy.AllowedOrganizationIDs,
+			"allowed_project_ids":      conf.Policy.AllowedProjectIDs,
+			"allow_read_write":         !conf.Policy.DenyReadWrite,
+			"allow_user_roles":         !conf.Policy.DenyUserRoles,
+			"max_role_ttl":             conf.Policy.MaxRoleTTL,
+			"roles_violating_policy":   violations,
+		},
+	}, nil
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
 }
 
-const pathConfigRootHelpSyn = `Configure the API token which Vault will use to create temporary tokens.`
+const pathConfigRootHelpSyn = `Configure the API tokens which Vault will use to create temporary tokens, and the policy limiting what roles may grant.`
+
+const pathConfigRootHelpDesc = `Before doing anything, the Packet backend needs credentials that are able to create other API tokens. This endpoint is used to configure those credentials.
+
+Several tokens of the same account can be given in api_tokens, to spread Packet API calls over their rate limits. Each call uses the next token in turn, or with token_selection=rate-limit the token with the most remaining requests. A token rejected by Packet with 401 is taken out of rotation until the config is written again, and flagged in the status output.
 
-const pathConfigRootHelpDesc = `Before doing anything, the Packet backend needs credentials that are able to create other API tokens. This endpoint is used to configure those credentials.`
+The config also carries a mount-wide policy, enforced when roles are written and again at issuance: the organizations and projects roles may target, whether read-write and user roles are allowed, and a ceiling on role TTLs. Roles violating the policy after it's tightened refuse to issue credentials, and are reported when the config is written and read. The API token is never returned on read.`
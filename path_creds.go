@@ -3,13 +3,19 @@ package packet
 import (
 	"context"
 	"fmt"
-	"log"
+	"strings"
+	"sync"
 
+	multierror "github.com/hashicorp/go-multierror"
 	"github.com/hashicorp/vault/sdk/framework"
 	"github.com/hashicorp/vault/sdk/logical"
 	"github.com/packethost/packngo"
 )
 
+// issueParallelism bounds the number of API keys created concurrently for one
+// request.
+const issueParallelism = 8
+
 func (b *backend) pathCredentials() *framework.Path {
 	return &framework.Path{
 		Pattern: "creds/" + framework.GenericNameRegex("name"),
@@ -18,9 +24,58 @@ func (b *backend) pathCredentials() *framework.Path {
 				Type:        framework.TypeLowerCaseString,
 				Description: "The name of the role.",
 			},
+			"device_id": {
+				Type:        framework.TypeString,
+				Description: "ID of the device to unlock, for device-unlock roles.",
+			},
+			"reservation_id": {
+				Type:        framework.TypeString,
+				Description: "ID of the hardware reservation to loan, for hardware-reservation roles. If empty, any available reservation from the pool project is loaned.",
+			},
+			"plan": {
+				Type:        framework.TypeString,
+				Description: "Plan of the spot market devices, for spot-market-request roles. Can be omitted if the role allows a single plan.",
+			},
+			"facilities": {
+				Type:        framework.TypeCommaStringSlice,
+				Description: "Facilities of the spot market devices, for spot-market-request roles. Defaults to the facilities allowed by the role.",
+			},
+			"operating_system": {
+				Type:        framework.TypeString,
+				Description: "Operating system slug of the spot market devices, for spot-market-request roles.",
+			},
+			"hostname": {
+				Type:        framework.TypeString,
+				Description: "Hostname of the spot market devices, for spot-market-request roles.",
+			},
+			"devices_min": {
+				Type:        framework.TypeInt,
+				Description: "Minimum number of spot market devices, for spot-market-request roles. Defaults to 1.",
+			},
+			"devices_max": {
+				Type:        framework.TypeInt,
+				Description: "Maximum number of spot market devices, for spot-market-request roles. Defaults to devices_min.",
+			},
+			"max_bid_price": {
+				Type:        framework.TypeString,
+				Description: "Maximum bid price per device per hour, for spot-market-request roles. Defaults to the role's max_bid_price.",
+			},
+			"format": {
+				Type:        framework.TypeString,
+				Description: "Format to render the API token in as config, for user and project roles. One of env, packet-cli, terraform or kubernetes.",
+			},
 		},
-		Callbacks: map[logical.Operation]framework.OperationFunc{
-			logical.ReadOperation: b.operationCredsRead,
+		// Issuance writes local storage, so performance secondaries issue
+		// on their own
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ReadOperation: &framework.PathOperation{
+				Callback:                  b.operationCredsRead,
+				ForwardPerformanceStandby: true,
+			},
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback:                  b.operationCredsRead,
+				ForwardPerformanceStandby: true,
+			},
 		},
 		HelpSynopsis:    pathCredsHelpSyn,
 		HelpDescription: pathCredsHelpDesc,
@@ -37,41 +92,227 @@ func (b *backend) operationCredsRead(ctx context.Context, req *logical.Request,
 		return nil, err
 	}
 	if role == nil {
-		log.Println("Role", roleName, "doesn't exist")
 		// Attempting to read a role that doesn't exist.
+		b.Logger().Debug("role doesn't exist", "role", roleName, "operation", req.Operation)
 		return nil, nil
 	}
-
-	tokenCreateRequest := packngo.APIKeyCreateRequest{
-		Description: fmt.Sprintf("Vault-%s", roleName),
-		ReadOnly:    role.ReadOnly,
-		ProjectID:   role.ProjectID,
+	if err := b.checkCaller(req, role); err != nil {
+		return b.callerDeniedResponse(req, roleName, err)
 	}
 
-	client, err := b.Client(ctx, req.Storage)
+	role, err = b.resolveTemplates(role, req.EntityID)
 	if err != nil {
-		return nil, err
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	if resp, err := b.enforcePolicy(ctx, req.Storage, roleName, role); resp != nil || err != nil {
+		return resp, err
+	}
+
+	switch role.Type {
+	case TypeDeviceUnlock:
+		return b.unlockDevice(ctx, req, data, roleName, role)
+	case TypeReservation:
+		return b.loanReservation(ctx, req, data, roleName, role)
+	case TypeSpotMarket:
+		return b.createSpotMarketRequest(ctx, req, data, roleName, role)
+	}
+
+	format := data.Get("format").(string)
+	if format != "" && !validCredsFormat(format) {
+		return logical.ErrorResponse(fmt.Sprintf("format should be one of %s, was %s", strings.Join(credsFormats, ", "), format)), nil
 	}
-	apiKey, _, err := client.APIKeys.Create(&tokenCreateRequest)
-	if err != nil {
-		return logical.ErrorResponse(fmt.Sprintf("err '%s' when attempting to create API key in Packet", err)), nil
 
+	var apiKey *packngo.APIKey
+	if role.PoolSize > 0 {
+		apiKey, err = b.issuePooledKey(ctx, req.Storage, roleName, role, requesterOf(req))
+		if err != nil {
+			recordIssuance(roleName, role.Type, 1, err)
+			return b.issueErrorResponse(err, roleName, req.Operation)
+		}
 	}
+	pooled := apiKey != nil
+	if !pooled {
+		apiKeys, err := b.issueAPIKeys(ctx, req.Storage, roleName, role, 1, requesterOf(req), false)
+		if err != nil {
+			recordIssuance(roleName, role.Type, 1, err)
+			return b.issueErrorResponse(err, roleName, req.Operation)
+		}
+		apiKey = apiKeys[0]
+	}
+	recordIssuance(roleName, role.Type, 1, nil)
+	b.Logger().Info("issued API key", "role", roleName, "key_id", apiKey.ID, "project", role.ProjectID,
+		"operation", req.Operation, "pooled", pooled)
 	resp := b.Secret(secretType).Response(map[string]interface{}{
-		"api_key_token": apiKey.Token,
+		"api_key_token":       apiKey.Token,
+		"api_key_id":          apiKey.ID,
+		"api_key_fingerprint": fingerprint(apiKey.Token),
 	}, map[string]interface{}{
 		"api_key_id": apiKey.ID,
+		"role":       roleName,
+		"scope":      role.Type,
+		"project_id": role.ProjectID,
 	})
+	if format != "" {
+		config, err := renderCreds(format, apiKey.Token, role.ProjectID)
+		if err != nil {
+			return nil, err
+		}
+		resp.Data["config"] = config
+	}
 	if role.TTL != 0 {
 		resp.Secret.TTL = role.TTL
 	}
 	if role.MaxTTL != 0 {
 		resp.Secret.MaxTTL = role.MaxTTL
 	}
+	b.notify(ctx, req.Storage, b.issueEvent(req, roleName, role, []string{apiKey.ID}, resp.Secret.TTL))
 
 	return resp, nil
 }
 
+// createAPIKey creates an API key in Packet as configured by a user or
+// project role. With verify_timeout set, the key is returned only once it's
+// usable, otherwise it's deleted.
+func (b *backend) createAPIKey(ctx context.Context, s logical.Storage, roleName string, role *roleEntry) (*packngo.APIKey, error) {
+	description := role.Description
+	if description == "" {
+		description = fmt.Sprintf("Vault-%s", roleName)
+	}
+	tokenCreateRequest := packngo.APIKeyCreateRequest{
+		Description: description,
+		ReadOnly:    role.ReadOnly,
+		ProjectID:   role.ProjectID,
+	}
+
+	var apiKey *packngo.APIKey
+	err := b.apiCall(ctx, s, priorityIssue, "APIKeys.Create", func(c *packngo.Client) (resp *packngo.Response, err error) {
+		apiKey, resp, err = c.APIKeys.Create(&tokenCreateRequest)
+		return resp, err
+	})
+	if err != nil || role.VerifyTimeout == 0 {
+		return apiKey, err
+	}
+
+	if err := b.verifyAPIKey(ctx, s, role, apiKey); err != nil {
+		b.Logger().Warn("deleting API key which didn't become usable", "role", roleName, "key_id", apiKey.ID, "error", err)
+		if delErr := b.deleteAPIKeys(ctx, s, []string{apiKey.ID}); delErr != nil {
+			b.Logger().Error("failed to delete unusable API key", "role", roleName, "key_id", apiKey.ID, "error", delErr)
+			return nil, fmt.Errorf("failed to delete unusable API key %s: %v, verification failed with: %v", apiKey.ID, delErr, err)
+		}
+		b.notify(ctx, s, &webhookEvent{
+			Type:      eventRollback,
+			Role:      roleName,
+			KeyIDs:    []string{apiKey.ID},
+			ProjectID: role.ProjectID,
+			Reason:    fmt.Sprintf("API key didn't become usable: %v", err),
+		})
+		return nil, err
+	}
+	return apiKey, nil
+}
+
+// issueAPIKeys creates count API keys for a user or project role within the
+// limits of the role, with bounded parallelism. If any of the keys fails to
+// be created, the others are deleted. Keys of a batch are recorded as such,
+// so that they can be claimed.
+func (b *backend) issueAPIKeys(ctx context.Context, s logical.Storage, roleName string, role *roleEntry, count int, who *requester, batch bool) ([]*packngo.APIKey, error) {
+	slots, err := b.reserveIssuance(ctx, s, roleName, role, count)
+	if err != nil {
+		return nil, err
+	}
+
+	apiKeys := make([]*packngo.APIKey, count)
+	errs := make([]error, count)
+	sem := make(chan struct{}, issueParallelism)
+	var wg sync.WaitGroup
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			apiKeys[i], errs[i] = b.createAPIKey(ctx, s, roleName, role)
+			if errs[i] == nil {
+				record := b.newIssuedKey(roleName, role, apiKeys[i], who)
+				record.Batch = batch
+				errs[i] = b.recordIssuedKey(ctx, s, slots[i], record)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	var createErr, retryErr error
+	var keyIDs []string
+	for i := range apiKeys {
+		if apiKeys[i] != nil {
+			keyIDs = append(keyIDs, apiKeys[i].ID)
+		}
+		if errs[i] != nil {
+			createErr = multierror.Append(createErr, errs[i])
+			if isRetryable(errs[i]) {
+				retryErr = errs[i]
+			}
+		}
+	}
+	if createErr == nil {
+		return apiKeys, nil
+	}
+
+	// Don't leave behind keys nobody holds a lease for
+	b.Logger().Warn("rolling back failed issuance", "role", roleName, "key_ids", keyIDs, "error", createErr)
+	if err := b.revokeAPIKeys(ctx, s, roleName, keyIDs); err != nil {
+		b.Logger().Error("failed to roll back issuance", "role", roleName, "key_ids", keyIDs, "error", err)
+		return nil, fmt.Errorf("failed to clean up API keys: %v, creation failed with: %v", err, createErr)
+	}
+	if len(keyIDs) > 0 {
+		b.notify(ctx, s, &webhookEvent{
+			Type:      eventRollback,
+			Role:      roleName,
+			KeyIDs:    keyIDs,
+			ProjectID: role.ProjectID,
+			Reason:    fmt.Sprintf("issuance failed: %v", createErr),
+		})
+	}
+	for _, slot := range slots {
+		if err := b.releaseSlot(ctx, s, roleName, slot); err != nil {
+			return nil, err
+		}
+	}
+	if retryErr != nil {
+		return nil, retryErr
+	}
+	return nil, createErr
+}
+
+// issueErrorResponse logs an error of issueAPIKeys and turns it into an
+// error response.
+func (b *backend) issueErrorResponse(err error, roleName string, op logical.Operation) (*logical.Response, error) {
+	if qErr, ok := err.(*quotaError); ok {
+		b.Logger().Info("refused issuance over role limits", "role", roleName, "operation", op, "error", qErr)
+		return logical.ErrorResponse(qErr.Error()), nil
+	}
+	b.Logger().Error("failed to issue API keys", "role", roleName, "operation", op, "error", err)
+	return apiErrorResponse(err, "create API key in Packet")
+}
+
 const pathCredsHelpSyn = `Generate an API token using the given role's configuration.`
 
-const pathCredsHelpDesc = `This path will generate a new API key for Packet API.`
+const pathCredsHelpDesc = `This path will generate a new API key for Packet API.
+
+For device-unlock roles, pass the device_id parameter. The device is unlocked
+for the duration of the lease and locked again when the lease is revoked.
+
+For hardware-reservation roles, a reservation from the pool project is moved
+to the role's project for the duration of the lease and moved back when the
+lease is revoked. A specific reservation can be requested with the
+reservation_id parameter.
+
+For spot-market-request roles, a spot market request is created in the role's
+project within the role's bid price, device count, plans and facilities. The
+request and its devices are deleted when the lease is revoked.
+
+For user and project roles, the format parameter adds the API token rendered
+as config: env for shell export lines, packet-cli for a Packet CLI config
+file, terraform for a Terraform variables file, or kubernetes for the JSON
+secret of the Packet cloud-controller-manager and CSI driver. Configs of
+project roles include the project ID.`
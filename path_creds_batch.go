@@ -0,0 +1,303 @@
+package packet
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const secretTypeBatch = "packet_batch"
+
+func (b *backend) pathCredentialsBatch() *framework.Path {
+	return &framework.Path{
+		Pattern: "creds/" + framework.GenericNameRegex("name") + "/batch",
+		Fields: map[string]*framework.FieldSchema{
+			"name": {
+				Type:        framework.TypeLowerCaseString,
+				Description: "The name of the role.",
+			},
+			"count": {
+				Type:        framework.TypeInt,
+				Description: "Number of API keys to create. Can't exceed max_batch_size of the role.",
+			},
+		},
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback:                  b.operationCredsBatch,
+				ForwardPerformanceStandby: true,
+			},
+		},
+		HelpSynopsis:    pathCredsBatchHelpSyn,
+		HelpDescription: pathCredsBatchHelpDesc,
+	}
+}
+
+func (b *backend) pathSecretsBatch() *framework.Secret {
+	return &framework.Secret{
+		Type: secretTypeBatch,
+		Fields: map[string]*framework.FieldSchema{
+			"api_key_tokens": {
+				Type:        framework.TypeStringSlice,
+				Description: "API tokens",
+			},
+			"api_key_ids": {
+				Type:        framework.TypeStringSlice,
+				Description: "IDs of the API keys, in the order of api_key_tokens",
+			},
+			"api_key_fingerprints": {
+				Type:        framework.TypeStringSlice,
+				Description: "Fingerprints of the API tokens, in the order of api_key_tokens",
+			},
+		},
+		Renew:  b.operationAPIKeyRenew,
+		Revoke: b.operationBatchRevoke,
+	}
+}
+
+func (b *backend) operationCredsBatch(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	roleName := data.Get("name").(string)
+	if roleName == "" {
+		return logical.ErrorResponse("missing role name"), nil
+	}
+	role, err := readRole(ctx, req.Storage, roleName)
+	if err != nil {
+		return nil, err
+	}
+	if role == nil {
+		return logical.ErrorResponse(fmt.Sprintf("role %s doesn't exist", roleName)), nil
+	}
+	if err := b.checkCaller(req, role); err != nil {
+		return b.callerDeniedResponse(req, roleName, err)
+	}
+	if role.Type != TypeUser && role.Type != TypeProject {
+		return logical.ErrorResponse(fmt.Sprintf("batch creation is only possible for %s and %s roles", TypeUser, TypeProject)), nil
+	}
+	role, err = b.resolveTemplates(role, req.EntityID)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	if resp, err := b.enforcePolicy(ctx, req.Storage, roleName, role); resp != nil || err != nil {
+		return resp, err
+	}
+	count := data.Get("count").(int)
+	if count < 1 || count > role.MaxBatchSize {
+		return logical.ErrorResponse(fmt.Sprintf("count must be between 1 and %d, the max_batch_size of role %s", role.MaxBatchSize, roleName)), nil
+	}
+
+	apiKeys, err := b.issueAPIKeys(ctx, req.Storage, roleName, role, count, requesterOf(req), true)
+	recordIssuance(roleName, role.Type, count, err)
+	if err != nil {
+		return b.issueErrorResponse(err, roleName, req.Operation)
+	}
+	tokens := make([]string, 0, count)
+	keyIDs := make([]string, 0, count)
+	fingerprints := make([]string, 0, count)
+	for _, apiKey := range apiKeys {
+		tokens = append(tokens, apiKey.Token)
+		keyIDs = append(keyIDs, apiKey.ID)
+		fingerprints = append(fingerprints, fingerprint(apiKey.Token))
+	}
+	b.Logger().Info("issued API key batch", "role", roleName, "key_ids", keyIDs, "project", role.ProjectID,
+		"operation", req.Operation)
+
+	resp := b.Secret(secretTypeBatch).Response(map[string]interface{}{
+		"api_key_tokens":       tokens,
+		"api_key_ids":          keyIDs,
+		"api_key_fingerprints": fingerprints,
+	}, map[string]interface{}{
+		"api_key_ids": keyIDs,
+		"role":        roleName,
+		"scope":       role.Type,
+		"project_id":  role.ProjectID,
+	})
+	if role.TTL != 0 {
+		resp.Secret.TTL = role.TTL
+	}
+	if role.MaxTTL != 0 {
+		resp.Secret.MaxTTL = role.MaxTTL
+	}
+	b.notify(ctx, req.Storage, b.issueEvent(req, roleName, role, keyIDs, resp.Secret.TTL))
+
+	return resp, nil
+}
+
+func (b *backend) operationBatchRevoke(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	keyIDs := leaseKeyIDs(req.Secret)
+	if keyIDs == nil {
+		return nil, fmt.Errorf("secret is missing IDs of the API tokens")
+	}
+
+	roleName, _ := req.Secret.InternalData["role"].(string)
+	scope, _ := req.Secret.InternalData["scope"].(string)
+
+	b.batchLock.Lock()
+	defer b.batchLock.Unlock()
+
+	keyIDs, err := batchKeyIDs(ctx, req.Storage, roleName, keyIDs, true)
+	if err != nil {
+		return nil, err
+	}
+	if len(keyIDs) == 0 {
+		// Every key was claimed under a lease of its own
+		return nil, nil
+	}
+	event := leaseEvent(ctx, req.Storage, eventRevoke, req.Secret)
+	event.KeyIDs = keyIDs
+	err = b.revokeAPIKeys(ctx, req.Storage, roleName, keyIDs)
+	recordRevocation(roleName, scope, len(keyIDs), err)
+	if err != nil {
+		return nil, err
+	}
+	b.notify(ctx, req.Storage, event)
+	return nil, nil
+}
+
+// batchKeyIDs returns the API keys still held by a batch lease, leaving out
+// keys claimed under leases of their own. Keys without a record were either
+// revoked after being claimed or issued before records were kept, and are
+// returned only with unrecorded set.
+func batchKeyIDs(ctx context.Context, s logical.Storage, roleName string, keyIDs []string, unrecorded bool) ([]string, error) {
+	held := make([]string, 0, len(keyIDs))
+	for _, keyID := range keyIDs {
+		record, err := readIssuedKey(ctx, s, roleName, keyID)
+		if err != nil {
+			return nil, err
+		}
+		if (record == nil && !unrecorded) || (record != nil && record.Claimed) {
+			continue
+		}
+		held = append(held, keyID)
+	}
+	return held, nil
+}
+
+func (b *backend) pathCredentialsClaim() *framework.Path {
+	return &framework.Path{
+		Pattern: "creds/" + framework.GenericNameRegex("name") + "/claim",
+		Fields: map[string]*framework.FieldSchema{
+			"name": {
+				Type:        framework.TypeLowerCaseString,
+				Description: "The name of the role.",
+			},
+			"api_key_token": {
+				Type:        framework.TypeString,
+				Description: "API token issued in a batch of the role.",
+			},
+		},
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback:                  b.operationCredsClaim,
+				ForwardPerformanceStandby: true,
+			},
+		},
+		HelpSynopsis:    pathCredsClaimHelpSyn,
+		HelpDescription: pathCredsClaimHelpDesc,
+	}
+}
+
+// operationCredsClaim takes an API key out of the lease of its batch and
+// returns it under a lease of its own.
+func (b *backend) operationCredsClaim(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	roleName := data.Get("name").(string)
+	if roleName == "" {
+		return logical.ErrorResponse("missing role name"), nil
+	}
+	role, err := readRole(ctx, req.Storage, roleName)
+	if err != nil {
+		return nil, err
+	}
+	if role == nil {
+		return logical.ErrorResponse(fmt.Sprintf("role %s doesn't exist", roleName)), nil
+	}
+	if err := b.checkCaller(req, role); err != nil {
+		return b.callerDeniedResponse(req, roleName, err)
+	}
+	token := data.Get("api_key_token").(string)
+	if token == "" {
+		return logical.ErrorResponse("api_key_token is required"), nil
+	}
+
+	b.batchLock.Lock()
+	defer b.batchLock.Unlock()
+
+	notInBatch := logical.ErrorResponse(fmt.Sprintf("API token wasn't issued in an unrevoked batch of role %s", roleName))
+	entry, err := req.Storage.Get(ctx, fingerprintPrefix+fingerprint(token))
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return notInBatch, nil
+	}
+	var index fingerprintIndexEntry
+	if err := entry.DecodeJSON(&index); err != nil {
+		return nil, err
+	}
+	if index.Role != roleName {
+		return notInBatch, nil
+	}
+	record, err := readIssuedKey(ctx, req.Storage, roleName, index.KeyID)
+	if err != nil {
+		return nil, err
+	}
+	if record == nil || !record.Batch {
+		return notInBatch, nil
+	}
+	if record.Claimed {
+		return logical.ErrorResponse(fmt.Sprintf("API key %s was already claimed", record.KeyID)), nil
+	}
+	for _, prefix := range []string{revocationPendingPrefix, revocationFailedPrefix} {
+		r, err := readFailedRevocation(ctx, req.Storage, prefix, record.KeyID)
+		if err != nil {
+			return nil, err
+		}
+		if r != nil {
+			return logical.ErrorResponse(fmt.Sprintf("API key %s is being revoked with its batch", record.KeyID)), nil
+		}
+	}
+
+	record.Claimed = true
+	if err := writeIssuedKey(ctx, req.Storage, record); err != nil {
+		return nil, err
+	}
+	b.Logger().Info("claimed API key of batch", "role", roleName, "key_id", record.KeyID, "project", record.ProjectID,
+		"operation", req.Operation)
+
+	resp := b.Secret(secretType).Response(map[string]interface{}{
+		"api_key_id":          record.KeyID,
+		"api_key_fingerprint": record.Fingerprint,
+	}, map[string]interface{}{
+		"api_key_id": record.KeyID,
+		"role":       roleName,
+		"scope":      role.Type,
+		"project_id": record.ProjectID,
+	})
+	if role.TTL != 0 {
+		resp.Secret.TTL = role.TTL
+	}
+	if role.MaxTTL != 0 {
+		resp.Secret.MaxTTL = role.MaxTTL
+	}
+	return resp, nil
+}
+
+const pathCredsBatchHelpSyn = `Generate a batch of API tokens using the given role's configuration.`
+
+const pathCredsBatchHelpDesc = `This path creates count API keys for a user or project role at once, with
+bounded parallelism. The role's max_batch_size caps the count, and the batch
+counts against max_active_keys and max_issuance_per_hour of the role.
+
+A Vault response carries a single lease, so the keys of a batch are returned
+under one lease, and revoking it deletes the keys of the batch which weren't
+claimed. Each key can be moved to a lease of its own through the claim path
+of the role, e.g. by the worker it's handed to. If creation of any key fails,
+the keys created so far are deleted and the request fails.`
+
+const pathCredsClaimHelpSyn = `Move an API token of a batch to a lease of its own.`
+
+const pathCredsClaimHelpDesc = `This path takes an API token issued by the batch path of the role, and
+returns a lease for its API key alone, with the role's TTLs. Once claimed, the
+key is deleted when its own lease is revoked, and revoking the lease of the
+batch leaves it alone. A key can be claimed once, and not after revocation of
+its batch has started.`
@@ -0,0 +1,161 @@
+package packet
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/packethost/packngo"
+)
+
+// fingerprintPrefix is the storage prefix of the index of issued API keys by
+// fingerprint of their token, "fingerprint/<fingerprint>".
+const fingerprintPrefix = "fingerprint/"
+
+// fingerprint returns a non-reversible identifier of an API token, the hex
+// SHA-256 of the token. It can be computed from the token by anyone holding
+// it, e.g. with sha256sum.
+func fingerprint(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// requester identifies who asked Vault for credentials.
+type requester struct {
+	EntityID            string `json:"entity_id"`
+	DisplayName         string `json:"display_name"`
+	ClientTokenAccessor string `json:"client_token_accessor"`
+	RemoteAddr          string `json:"remote_addr"`
+}
+
+func requesterOf(req *logical.Request) *requester {
+	r := &requester{
+		EntityID:            req.EntityID,
+		DisplayName:         req.DisplayName,
+		ClientTokenAccessor: req.ClientTokenAccessor,
+	}
+	if req.Connection != nil {
+		r.RemoteAddr = req.Connection.RemoteAddr
+	}
+	return r
+}
+
+// newIssuedKey returns the record of an API key issued through a role for
+// the requester.
+func (b *backend) newIssuedKey(roleName string, role *roleEntry, apiKey *packngo.APIKey, who *requester) *issuedKey {
+	ttl, maxTTL := b.getDefaultAndMaxLease()
+	if role.TTL != 0 {
+		ttl = role.TTL
+	}
+	if role.MaxTTL != 0 {
+		maxTTL = role.MaxTTL
+	}
+	return &issuedKey{
+		KeyID:       apiKey.ID,
+		Role:        roleName,
+		Fingerprint: fingerprint(apiKey.Token),
+		Requester:   who,
+		TTL:         int64(ttl / time.Second),
+		MaxTTL:      int64(maxTTL / time.Second),
+		ProjectID:   role.ProjectID,
+	}
+}
+
+type fingerprintIndexEntry struct {
+	Role  string `json:"role"`
+	KeyID string `json:"key_id"`
+}
+
+func writeFingerprintIndex(ctx context.Context, s logical.Storage, record *issuedKey) error {
+	entry, err := logical.StorageEntryJSON(fingerprintPrefix+record.Fingerprint, fingerprintIndexEntry{
+		Role:  record.Role,
+		KeyID: record.KeyID,
+	})
+	if err != nil {
+		return err
+	}
+	return s.Put(ctx, entry)
+}
+
+func (b *backend) pathLookup() *framework.Path {
+	return &framework.Path{
+		Pattern: "lookup",
+		Fields: map[string]*framework.FieldSchema{
+			"token": {
+				Type:        framework.TypeString,
+				Description: "API token issued by this backend.",
+			},
+			"fingerprint": {
+				Type:        framework.TypeString,
+				Description: "Fingerprint of an API token issued by this backend, as returned at issuance.",
+			},
+		},
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.UpdateOperation: b.operationLookup,
+		},
+		HelpSynopsis:    pathLookupHelpSyn,
+		HelpDescription: pathLookupHelpDesc,
+	}
+}
+
+func (b *backend) operationLookup(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	fp := data.Get("fingerprint").(string)
+	if token := data.Get("token").(string); token != "" {
+		if fp != "" {
+			return logical.ErrorResponse("only one of token and fingerprint can be given"), nil
+		}
+		fp = fingerprint(token)
+	}
+	if fp == "" {
+		return logical.ErrorResponse("token or fingerprint is required"), nil
+	}
+
+	entry, err := req.Storage.Get(ctx, fingerprintPrefix+fp)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return logical.ErrorResponse(fmt.Sprintf("no unrevoked API key with fingerprint %s was issued by this backend", fp)), nil
+	}
+	var index fingerprintIndexEntry
+	if err := entry.DecodeJSON(&index); err != nil {
+		return nil, err
+	}
+	record, err := readIssuedKey(ctx, req.Storage, index.Role, index.KeyID)
+	if err != nil {
+		return nil, err
+	}
+	if record == nil {
+		return nil, fmt.Errorf("record of API key %s indexed by fingerprint %s is missing", index.KeyID, fp)
+	}
+
+	respData := map[string]interface{}{
+		"role":                index.Role,
+		"api_key_id":          record.KeyID,
+		"api_key_fingerprint": record.Fingerprint,
+		"issued_at":           record.IssuedAt.Format(time.RFC3339),
+		"ttl":                 record.TTL,
+		"max_ttl":             record.MaxTTL,
+	}
+	if record.Requester != nil {
+		respData["entity_id"] = record.Requester.EntityID
+		respData["display_name"] = record.Requester.DisplayName
+		respData["client_token_accessor"] = record.Requester.ClientTokenAccessor
+		respData["remote_addr"] = record.Requester.RemoteAddr
+	}
+	return &logical.Response{Data: respData}, nil
+}
+
+const pathLookupHelpSyn = `Look up an API token issued by this backend.`
+
+const pathLookupHelpDesc = `This path takes an API token, or its fingerprint, and returns the role it
+was issued through, its key ID, the lease TTLs granted at issuance and who
+requested it. The fingerprint is the hex SHA-256 of the token, returned as
+api_key_fingerprint at issuance.
+
+Only API keys issued by user and project roles and not revoked yet can be
+looked up.`
@@ -0,0 +1,295 @@
+package packet
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/locksutil"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/packethost/packngo"
+)
+
+// knownKey is an API key the backend believes exists in Packet, either
+// issued through a role or waiting in its pool.
+type knownKey struct {
+	Role      string
+	KeyID     string
+	ProjectID string
+	Pooled    bool
+}
+
+// upstreamKey is an API key found in Packet, with the project it belongs to,
+// empty for user keys.
+type upstreamKey struct {
+	packngo.APIKey
+	ProjectID string
+}
+
+func (b *backend) pathReconcile() *framework.Path {
+	return &framework.Path{
+		Pattern: "reconcile",
+		Fields: map[string]*framework.FieldSchema{
+			"apply": {
+				Type:        framework.TypeBool,
+				Description: "Fix what can be fixed safely, i.e. forget API keys which don't exist in Packet anymore.",
+				Default:     false,
+			},
+		},
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ReadOperation: &framework.PathOperation{Callback: b.operationReconcile},
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback:                  b.operationReconcile,
+				ForwardPerformanceStandby: true,
+			},
+		},
+		HelpSynopsis:    pathReconcileHelpSyn,
+		HelpDescription: pathReconcileHelpDesc,
+	}
+}
+
+// knownKeys returns the API keys issued through roles and in their pools.
+// Issued keys whose project can't be determined, i.e. keys of templated
+// roles issued before records had the project, are left out.
+func knownKeys(ctx context.Context, s logical.Storage, roles map[string]*roleEntry) ([]*knownKey, error) {
+	var known []*knownKey
+	issuedRoles, err := s.List(ctx, issuedKeyPrefix)
+	if err != nil {
+		return nil, err
+	}
+	for _, dir := range issuedRoles {
+		roleName := strings.TrimSuffix(dir, "/")
+		ids, err := s.List(ctx, issuedKeyPrefix+dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range ids {
+			record, err := readIssuedKey(ctx, s, roleName, id)
+			if err != nil {
+				return nil, err
+			}
+			if record == nil || record.KeyID == "" {
+				// Reserved slot of a key being created, expired by
+				// expireSlots if its request never finished
+				continue
+			}
+			k := &knownKey{Role: roleName, KeyID: record.KeyID, ProjectID: record.ProjectID}
+			if role := roles[roleName]; k.ProjectID == "" && role != nil && role.Type == TypeProject {
+				if templated, _ := isTemplated(role.ProjectID); templated {
+					continue
+				}
+				k.ProjectID = role.ProjectID
+			}
+			known = append(known, k)
+		}
+	}
+
+	pools, err := s.List(ctx, poolPrefix)
+	if err != nil {
+		return nil, err
+	}
+	for _, dir := range pools {
+		roleName := strings.TrimSuffix(dir, "/")
+		ids, err := s.List(ctx, poolPrefix+dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range ids {
+			pooled, err := readPooledKey(ctx, s, roleName, id)
+			if err != nil {
+				return nil, err
+			}
+			if pooled == nil {
+				continue
+			}
+			known = append(known, &knownKey{Role: roleName, KeyID: pooled.KeyID, ProjectID: pooled.ProjectID, Pooled: true})
+		}
+	}
+	return known, nil
+}
+
+// vaultDescribed reports whether an API key looks created by Vault, i.e. it
+// has the default description or the description of one of the roles.
+func vaultDescribed(apiKey packngo.APIKey, roles map[string]*roleEntry) bool {
+	if strings.HasPrefix(apiKey.Description, "Vault-") {
+		return true
+	}
+	for _, role := range roles {
+		if role.Description == "" {
+			continue
+		}
+		if templated, _ := isTemplated(role.Description); !templated && role.Description == apiKey.Description {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *backend) operationReconcile(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	apply := req.Operation == logical.UpdateOperation && data.Get("apply").(bool)
+
+	roleNames, err := req.Storage.List(ctx, "role/")
+	if err != nil {
+		return nil, err
+	}
+	roles := make(map[string]*roleEntry, len(roleNames))
+	for _, roleName := range roleNames {
+		role, err := readRole(ctx, req.Storage, roleName)
+		if err != nil {
+			return nil, err
+		}
+		if role != nil {
+			roles[roleName] = role
+		}
+	}
+	known, err := knownKeys(ctx, req.Storage, roles)
+	if err != nil {
+		return nil, err
+	}
+
+	// List the user's keys and the keys of every project Vault knows of
+	projects := map[string]bool{"": true}
+	for _, k := range known {
+		projects[k.ProjectID] = true
+	}
+	for _, role := range roles {
+		if role.Type != TypeProject {
+			continue
+		}
+		if templated, _ := isTemplated(role.ProjectID); !templated {
+			projects[role.ProjectID] = true
+		}
+	}
+	upstream := map[string]*upstreamKey{}
+	for projectID := range projects {
+		apiKeys, err := b.listAPIKeys(ctx, req.Storage, projectID)
+		if err != nil {
+			if projectID != "" && isNotFound(err) {
+				// Deleted project, its keys are gone with it
+				continue
+			}
+			return nil, err
+		}
+		for id, k := range apiKeys {
+			upstream[id] = &upstreamKey{APIKey: k, ProjectID: projectID}
+		}
+	}
+
+	missing := []map[string]interface{}{}
+	drifted := []map[string]interface{}{}
+	knownIDs := map[string]bool{}
+	var forget []*knownKey
+	for _, k := range known {
+		knownIDs[k.KeyID] = true
+		u, ok := upstream[k.KeyID]
+		if !ok {
+			missing = append(missing, map[string]interface{}{
+				"role":       k.Role,
+				"api_key_id": k.KeyID,
+				"project_id": k.ProjectID,
+				"pooled":     k.Pooled,
+			})
+			forget = append(forget, k)
+			continue
+		}
+		role := roles[k.Role]
+		if role == nil {
+			continue
+		}
+		expectedProject := k.ProjectID
+		if role.Type == TypeUser {
+			expectedProject = ""
+		} else if templated, _ := isTemplated(role.ProjectID); !templated {
+			expectedProject = role.ProjectID
+		}
+		if u.ReadOnly != role.ReadOnly || u.ProjectID != expectedProject {
+			drifted = append(drifted, map[string]interface{}{
+				"role":                k.Role,
+				"api_key_id":          k.KeyID,
+				"project_id":          u.ProjectID,
+				"read_only":           u.ReadOnly,
+				"role_project_id":     expectedProject,
+				"role_read_only":      role.ReadOnly,
+				"pooled":              k.Pooled,
+				"api_key_description": u.Description,
+			})
+		}
+	}
+
+	unknown := []map[string]interface{}{}
+	for id, u := range upstream {
+		if knownIDs[id] || !vaultDescribed(u.APIKey, roles) {
+			continue
+		}
+		unknown = append(unknown, map[string]interface{}{
+			"api_key_id":          id,
+			"api_key_description": u.Description,
+			"project_id":          u.ProjectID,
+			"read_only":           u.ReadOnly,
+		})
+	}
+	sortByKeyID(missing)
+	sortByKeyID(drifted)
+	sortByKeyID(unknown)
+
+	fixed := []string{}
+	if apply {
+		for _, k := range forget {
+			if err := b.forgetMissingKey(ctx, req.Storage, k); err != nil {
+				return nil, err
+			}
+			b.Logger().Info("forgot API key missing in Packet", "role", k.Role, "key_id", k.KeyID, "pooled", k.Pooled)
+			fixed = append(fixed, k.KeyID)
+		}
+		sort.Strings(fixed)
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"missing_upstream": missing,
+			"unknown_to_vault": unknown,
+			"drifted":          drifted,
+			"applied":          apply,
+			"fixed":            fixed,
+		},
+	}, nil
+}
+
+// forgetMissingKey removes a key which doesn't exist in Packet from the
+// records of issued keys, or from the pool of its role, so that it isn't
+// issued.
+func (b *backend) forgetMissingKey(ctx context.Context, s logical.Storage, k *knownKey) error {
+	if !k.Pooled {
+		return b.forgetIssuedKey(ctx, s, k.Role, k.KeyID)
+	}
+	lock := locksutil.LockForKey(b.poolLocks, k.Role)
+	lock.Lock()
+	defer lock.Unlock()
+	return s.Delete(ctx, poolPrefix+k.Role+"/"+k.KeyID)
+}
+
+func sortByKeyID(keys []map[string]interface{}) {
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i]["api_key_id"].(string) < keys[j]["api_key_id"].(string)
+	})
+}
+
+const pathReconcileHelpSyn = `Compare API keys issued by this backend with API keys in Packet.`
+
+const pathReconcileHelpDesc = `This path lists the API keys of the user owning the config token, and of
+every project the backend issued keys in, and reports:
+
+missing_upstream: keys issued or pooled by the backend which don't exist in
+Packet anymore, e.g. because they were deleted in the Packet console.
+
+unknown_to_vault: keys with the default Vault-<role> description or the
+description of a role, which the backend has no record of.
+
+drifted: keys whose read_only flag or project differs from their role, e.g.
+because the role was changed after they were issued.
+
+Writing with apply=true forgets the keys missing in Packet, so that they're
+not counted against role limits or issued from a pool. Unknown and drifted
+keys are only reported, they may belong to another Vault mount or be in use
+by a lease holder.`
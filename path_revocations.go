@@ -0,0 +1,161 @@
+package packet
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// revocationPrefixes maps the state in revocations/<state> paths to the
+// storage prefix of its entries.
+var revocationPrefixes = map[string]string{
+	"pending": revocationPendingPrefix,
+	"failed":  revocationFailedPrefix,
+}
+
+func (b *backend) pathRevocationsList() *framework.Path {
+	return &framework.Path{
+		Pattern: "revocations/(?P<state>pending|failed)/?$",
+		Fields: map[string]*framework.FieldSchema{
+			"state": {
+				Type:        framework.TypeString,
+				Description: "pending for API keys queued for retry, failed for API keys given up on.",
+			},
+		},
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.ListOperation: b.operationRevocationsList,
+		},
+		HelpSynopsis:    pathRevocationsHelpSyn,
+		HelpDescription: pathRevocationsHelpDesc,
+	}
+}
+
+func (b *backend) pathRevocation() *framework.Path {
+	return &framework.Path{
+		Pattern: "revocations/(?P<state>pending|failed)/" + framework.GenericNameRegex("key_id") + "$",
+		Fields: map[string]*framework.FieldSchema{
+			"state": {
+				Type:        framework.TypeString,
+				Description: "pending for API keys queued for retry, failed for API keys given up on.",
+			},
+			"key_id": {
+				Type:        framework.TypeString,
+				Description: "ID of the API key.",
+			},
+		},
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.ReadOperation: b.operationRevocationRead,
+		},
+		HelpSynopsis:    pathRevocationsHelpSyn,
+		HelpDescription: pathRevocationsHelpDesc,
+	}
+}
+
+func (b *backend) pathRevocationAction() *framework.Path {
+	return &framework.Path{
+		Pattern: "revocations/failed/" + framework.GenericNameRegex("key_id") + "/(?P<action>retry|acknowledge)$",
+		Fields: map[string]*framework.FieldSchema{
+			"key_id": {
+				Type:        framework.TypeString,
+				Description: "ID of the API key.",
+			},
+			"action": {
+				Type:        framework.TypeString,
+				Description: "retry to delete the API key now, acknowledge to drop it from the list.",
+			},
+		},
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback:                  b.operationRevocationAction,
+				ForwardPerformanceStandby: true,
+			},
+		},
+		HelpSynopsis:    pathRevocationsHelpSyn,
+		HelpDescription: pathRevocationsHelpDesc,
+	}
+}
+
+func (b *backend) operationRevocationsList(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	keyIDs, err := req.Storage.List(ctx, revocationPrefixes[data.Get("state").(string)])
+	if err != nil {
+		return nil, err
+	}
+	return logical.ListResponse(keyIDs), nil
+}
+
+func (b *backend) operationRevocationRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	r, err := readFailedRevocation(ctx, req.Storage, revocationPrefixes[data.Get("state").(string)], data.Get("key_id").(string))
+	if err != nil {
+		return nil, err
+	}
+	if r == nil {
+		return nil, nil
+	}
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"api_key_id":      r.KeyID,
+			"role":            r.Role,
+			"attempts":        r.Attempts,
+			"last_error":      r.LastError,
+			"first_failed_at": formatTime(r.FirstFailedAt),
+			"last_attempt_at": formatTime(r.LastAttemptAt),
+			"next_attempt_at": formatTime(r.NextAttemptAt),
+		},
+	}, nil
+}
+
+func (b *backend) operationRevocationAction(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	keyID := data.Get("key_id").(string)
+	r, err := readFailedRevocation(ctx, req.Storage, revocationFailedPrefix, keyID)
+	if err != nil {
+		return nil, err
+	}
+	if r == nil {
+		return logical.ErrorResponse(fmt.Sprintf("API key %s isn't in the failed revocations", keyID)), nil
+	}
+
+	switch data.Get("action").(string) {
+	case "retry":
+		// A failure puts the key back in the retry queue with fresh attempts
+		if err := req.Storage.Delete(ctx, revocationFailedPrefix+keyID); err != nil {
+			return nil, err
+		}
+		event := b.queuedRevocationEvent(ctx, req.Storage, r)
+		err := b.revokeAPIKeys(ctx, req.Storage, r.Role, []string{keyID})
+		recordRevocation(r.Role, b.roleScope(ctx, req.Storage, r.Role), 1, err)
+		if err != nil {
+			return logical.ErrorResponse(fmt.Sprintf("failed to revoke API key %s, it's queued for retry: %v", keyID, err)), nil
+		}
+		b.notify(ctx, req.Storage, event)
+		return nil, nil
+	default:
+		// The operator dealt with the key, so it no longer counts against the
+		// limits of its role
+		if err := req.Storage.Delete(ctx, revocationFailedPrefix+keyID); err != nil {
+			return nil, err
+		}
+		if r.Role != "" {
+			if err := b.forgetIssuedKey(ctx, req.Storage, r.Role, keyID); err != nil {
+				return nil, err
+			}
+		}
+		b.Logger().Info("acknowledged failed revocation", "role", r.Role, "key_id", keyID, "attempts", r.Attempts)
+		return nil, nil
+	}
+}
+
+const pathRevocationsHelpSyn = `Inspect API keys whose revocation failed.`
+
+const pathRevocationsHelpDesc = `When deleting an API key in Packet fails, e.g. because the Packet API is
+down or rate-limited, the key is queued in revocations/pending and retried by
+the periodic function with exponential backoff, independently of Vault's own
+retries of the lease. After 8 failed attempts the key moves to
+revocations/failed and isn't retried anymore.
+
+Both lists can be listed, and their entries read for the attempt count and
+last error. A failed revocation can be retried with
+revocations/failed/<key_id>/retry, or dropped with
+revocations/failed/<key_id>/acknowledge once the key was dealt with, e.g.
+deleted in the Packet console.`
@@ -4,16 +4,22 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"math"
 	"regexp"
+	"strconv"
 	"time"
 
 	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/cidrutil"
 	"github.com/hashicorp/vault/sdk/logical"
 )
 
 const (
-	TypeUser    = "user"
-	TypeProject = "project"
+	TypeUser         = "user"
+	TypeProject      = "project"
+	TypeDeviceUnlock = "device-unlock"
+	TypeReservation  = "hardware-reservation"
+	TypeSpotMarket   = "spot-market-request"
 )
 
 func readRole(ctx context.Context, s logical.Storage, roleName string) (*roleEntry, error) {
@@ -31,12 +37,42 @@ func readRole(ctx context.Context, s logical.Storage, roleName string) (*roleEnt
 	return result, nil
 }
 
+// roleEntry is stored with durations in seconds, see storedRoleEntry.
 type roleEntry struct {
-	Type      string        `json:"type"`
-	ReadOnly  bool          `json:"read_only"`
-	ProjectID string        `json:"project_id"`
-	TTL       time.Duration `json:"ttl"`
-	MaxTTL    time.Duration `json:"max_ttl"`
+	Version int `json:"version"`
+
+	Type        string        `json:"type"`
+	ReadOnly    bool          `json:"read_only"`
+	ProjectID   string        `json:"project_id"`
+	Description string        `json:"description"`
+	TTL         time.Duration `json:"ttl"`
+	MaxTTL      time.Duration `json:"max_ttl"`
+
+	AllowedDeviceIDs  []string `json:"allowed_device_ids"`
+	AllowedDeviceTags []string `json:"allowed_device_tags"`
+
+	PoolProjectID string `json:"pool_project_id"`
+	DeleteDevices bool   `json:"delete_devices"`
+
+	MaxBidPrice       float64  `json:"max_bid_price"`
+	MaxDevices        int      `json:"max_devices"`
+	AllowedPlans      []string `json:"allowed_plans"`
+	AllowedFacilities []string `json:"allowed_facilities"`
+
+	MaxBatchSize       int `json:"max_batch_size"`
+	MaxActiveKeys      int `json:"max_active_keys"`
+	MaxIssuancePerHour int `json:"max_issuance_per_hour"`
+
+	PoolSize   int           `json:"pool_size"`
+	PoolMaxAge time.Duration `json:"pool_max_age"`
+
+	VerifyTimeout  time.Duration `json:"verify_timeout"`
+	SkipRenewCheck bool          `json:"skip_renew_check"`
+
+	BoundCIDRs                 []string `json:"bound_cidrs"`
+	AllowedEntityIDs           []string `json:"allowed_entity_ids"`
+	AllowedGroupNames          []string `json:"allowed_group_names"`
+	AllowedAliasMountAccessors []string `json:"allowed_alias_mount_accessors"`
 }
 
 func (b *backend) pathListRoles() *framework.Path {
@@ -68,7 +104,7 @@ func (b *backend) pathRole() *framework.Path {
 			},
 			"type": {
 				Type:        framework.TypeString,
-				Description: fmt.Sprintf("%s or %s", TypeUser, TypeProject),
+				Description: fmt.Sprintf("%s, %s, %s, %s or %s", TypeUser, TypeProject, TypeDeviceUnlock, TypeReservation, TypeSpotMarket),
 				Required:    true,
 			},
 			"read_only": {
@@ -78,7 +114,89 @@ func (b *backend) pathRole() *framework.Path {
 			},
 			"project_id": {
 				Type:        framework.TypeString,
-				Description: "project_id for a project key",
+				Description: "project_id for a project key, project which devices of a device-unlock role must belong to, or project in which a hardware-reservation or spot-market-request role operates. Project roles accept identity templates, e.g. {{identity.entity.metadata.packet_project}}.",
+			},
+			"description": {
+				Type:        framework.TypeString,
+				Description: "Description of API keys of a user or project role. Accepts identity templates. Defaults to Vault-<role name>.",
+			},
+			"allowed_device_ids": {
+				Type:        framework.TypeCommaStringSlice,
+				Description: "IDs of devices which a device-unlock role may unlock",
+			},
+			"allowed_device_tags": {
+				Type:        framework.TypeCommaStringSlice,
+				Description: "Tags of devices which a device-unlock role may unlock. A device needs to have at least one of the tags.",
+			},
+			"pool_project_id": {
+				Type:        framework.TypeString,
+				Description: "Project holding the hardware reservations which a hardware-reservation role loans",
+			},
+			"delete_devices": {
+				Type:        framework.TypeBool,
+				Description: "Should devices on a loaned hardware reservation be deleted when the loan is revoked",
+				Default:     false,
+			},
+			"max_bid_price": {
+				Type:        framework.TypeString,
+				Description: "Maximum bid price per device per hour for a spot-market-request role",
+			},
+			"max_devices": {
+				Type:        framework.TypeInt,
+				Description: "Maximum number of devices in a spot market request of a spot-market-request role",
+			},
+			"allowed_plans": {
+				Type:        framework.TypeCommaStringSlice,
+				Description: "Plans which a spot-market-request role may request",
+			},
+			"allowed_facilities": {
+				Type:        framework.TypeCommaStringSlice,
+				Description: "Facility codes or IDs in which a spot-market-request role may request devices",
+			},
+			"max_batch_size": {
+				Type:        framework.TypeInt,
+				Description: "Maximum number of API keys which can be created at once through the batch endpoint of a user or project role. Defaults to 0, which disables batch creation.",
+			},
+			"max_active_keys": {
+				Type:        framework.TypeInt,
+				Description: "Maximum number of unrevoked API keys issued through a user or project role. Defaults to 0, which means no limit.",
+			},
+			"max_issuance_per_hour": {
+				Type:        framework.TypeInt,
+				Description: "Maximum number of API keys issued through a user or project role in the last hour. Defaults to 0, which means no limit.",
+			},
+			"pool_size": {
+				Type:        framework.TypeInt,
+				Description: "Number of API keys of a user or project role to keep created ahead of issuance. Defaults to 0, which disables the pool.",
+			},
+			"pool_max_age": {
+				Type:        framework.TypeDurationSecond,
+				Description: "Duration in seconds after which unissued API keys in the pool are deleted and replaced. Defaults to 0, which means no limit.",
+			},
+			"verify_timeout": {
+				Type:        framework.TypeDurationSecond,
+				Description: "Duration in seconds for which a new API key of a user or project role is probed until it's usable, before it's returned. A key which doesn't become usable is deleted. Defaults to 0, which disables the probe.",
+			},
+			"skip_renew_check": {
+				Type:        framework.TypeBool,
+				Description: "Renew leases of API keys of a user or project role without checking the keys still exist in Packet, saving an API call per renewal.",
+				Default:     false,
+			},
+			"bound_cidrs": {
+				Type:        framework.TypeCommaStringSlice,
+				Description: "CIDR blocks which the client address must be in to draw credentials from the role. Defaults to any address.",
+			},
+			"allowed_entity_ids": {
+				Type:        framework.TypeCommaStringSlice,
+				Description: "IDs of identity entities allowed to draw credentials from the role. Defaults to any entity.",
+			},
+			"allowed_group_names": {
+				Type:        framework.TypeCommaStringSlice,
+				Description: "Names of identity groups whose members are allowed to draw credentials from the role. Defaults to any group.",
+			},
+			"allowed_alias_mount_accessors": {
+				Type:        framework.TypeCommaStringSlice,
+				Description: "Accessors of auth mounts, on one of which the requesting entity must have an alias to draw credentials from the role. The entity may have logged in through any mount. Defaults to any auth mount.",
 			},
 			"ttl": {
 				Type: framework.TypeDurationSecond,
@@ -91,11 +209,23 @@ to 0, in which case the value will fallback to the system/mount defaults.`,
 			},
 		},
 		ExistenceCheck: b.operationRoleExistenceCheck,
-		Callbacks: map[logical.Operation]framework.OperationFunc{
-			logical.CreateOperation: b.operationRoleCreate,
-			logical.UpdateOperation: b.operationRoleCreate,
-			logical.ReadOperation:   b.operationRoleRead,
-			logical.DeleteOperation: b.operationRoleDelete,
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.CreateOperation: &framework.PathOperation{
+				Callback:                    b.operationRoleCreate,
+				ForwardPerformanceStandby:   true,
+				ForwardPerformanceSecondary: true,
+			},
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback:                    b.operationRoleCreate,
+				ForwardPerformanceStandby:   true,
+				ForwardPerformanceSecondary: true,
+			},
+			logical.ReadOperation: &framework.PathOperation{Callback: b.operationRoleRead},
+			logical.DeleteOperation: &framework.PathOperation{
+				Callback:                    b.operationRoleDelete,
+				ForwardPerformanceStandby:   true,
+				ForwardPerformanceSecondary: true,
+			},
 		},
 		HelpSynopsis:    pathRolesHelpSyn,
 		HelpDescription: pathRolesHelpDesc,
@@ -133,8 +263,10 @@ func (b *backend) operationRoleCreate(ctx context.Context, req *logical.Request,
 
 	if raw, ok := data.GetOk("type"); ok {
 		role.Type = raw.(string)
-		if (role.Type != TypeUser) && (role.Type != TypeProject) {
-			return nil, fmt.Errorf("role type should be either %s or %s, was %s", TypeUser, TypeProject, role.Type)
+		switch role.Type {
+		case TypeUser, TypeProject, TypeDeviceUnlock, TypeReservation, TypeSpotMarket:
+		default:
+			return nil, fmt.Errorf("role type should be one of %s, %s, %s, %s or %s, was %s", TypeUser, TypeProject, TypeDeviceUnlock, TypeReservation, TypeSpotMarket, role.Type)
 		}
 	}
 
@@ -150,9 +282,151 @@ func (b *backend) operationRoleCreate(ctx context.Context, req *logical.Request,
 				return nil, fmt.Errorf("For user API key role, project_id must be left empty")
 			}
 		case TypeProject:
+			templated, err := isTemplated(role.ProjectID)
+			if err != nil {
+				return nil, err
+			}
+			if !templated && !IsValidUUID(role.ProjectID) {
+				return nil, fmt.Errorf("For project API key role, you must supply valid Packet API project ID or identity template")
+			}
+		case TypeReservation, TypeSpotMarket:
 			if !IsValidUUID(role.ProjectID) {
 				return nil, fmt.Errorf("For project API key role, you must supply valid Packet API project ID")
 			}
+		case TypeDeviceUnlock:
+			if role.ProjectID != "" && !IsValidUUID(role.ProjectID) {
+				return nil, fmt.Errorf("For device-unlock role, project_id must be empty or valid Packet API project ID")
+			}
+		}
+	}
+
+	if raw, ok := data.GetOk("description"); ok {
+		role.Description = raw.(string)
+		if role.Description != "" && role.Type != TypeUser && role.Type != TypeProject {
+			return nil, fmt.Errorf("description can only be set for %s and %s roles", TypeUser, TypeProject)
+		}
+		if _, err := isTemplated(role.Description); err != nil {
+			return nil, err
+		}
+	}
+
+	if raw, ok := data.GetOk("allowed_device_ids"); ok {
+		role.AllowedDeviceIDs = raw.([]string)
+	}
+	if raw, ok := data.GetOk("allowed_device_tags"); ok {
+		role.AllowedDeviceTags = raw.([]string)
+	}
+	if role.Type == TypeDeviceUnlock && len(role.AllowedDeviceIDs) == 0 && len(role.AllowedDeviceTags) == 0 {
+		return nil, errors.New("device-unlock role needs allowed_device_ids or allowed_device_tags")
+	}
+
+	if raw, ok := data.GetOk("pool_project_id"); ok {
+		role.PoolProjectID = raw.(string)
+	}
+	if raw, ok := data.GetOk("delete_devices"); ok {
+		role.DeleteDevices = raw.(bool)
+	}
+	if role.Type == TypeReservation {
+		if !IsValidUUID(role.PoolProjectID) || !IsValidUUID(role.ProjectID) {
+			return nil, errors.New("hardware-reservation role needs valid project_id and pool_project_id")
+		}
+		if role.PoolProjectID == role.ProjectID {
+			return nil, errors.New("project_id and pool_project_id of hardware-reservation role must differ")
+		}
+	}
+
+	if raw, ok := data.GetOk("max_bid_price"); ok {
+		role.MaxBidPrice, err = strconv.ParseFloat(raw.(string), 64)
+		if err != nil || math.IsNaN(role.MaxBidPrice) || math.IsInf(role.MaxBidPrice, 0) || role.MaxBidPrice < 0 {
+			return nil, fmt.Errorf("max_bid_price must be a non-negative number, was %s", raw.(string))
+		}
+	}
+	if raw, ok := data.GetOk("max_devices"); ok {
+		role.MaxDevices = raw.(int)
+	}
+	if raw, ok := data.GetOk("allowed_plans"); ok {
+		role.AllowedPlans = raw.([]string)
+	}
+	if raw, ok := data.GetOk("allowed_facilities"); ok {
+		role.AllowedFacilities = raw.([]string)
+	}
+	if raw, ok := data.GetOk("max_batch_size"); ok {
+		role.MaxBatchSize = raw.(int)
+		if role.MaxBatchSize < 0 {
+			return nil, errors.New("max_batch_size can't be negative")
+		}
+	}
+
+	if raw, ok := data.GetOk("max_active_keys"); ok {
+		role.MaxActiveKeys = raw.(int)
+		if role.MaxActiveKeys < 0 {
+			return nil, errors.New("max_active_keys can't be negative")
+		}
+	}
+	if raw, ok := data.GetOk("max_issuance_per_hour"); ok {
+		role.MaxIssuancePerHour = raw.(int)
+		if role.MaxIssuancePerHour < 0 {
+			return nil, errors.New("max_issuance_per_hour can't be negative")
+		}
+	}
+
+	if raw, ok := data.GetOk("pool_size"); ok {
+		role.PoolSize = raw.(int)
+		if role.PoolSize < 0 {
+			return nil, errors.New("pool_size can't be negative")
+		}
+		if role.PoolSize > 0 && role.Type != TypeUser && role.Type != TypeProject {
+			return nil, fmt.Errorf("pool_size can only be set for %s and %s roles", TypeUser, TypeProject)
+		}
+	}
+	if raw, ok := data.GetOk("pool_max_age"); ok {
+		role.PoolMaxAge = time.Duration(raw.(int)) * time.Second
+	}
+	if role.PoolSize > 0 && role.templated() {
+		return nil, errors.New("pool_size can't be set for roles with identity templates, which are resolved at issuance")
+	}
+
+	if raw, ok := data.GetOk("verify_timeout"); ok {
+		role.VerifyTimeout = time.Duration(raw.(int)) * time.Second
+		if role.VerifyTimeout < 0 {
+			return nil, errors.New("verify_timeout can't be negative")
+		}
+		if role.VerifyTimeout > 0 && role.Type != TypeUser && role.Type != TypeProject {
+			return nil, fmt.Errorf("verify_timeout can only be set for %s and %s roles", TypeUser, TypeProject)
+		}
+	}
+
+	if raw, ok := data.GetOk("skip_renew_check"); ok {
+		role.SkipRenewCheck = raw.(bool)
+	}
+
+	if raw, ok := data.GetOk("bound_cidrs"); ok {
+		role.BoundCIDRs = raw.([]string)
+		if len(role.BoundCIDRs) > 0 {
+			if valid, err := cidrutil.ValidateCIDRListSlice(role.BoundCIDRs); !valid {
+				return nil, fmt.Errorf("bound_cidrs must be CIDR blocks: %v", err)
+			}
+		}
+	}
+	if raw, ok := data.GetOk("allowed_entity_ids"); ok {
+		role.AllowedEntityIDs = raw.([]string)
+	}
+	if raw, ok := data.GetOk("allowed_group_names"); ok {
+		role.AllowedGroupNames = raw.([]string)
+	}
+	if raw, ok := data.GetOk("allowed_alias_mount_accessors"); ok {
+		role.AllowedAliasMountAccessors = raw.([]string)
+	}
+
+	if role.Type == TypeSpotMarket {
+		if !IsValidUUID(role.ProjectID) {
+			return nil, errors.New("spot-market-request role needs valid project_id")
+		}
+		if role.MaxBidPrice <= 0 || role.MaxDevices <= 0 {
+			return nil, errors.New("spot-market-request role needs positive max_bid_price and max_devices")
+		}
+		if len(role.AllowedPlans) == 0 || len(role.AllowedFacilities) == 0 {
+			return nil, errors.New("spot-market-request role needs allowed_plans and allowed_facilities")
 		}
 	}
 
@@ -167,11 +441,15 @@ func (b *backend) operationRoleCreate(ctx context.Context, req *logical.Request,
 		return nil, errors.New("ttl exceeds max_ttl")
 	}
 
-	entry, err := logical.StorageEntryJSON("role/"+roleName, role)
+	policy, err := readPolicy(ctx, req.Storage)
 	if err != nil {
 		return nil, err
 	}
-	if err := req.Storage.Put(ctx, entry); err != nil {
+	if err := b.checkPolicy(ctx, req.Storage, policy, role); err != nil {
+		return nil, err
+	}
+
+	if err := writeRole(ctx, req.Storage, roleName, role); err != nil {
 		return nil, err
 	}
 	return nil, nil
@@ -192,11 +470,38 @@ func (b *backend) operationRoleRead(ctx context.Context, req *logical.Request, d
 	}
 	return &logical.Response{
 		Data: map[string]interface{}{
-			"type":       role.Type,
-			"read_only":  role.ReadOnly,
-			"project_id": role.ProjectID,
-			"ttl":        role.TTL / time.Second,
-			"max_ttl":    role.MaxTTL / time.Second,
+			"type":        role.Type,
+			"read_only":   role.ReadOnly,
+			"project_id":  role.ProjectID,
+			"description": role.Description,
+			"ttl":         role.TTL / time.Second,
+			"max_ttl":     role.MaxTTL / time.Second,
+
+			"allowed_device_ids":  role.AllowedDeviceIDs,
+			"allowed_device_tags": role.AllowedDeviceTags,
+
+			"pool_project_id": role.PoolProjectID,
+			"delete_devices":  role.DeleteDevices,
+
+			"max_bid_price":      role.MaxBidPrice,
+			"max_devices":        role.MaxDevices,
+			"allowed_plans":      role.AllowedPlans,
+			"allowed_facilities": role.AllowedFacilities,
+
+			"max_batch_size":        role.MaxBatchSize,
+			"max_active_keys":       role.MaxActiveKeys,
+			"max_issuance_per_hour": role.MaxIssuancePerHour,
+
+			"pool_size":    role.PoolSize,
+			"pool_max_age": role.PoolMaxAge / time.Second,
+
+			"verify_timeout":   role.VerifyTimeout / time.Second,
+			"skip_renew_check": role.SkipRenewCheck,
+
+			"bound_cidrs":                   role.BoundCIDRs,
+			"allowed_entity_ids":            role.AllowedEntityIDs,
+			"allowed_group_names":           role.AllowedGroupNames,
+			"allowed_alias_mount_accessors": role.AllowedAliasMountAccessors,
 		},
 	}, nil
 }
@@ -3,10 +3,15 @@ package packet
 import (
 	"context"
 	"fmt"
+	"net/http"
+	"strings"
+	"sync"
 	"time"
 
+	multierror "github.com/hashicorp/go-multierror"
 	"github.com/hashicorp/vault/sdk/framework"
 	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/packethost/packngo"
 )
 
 func (b *backend) pathSecrets() *framework.Secret {
@@ -17,8 +22,20 @@ func (b *backend) pathSecrets() *framework.Secret {
 				Type:        framework.TypeString,
 				Description: "API token",
 			},
+			"api_key_id": {
+				Type:        framework.TypeString,
+				Description: "ID of the API key",
+			},
+			"api_key_fingerprint": {
+				Type:        framework.TypeString,
+				Description: "Hex SHA-256 of the API token, for looking it up in lookup",
+			},
+			"config": {
+				Type:        framework.TypeString,
+				Description: "API token rendered in the requested format",
+			},
 		},
-		Renew:  b.operationRenew,
+		Renew:  b.operationAPIKeyRenew,
 		Revoke: b.operationRevoke,
 	}
 }
@@ -29,19 +46,87 @@ func (b *backend) operationRevoke(ctx context.Context, req *logical.Request, d *
 		return nil, fmt.Errorf("secret is missing ID of the API token")
 	}
 	keyID := idRaw.(string)
-	client, err := b.Client(ctx, req.Storage)
-	if err != nil {
-		return nil, err
-	}
-	_, err = client.APIKeys.Delete(keyID)
+	roleName, _ := req.Secret.InternalData["role"].(string)
+	scope, _ := req.Secret.InternalData["scope"].(string)
+	event := leaseEvent(ctx, req.Storage, eventRevoke, req.Secret)
+	err := b.revokeAPIKeys(ctx, req.Storage, roleName, []string{keyID})
+	recordRevocation(roleName, scope, 1, err)
 	if err != nil {
 		return nil, err
 	}
+	b.notify(ctx, req.Storage, event)
 
 	return nil, nil
 }
 
+// deleteAPIKeys deletes API keys with bounded parallelism. Keys which don't
+// exist anymore are considered deleted.
+func (b *backend) deleteAPIKeys(ctx context.Context, s logical.Storage, keyIDs []string) error {
+	errs := make([]error, len(keyIDs))
+	sem := make(chan struct{}, issueParallelism)
+	var wg sync.WaitGroup
+	for i := range keyIDs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			errs[i] = b.apiCall(ctx, s, priorityRevoke, "APIKeys.Delete", func(c *packngo.Client) (resp *packngo.Response, err error) {
+				resp, err = c.APIKeys.Delete(keyIDs[i])
+				return resp, err
+			})
+			if isNotFound(errs[i]) {
+				errs[i] = nil
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	var result error
+	for _, err := range errs {
+		if err != nil {
+			result = multierror.Append(result, err)
+		}
+	}
+	return result
+}
+
+// revokeAPIKeys deletes API keys issued through a role and their records. If
+// deletion fails, the keys are queued for retry by the periodic function and
+// the error is returned.
+func (b *backend) revokeAPIKeys(ctx context.Context, s logical.Storage, roleName string, keyIDs []string) error {
+	if err := b.deleteAPIKeys(ctx, s, keyIDs); err != nil {
+		b.Logger().Warn("failed to revoke API keys", "role", roleName, "key_ids", keyIDs, "error", err)
+		if qErr := b.queueRevocations(ctx, s, roleName, keyIDs, err); qErr != nil {
+			b.Logger().Error("failed to queue API keys for revocation retry", "role", roleName, "key_ids", keyIDs, "error", qErr)
+		}
+		return err
+	}
+	b.Logger().Info("revoked API keys", "role", roleName, "key_ids", keyIDs)
+	if err := b.dequeueRevocations(ctx, s, keyIDs); err != nil {
+		return err
+	}
+	if roleName == "" {
+		// Lease issued before issued keys were recorded
+		return nil
+	}
+	for _, keyID := range keyIDs {
+		if err := b.forgetIssuedKey(ctx, s, roleName, keyID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isNotFound reports whether err is a 404 response of the Packet API.
+func isNotFound(err error) bool {
+	errResp, ok := err.(*packngo.ErrorResponse)
+	return ok && errResp.Response != nil && errResp.Response.StatusCode == http.StatusNotFound
+}
+
 func (b *backend) operationRenew(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	b.Logger().Debug("renewing lease", "role", req.Secret.InternalData["role"], "key_id", req.Secret.InternalData["api_key_id"],
+		"operation", req.Operation)
 	defaultLease, maxLease := b.getDefaultAndMaxLease()
 	resp := &logical.Response{Secret: req.Secret}
 	resp.Secret.TTL = defaultLease
@@ -49,6 +134,121 @@ func (b *backend) operationRenew(ctx context.Context, req *logical.Request, d *f
 	return resp, nil
 }
 
+// operationAPIKeyRenew renews leases of API keys of user and project roles,
+// after checking that the keys still exist in Packet, unless the role skips
+// the check. It fails closed: if the check itself fails, the lease isn't
+// renewed either.
+func (b *backend) operationAPIKeyRenew(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	roleName, _ := req.Secret.InternalData["role"].(string)
+	scope, _ := req.Secret.InternalData["scope"].(string)
+	projectID, _ := req.Secret.InternalData["project_id"].(string)
+	keyIDs := leaseKeyIDs(req.Secret)
+	if _, batch := req.Secret.InternalData["api_key_ids"]; batch {
+		// Claimed keys are checked when their own leases are renewed
+		var err error
+		if keyIDs, err = batchKeyIDs(ctx, req.Storage, roleName, keyIDs, false); err != nil {
+			return nil, err
+		}
+	}
+
+	role, err := readRole(ctx, req.Storage, roleName)
+	if err != nil {
+		return nil, err
+	}
+	if role != nil && role.SkipRenewCheck {
+		return b.renewAPIKeys(ctx, req, d)
+	}
+	if scope == TypeProject && projectID == "" && role != nil {
+		// Lease issued before the project was recorded
+		if templated, _ := isTemplated(role.ProjectID); !templated {
+			projectID = role.ProjectID
+		}
+	}
+	if (scope != TypeUser && scope != TypeProject) || (scope == TypeProject && projectID == "") {
+		b.Logger().Debug("can't check API keys of lease exist, renewing", "role", roleName, "key_ids", keyIDs)
+		return b.renewAPIKeys(ctx, req, d)
+	}
+
+	existing, err := b.listAPIKeys(ctx, req.Storage, projectID)
+	if err != nil {
+		// The renewal can be retried while the lease lasts
+		b.Logger().Warn("failed to check API keys of lease exist, refusing to renew", "role", roleName, "key_ids", keyIDs, "error", err)
+		return apiErrorResponse(err, "check API keys of lease exist in Packet")
+	}
+	var missing []string
+	for _, keyID := range keyIDs {
+		if _, ok := existing[keyID]; !ok {
+			missing = append(missing, keyID)
+		}
+	}
+	if len(missing) > 0 {
+		b.Logger().Warn("refusing to renew lease of deleted API keys", "role", roleName, "key_ids", missing)
+		return logical.ErrorResponse(fmt.Sprintf("API keys %s of role %s don't exist in Packet anymore, they were deleted outside of Vault", strings.Join(missing, ", "), roleName)), nil
+	}
+	return b.renewAPIKeys(ctx, req, d)
+}
+
+// renewAPIKeys renews the lease of API keys and notifies webhooks.
+func (b *backend) renewAPIKeys(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	resp, err := b.operationRenew(ctx, req, d)
+	if err != nil {
+		return resp, err
+	}
+	event := leaseEvent(ctx, req.Storage, eventRenew, req.Secret)
+	expires := time.Now().UTC().Add(resp.Secret.TTL)
+	event.ExpiresAt = &expires
+	b.notify(ctx, req.Storage, event)
+	return resp, nil
+}
+
+// listAPIKeys returns the API keys of a project, or of the user owning the
+// config token with empty projectID, by ID. The APIKeys.UserGet and
+// ProjectGet helpers list the keys too, but can't tell a missing key from a
+// failed call.
+func (b *backend) listAPIKeys(ctx context.Context, s logical.Storage, projectID string) (map[string]packngo.APIKey, error) {
+	var apiKeys []packngo.APIKey
+	var err error
+	if projectID == "" {
+		err = b.apiCall(ctx, s, priorityIssue, "APIKeys.UserList", func(c *packngo.Client) (resp *packngo.Response, err error) {
+			apiKeys, resp, err = c.APIKeys.UserList(nil)
+			return resp, err
+		})
+	} else {
+		err = b.apiCall(ctx, s, priorityIssue, "APIKeys.ProjectList", func(c *packngo.Client) (resp *packngo.Response, err error) {
+			apiKeys, resp, err = c.APIKeys.ProjectList(projectID, nil)
+			return resp, err
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[string]packngo.APIKey, len(apiKeys))
+	for _, k := range apiKeys {
+		byID[k.ID] = k
+	}
+	return byID, nil
+}
+
+// leaseKeyIDs returns the IDs of the API keys of a single or batch lease, nil
+// if the lease has none.
+func leaseKeyIDs(secret *logical.Secret) []string {
+	if id, ok := secret.InternalData["api_key_id"].(string); ok {
+		return []string{id}
+	}
+	// InternalData is JSON-decoded by the time the lease is renewed or revoked
+	switch ids := secret.InternalData["api_key_ids"].(type) {
+	case []string:
+		return ids
+	case []interface{}:
+		keyIDs := make([]string, 0, len(ids))
+		for _, id := range ids {
+			keyIDs = append(keyIDs, id.(string))
+		}
+		return keyIDs
+	}
+	return nil
+}
+
 func (b *backend) getDefaultAndMaxLease() (time.Duration, time.Duration) {
 	maxLease := b.system.MaxLeaseTTL()
 	defaultLease := b.system.DefaultLeaseTTL()
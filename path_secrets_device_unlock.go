@@ -0,0 +1,233 @@
+package packet
+
+import (
+	"context"
+	"fmt"
+
+	uuid "github.com/hashicorp/go-uuid"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/strutil"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/packethost/packngo"
+)
+
+const (
+	secretTypeDeviceUnlock = "packet_device_unlock"
+
+	// deviceUnlockPrefix is the storage prefix of devices unlocked by
+	// outstanding leases, "device-unlock/<device ID>". Like VPN leases,
+	// they're replicated, as the lock state is one for the Packet account.
+	deviceUnlockPrefix = "device-unlock/"
+)
+
+// deviceUnlockEntry records the outstanding leases a device is unlocked for,
+// and whether it was locked before the first of them. The device is locked
+// again when the last lease is released, if it was locked before.
+type deviceUnlockEntry struct {
+	Leases []string `json:"leases"`
+	Locked bool     `json:"locked"`
+}
+
+func readDeviceUnlock(ctx context.Context, s logical.Storage, deviceID string) (*deviceUnlockEntry, error) {
+	entry, err := s.Get(ctx, deviceUnlockPrefix+deviceID)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, nil
+	}
+	result := &deviceUnlockEntry{}
+	if err := entry.DecodeJSON(result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func writeDeviceUnlock(ctx context.Context, s logical.Storage, deviceID string, e *deviceUnlockEntry) error {
+	entry, err := logical.StorageEntryJSON(deviceUnlockPrefix+deviceID, e)
+	if err != nil {
+		return err
+	}
+	return s.Put(ctx, entry)
+}
+
+func (b *backend) pathSecretsDeviceUnlock() *framework.Secret {
+	return &framework.Secret{
+		Type: secretTypeDeviceUnlock,
+		Fields: map[string]*framework.FieldSchema{
+			"device_id": {
+				Type:        framework.TypeString,
+				Description: "ID of the unlocked device",
+			},
+		},
+		Renew:  b.operationRenew,
+		Revoke: b.operationDeviceUnlockRevoke,
+	}
+}
+
+// deviceAllowed checks whether the role permits unlocking of a device with
+// given ID, project and tags.
+func deviceAllowed(role *roleEntry, deviceID, projectID string, tags []string) bool {
+	if role.ProjectID != "" && role.ProjectID != projectID {
+		return false
+	}
+	if strutil.StrListContains(role.AllowedDeviceIDs, deviceID) {
+		return true
+	}
+	for _, t := range tags {
+		if strutil.StrListContains(role.AllowedDeviceTags, t) {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *backend) unlockDevice(ctx context.Context, req *logical.Request, data *framework.FieldData, roleName string, role *roleEntry) (*logical.Response, error) {
+	deviceID := data.Get("device_id").(string)
+	if deviceID == "" {
+		return logical.ErrorResponse("device_id is required for device-unlock role"), nil
+	}
+
+	var device *packngo.Device
+	err := b.apiCall(ctx, req.Storage, priorityIssue, "Devices.Get", func(c *packngo.Client) (resp *packngo.Response, err error) {
+		device, resp, err = c.Devices.Get(deviceID, nil)
+		return resp, err
+	})
+	if err != nil {
+		return apiErrorResponse(err, "get device from Packet")
+	}
+	projectID := ""
+	if device.Project != nil {
+		projectID = device.Project.ID
+	}
+	if !deviceAllowed(role, device.ID, projectID, device.Tags) {
+		return logical.ErrorResponse(fmt.Sprintf("role %s is not allowed to unlock device %s", roleName, deviceID)), nil
+	}
+
+	leaseID, err := uuid.GenerateUUID()
+	if err != nil {
+		return nil, err
+	}
+
+	b.deviceLock.Lock()
+	defer b.deviceLock.Unlock()
+
+	// Record the lease before unlocking, so that a concurrent revocation of
+	// another lease doesn't lock the device again
+	unlock, err := readDeviceUnlock(ctx, req.Storage, device.ID)
+	if err != nil {
+		return nil, err
+	}
+	if unlock == nil {
+		unlock = &deviceUnlockEntry{Locked: device.Locked}
+	}
+	unlock.Leases = append(unlock.Leases, leaseID)
+	if err := writeDeviceUnlock(ctx, req.Storage, device.ID, unlock); err != nil {
+		return nil, err
+	}
+
+	err = b.apiCall(ctx, req.Storage, priorityIssue, "Devices.Unlock", func(c *packngo.Client) (resp *packngo.Response, err error) {
+		resp, err = c.Devices.Unlock(device.ID)
+		return resp, err
+	})
+	if err != nil {
+		// The device wasn't unlocked for this lease, so there's nothing to
+		// lock again
+		if relErr := b.dropDeviceUnlockLease(ctx, req.Storage, device.ID, leaseID); relErr != nil {
+			return nil, relErr
+		}
+		return apiErrorResponse(err, "unlock device in Packet")
+	}
+	b.Logger().Info("unlocked device", "role", roleName, "device_id", device.ID, "project", projectID,
+		"was_locked", device.Locked, "unlock_leases", len(unlock.Leases), "operation", req.Operation)
+
+	resp := b.Secret(secretTypeDeviceUnlock).Response(map[string]interface{}{
+		"device_id": device.ID,
+	}, map[string]interface{}{
+		"device_id":       device.ID,
+		"role":            roleName,
+		"unlock_lease_id": leaseID,
+		"device_locked":   device.Locked,
+	})
+	if role.TTL != 0 {
+		resp.Secret.TTL = role.TTL
+	}
+	if role.MaxTTL != 0 {
+		resp.Secret.MaxTTL = role.MaxTTL
+	}
+
+	return resp, nil
+}
+
+// dropDeviceUnlockLease removes a lease which was never issued from the
+// record of the device, without touching the device. Callers must hold
+// deviceLock.
+func (b *backend) dropDeviceUnlockLease(ctx context.Context, s logical.Storage, deviceID, leaseID string) error {
+	unlock, err := readDeviceUnlock(ctx, s, deviceID)
+	if err != nil || unlock == nil {
+		return err
+	}
+	unlock.Leases = strutil.StrListDelete(unlock.Leases, leaseID)
+	if len(unlock.Leases) > 0 {
+		return writeDeviceUnlock(ctx, s, deviceID, unlock)
+	}
+	return s.Delete(ctx, deviceUnlockPrefix+deviceID)
+}
+
+// releaseDeviceUnlock removes an outstanding lease of an unlocked device and
+// locks the device when it was the last lease and the device was locked
+// before the first one. Without a record of the device, wasLocked tells
+// whether to lock it. Callers must hold deviceLock.
+func (b *backend) releaseDeviceUnlock(ctx context.Context, s logical.Storage, deviceID, leaseID string, wasLocked bool) error {
+	unlock, err := readDeviceUnlock(ctx, s, deviceID)
+	if err != nil {
+		return err
+	}
+	if unlock != nil {
+		unlock.Leases = strutil.StrListDelete(unlock.Leases, leaseID)
+		if len(unlock.Leases) > 0 {
+			return writeDeviceUnlock(ctx, s, deviceID, unlock)
+		}
+		wasLocked = unlock.Locked
+	}
+
+	if wasLocked {
+		err := b.apiCall(ctx, s, priorityRevoke, "Devices.Lock", func(c *packngo.Client) (resp *packngo.Response, err error) {
+			resp, err = c.Devices.Lock(deviceID)
+			return resp, err
+		})
+		if err != nil {
+			// Keep the record, so that the retried revocation locks the
+			// device
+			return err
+		}
+		b.Logger().Info("locked device after its last unlock lease was released", "device_id", deviceID)
+	}
+	return s.Delete(ctx, deviceUnlockPrefix+deviceID)
+}
+
+func (b *backend) operationDeviceUnlockRevoke(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	idRaw, ok := req.Secret.InternalData["device_id"]
+	if !ok {
+		return nil, fmt.Errorf("secret is missing ID of the unlocked device")
+	}
+	deviceID := idRaw.(string)
+	leaseID, _ := req.Secret.InternalData["unlock_lease_id"].(string)
+	// Leases issued before unlocks were recorded lock the device, as they
+	// used to
+	wasLocked, ok := req.Secret.InternalData["device_locked"].(bool)
+	if !ok {
+		wasLocked = true
+	}
+
+	b.deviceLock.Lock()
+	defer b.deviceLock.Unlock()
+
+	if err := b.releaseDeviceUnlock(ctx, req.Storage, deviceID, leaseID, wasLocked); err != nil {
+		return nil, err
+	}
+	b.Logger().Info("released device unlock", "role", req.Secret.InternalData["role"], "device_id", deviceID,
+		"operation", req.Operation)
+
+	return nil, nil
+}
@@ -0,0 +1,245 @@
+package packet
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	uuid "github.com/hashicorp/go-uuid"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/packethost/packngo"
+)
+
+const secretTypeReservation = "packet_hardware_reservation"
+
+// reservationLoanPrefix is the storage prefix of records of loaned hardware
+// reservations, "reservation-loan/<reservation ID>". Packet may still list a
+// reservation in its pool project right after it was moved, so the records
+// keep a reservation from being loaned twice.
+const reservationLoanPrefix = "reservation-loan/"
+
+// reservationLoan is the storage record of a loaned hardware reservation.
+// LoanID is also kept in the lease, so that revoking a lease whose loan
+// already ended doesn't move the reservation from under a later loan.
+type reservationLoan struct {
+	LoanID   string    `json:"loan_id"`
+	Role     string    `json:"role"`
+	LoanedAt time.Time `json:"loaned_at"`
+}
+
+func readReservationLoan(ctx context.Context, s logical.Storage, reservationID string) (*reservationLoan, error) {
+	entry, err := s.Get(ctx, reservationLoanPrefix+reservationID)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, nil
+	}
+	result := &reservationLoan{}
+	if err := entry.DecodeJSON(result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func writeReservationLoan(ctx context.Context, s logical.Storage, reservationID string, loan *reservationLoan) error {
+	entry, err := logical.StorageEntryJSON(reservationLoanPrefix+reservationID, loan)
+	if err != nil {
+		return err
+	}
+	return s.Put(ctx, entry)
+}
+
+func (b *backend) pathSecretsReservation() *framework.Secret {
+	return &framework.Secret{
+		Type: secretTypeReservation,
+		Fields: map[string]*framework.FieldSchema{
+			"reservation_id": {
+				Type:        framework.TypeString,
+				Description: "ID of the loaned hardware reservation",
+			},
+			"project_id": {
+				Type:        framework.TypeString,
+				Description: "Project to which the hardware reservation was moved",
+			},
+		},
+		Renew:  b.operationRenew,
+		Revoke: b.operationReservationRevoke,
+	}
+}
+
+// reservationAvailable reports whether a reservation in the pool project can
+// be loaned, i.e. it's provisionable and there's no device on it.
+func reservationAvailable(r *packngo.HardwareReservation) bool {
+	return r.Provisionable && r.Device == nil
+}
+
+func (b *backend) loanReservation(ctx context.Context, req *logical.Request, data *framework.FieldData, roleName string, role *roleEntry) (*logical.Response, error) {
+	b.reservationLock.Lock()
+	defer b.reservationLock.Unlock()
+
+	var reservation *packngo.HardwareReservation
+	if reservationID := data.Get("reservation_id").(string); reservationID != "" {
+		err := b.apiCall(ctx, req.Storage, priorityIssue, "HardwareReservations.Get", func(c *packngo.Client) (resp *packngo.Response, err error) {
+			reservation, resp, err = c.HardwareReservations.Get(reservationID, nil)
+			return resp, err
+		})
+		if err != nil {
+			return apiErrorResponse(err, "get hardware reservation from Packet")
+		}
+		if reservation.Project.ID != role.PoolProjectID {
+			return logical.ErrorResponse(fmt.Sprintf("hardware reservation %s is not in the pool project of role %s", reservationID, roleName)), nil
+		}
+		loan, err := readReservationLoan(ctx, req.Storage, reservationID)
+		if err != nil {
+			return nil, err
+		}
+		if !reservationAvailable(reservation) || loan != nil {
+			return logical.ErrorResponse(fmt.Sprintf("hardware reservation %s is not available", reservationID)), nil
+		}
+	} else {
+		var reservations []packngo.HardwareReservation
+		err := b.apiCall(ctx, req.Storage, priorityIssue, "HardwareReservations.List", func(c *packngo.Client) (resp *packngo.Response, err error) {
+			reservations, resp, err = c.HardwareReservations.List(role.PoolProjectID, nil)
+			return resp, err
+		})
+		if err != nil {
+			return apiErrorResponse(err, "list hardware reservations in Packet")
+		}
+		for i := range reservations {
+			if !reservationAvailable(&reservations[i]) {
+				continue
+			}
+			loan, err := readReservationLoan(ctx, req.Storage, reservations[i].ID)
+			if err != nil {
+				return nil, err
+			}
+			if loan == nil {
+				reservation = &reservations[i]
+				break
+			}
+		}
+		if reservation == nil {
+			return logical.ErrorResponse(fmt.Sprintf("no hardware reservation is available in the pool project of role %s", roleName)), nil
+		}
+	}
+
+	loanID, err := uuid.GenerateUUID()
+	if err != nil {
+		return nil, err
+	}
+	if err := writeReservationLoan(ctx, req.Storage, reservation.ID, &reservationLoan{
+		LoanID:   loanID,
+		Role:     roleName,
+		LoanedAt: time.Now(),
+	}); err != nil {
+		return nil, err
+	}
+	err = b.apiCall(ctx, req.Storage, priorityIssue, "HardwareReservations.Move", func(c *packngo.Client) (resp *packngo.Response, err error) {
+		_, resp, err = c.HardwareReservations.Move(reservation.ID, role.ProjectID)
+		return resp, err
+	})
+	if err != nil {
+		if delErr := req.Storage.Delete(ctx, reservationLoanPrefix+reservation.ID); delErr != nil {
+			return nil, delErr
+		}
+		return apiErrorResponse(err, "move hardware reservation in Packet")
+	}
+	b.Logger().Info("loaned hardware reservation", "role", roleName, "reservation_id", reservation.ID,
+		"project", role.ProjectID, "operation", req.Operation)
+
+	resp := b.Secret(secretTypeReservation).Response(map[string]interface{}{
+		"reservation_id": reservation.ID,
+		"project_id":     role.ProjectID,
+		"plan":           reservation.Plan.Slug,
+		"facility":       reservation.Facility.Code,
+	}, map[string]interface{}{
+		"reservation_id":  reservation.ID,
+		"loan_id":         loanID,
+		"pool_project_id": role.PoolProjectID,
+		"delete_devices":  role.DeleteDevices,
+		"role":            roleName,
+	})
+	if role.TTL != 0 {
+		resp.Secret.TTL = role.TTL
+	}
+	if role.MaxTTL != 0 {
+		resp.Secret.MaxTTL = role.MaxTTL
+	}
+
+	return resp, nil
+}
+
+func (b *backend) operationReservationRevoke(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	idRaw, ok := req.Secret.InternalData["reservation_id"]
+	if !ok {
+		return nil, fmt.Errorf("secret is missing ID of the hardware reservation")
+	}
+	reservationID := idRaw.(string)
+	poolRaw, ok := req.Secret.InternalData["pool_project_id"]
+	if !ok {
+		return nil, fmt.Errorf("secret is missing ID of the pool project")
+	}
+	poolProjectID := poolRaw.(string)
+	deleteDevices, _ := req.Secret.InternalData["delete_devices"].(bool)
+	// Leases issued before loans were recorded have no loan ID
+	loanID, _ := req.Secret.InternalData["loan_id"].(string)
+
+	b.reservationLock.Lock()
+	defer b.reservationLock.Unlock()
+
+	loan, err := readReservationLoan(ctx, req.Storage, reservationID)
+	if err != nil {
+		return nil, err
+	}
+	if loan != nil && loan.LoanID != loanID {
+		// The loan of this lease ended and the reservation was loaned again
+		b.Logger().Info("hardware reservation was loaned again, leaving it", "reservation_id", reservationID,
+			"operation", req.Operation)
+		return nil, nil
+	}
+
+	var reservation *packngo.HardwareReservation
+	err = b.apiCall(ctx, req.Storage, priorityRevoke, "HardwareReservations.Get", func(c *packngo.Client) (resp *packngo.Response, err error) {
+		reservation, resp, err = c.HardwareReservations.Get(reservationID, nil)
+		return resp, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if reservation.Project.ID == poolProjectID {
+		// Already returned to the pool
+		return nil, req.Storage.Delete(ctx, reservationLoanPrefix+reservationID)
+	}
+	if reservation.Device != nil {
+		if !deleteDevices {
+			return nil, fmt.Errorf("hardware reservation %s still has device %s, delete it to return the reservation", reservationID, reservation.Device.ID)
+		}
+		if reservation.Device.State != "deprovisioning" {
+			b.Logger().Info("deleting device on loaned hardware reservation", "reservation_id", reservationID,
+				"device_id", reservation.Device.ID, "operation", req.Operation)
+			err = b.apiCall(ctx, req.Storage, priorityRevoke, "Devices.Delete", func(c *packngo.Client) (resp *packngo.Response, err error) {
+				resp, err = c.Devices.Delete(reservation.Device.ID, false)
+				return resp, err
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+		// Packet deletes devices asynchronously, revocation is retried
+		// until the reservation is free to move back.
+		return nil, fmt.Errorf("waiting for device %s on hardware reservation %s to be deleted", reservation.Device.ID, reservationID)
+	}
+	err = b.apiCall(ctx, req.Storage, priorityRevoke, "HardwareReservations.Move", func(c *packngo.Client) (resp *packngo.Response, err error) {
+		_, resp, err = c.HardwareReservations.Move(reservationID, poolProjectID)
+		return resp, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	b.Logger().Info("returned hardware reservation", "role", req.Secret.InternalData["role"], "reservation_id", reservationID,
+		"project", poolProjectID, "operation", req.Operation)
+
+	return nil, req.Storage.Delete(ctx, reservationLoanPrefix+reservationID)
+}
@@ -0,0 +1,151 @@
+package packet
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/strutil"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/packethost/packngo"
+)
+
+const secretTypeSpotMarket = "packet_spot_market_request"
+
+func (b *backend) pathSecretsSpotMarket() *framework.Secret {
+	return &framework.Secret{
+		Type: secretTypeSpotMarket,
+		Fields: map[string]*framework.FieldSchema{
+			"spot_market_request_id": {
+				Type:        framework.TypeString,
+				Description: "ID of the spot market request",
+			},
+			"device_ids": {
+				Type:        framework.TypeStringSlice,
+				Description: "IDs of the devices created by the spot market request",
+			},
+		},
+		Renew:  b.operationRenew,
+		Revoke: b.operationSpotMarketRevoke,
+	}
+}
+
+func (b *backend) createSpotMarketRequest(ctx context.Context, req *logical.Request, data *framework.FieldData, roleName string, role *roleEntry) (*logical.Response, error) {
+	plan := data.Get("plan").(string)
+	if plan == "" && len(role.AllowedPlans) == 1 {
+		plan = role.AllowedPlans[0]
+	}
+	if !strutil.StrListContains(role.AllowedPlans, plan) {
+		return logical.ErrorResponse(fmt.Sprintf("plan must be one of %v", role.AllowedPlans)), nil
+	}
+
+	facilities := data.Get("facilities").([]string)
+	if len(facilities) == 0 {
+		facilities = role.AllowedFacilities
+	}
+	if !strutil.StrListSubset(role.AllowedFacilities, facilities) {
+		return logical.ErrorResponse(fmt.Sprintf("facilities must be a subset of %v", role.AllowedFacilities)), nil
+	}
+
+	operatingSystem := data.Get("operating_system").(string)
+	if operatingSystem == "" {
+		return logical.ErrorResponse("operating_system is required for spot-market-request role"), nil
+	}
+
+	devicesMin := data.Get("devices_min").(int)
+	if devicesMin == 0 {
+		devicesMin = 1
+	}
+	devicesMax := data.Get("devices_max").(int)
+	if devicesMax == 0 {
+		devicesMax = devicesMin
+	}
+	if devicesMin < 1 || devicesMax < devicesMin || devicesMax > role.MaxDevices {
+		return logical.ErrorResponse(fmt.Sprintf("devices_min and devices_max must satisfy 1 <= devices_min <= devices_max <= %d", role.MaxDevices)), nil
+	}
+
+	bidPrice := role.MaxBidPrice
+	if raw, ok := data.GetOk("max_bid_price"); ok {
+		var err error
+		bidPrice, err = strconv.ParseFloat(raw.(string), 64)
+		if err != nil || math.IsNaN(bidPrice) || math.IsInf(bidPrice, 0) || bidPrice <= 0 {
+			return logical.ErrorResponse(fmt.Sprintf("max_bid_price must be a positive number, was %s", raw.(string))), nil
+		}
+	}
+	if bidPrice > role.MaxBidPrice {
+		return logical.ErrorResponse(fmt.Sprintf("max_bid_price can't exceed %v set by role %s", role.MaxBidPrice, roleName)), nil
+	}
+
+	createRequest := packngo.SpotMarketRequestCreateRequest{
+		DevicesMin:  devicesMin,
+		DevicesMax:  devicesMax,
+		FacilityIDs: facilities,
+		MaxBidPrice: bidPrice,
+		Parameters: packngo.SpotMarketRequestInstanceParameters{
+			BillingCycle:    "hourly",
+			Description:     fmt.Sprintf("Vault-%s", roleName),
+			Hostname:        data.Get("hostname").(string),
+			OperatingSystem: operatingSystem,
+			Plan:            plan,
+			Tags:            []string{fmt.Sprintf("Vault-%s", roleName)},
+		},
+	}
+	if role.MaxTTL != 0 {
+		// Let Packet end the request even if the lease is never revoked
+		createRequest.EndAt = &packngo.Timestamp{Time: time.Now().Add(role.MaxTTL)}
+	}
+
+	var smr *packngo.SpotMarketRequest
+	err := b.apiCall(ctx, req.Storage, priorityIssue, "SpotMarketRequests.Create", func(c *packngo.Client) (resp *packngo.Response, err error) {
+		smr, resp, err = c.SpotMarketRequests.Create(&createRequest, role.ProjectID)
+		return resp, err
+	})
+	if err != nil {
+		return apiErrorResponse(err, "create spot market request in Packet")
+	}
+
+	deviceIDs := make([]string, 0, len(smr.Devices))
+	for _, d := range smr.Devices {
+		deviceIDs = append(deviceIDs, d.ID)
+	}
+	b.Logger().Info("created spot market request", "role", roleName, "spot_market_request_id", smr.ID,
+		"project", role.ProjectID, "operation", req.Operation)
+
+	resp := b.Secret(secretTypeSpotMarket).Response(map[string]interface{}{
+		"spot_market_request_id": smr.ID,
+		"device_ids":             deviceIDs,
+	}, map[string]interface{}{
+		"spot_market_request_id": smr.ID,
+		"role":                   roleName,
+	})
+	if role.TTL != 0 {
+		resp.Secret.TTL = role.TTL
+	}
+	if role.MaxTTL != 0 {
+		resp.Secret.MaxTTL = role.MaxTTL
+	}
+
+	return resp, nil
+}
+
+func (b *backend) operationSpotMarketRevoke(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	idRaw, ok := req.Secret.InternalData["spot_market_request_id"]
+	if !ok {
+		return nil, fmt.Errorf("secret is missing ID of the spot market request")
+	}
+	smrID := idRaw.(string)
+	err := b.apiCall(ctx, req.Storage, priorityRevoke, "SpotMarketRequests.Delete", func(c *packngo.Client) (resp *packngo.Response, err error) {
+		resp, err = c.SpotMarketRequests.Delete(smrID, true)
+		return resp, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	b.Logger().Info("deleted spot market request", "role", req.Secret.InternalData["role"], "spot_market_request_id", smrID,
+		"operation", req.Operation)
+
+	return nil, nil
+}
@@ -0,0 +1,189 @@
+package packet
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/packethost/packngo"
+)
+
+// health records outcomes of Packet API calls and periodic runs of the
+// mount, for the status endpoint. It's kept in memory, so it reflects the
+// node serving the request since the plugin started.
+type health struct {
+	mu sync.Mutex
+
+	lastSuccess         time.Time
+	lastFailure         time.Time
+	lastFailureEndpoint string
+	lastError           string
+
+	lastPeriodicRun   time.Time
+	lastPeriodicError string
+}
+
+// recordCall records the outcome of a Packet API call. Not found responses
+// mean the API works, so they count as successes.
+func (h *health) recordCall(endpoint string, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err == nil || isNotFound(err) {
+		h.lastSuccess = time.Now()
+		return
+	}
+	h.lastFailure = time.Now()
+	h.lastFailureEndpoint = endpoint
+	h.lastError = err.Error()
+}
+
+func (h *health) recordPeriodicRun(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastPeriodicRun = time.Now()
+	h.lastPeriodicError = ""
+	if err != nil {
+		h.lastPeriodicError = err.Error()
+	}
+}
+
+// state returns the recorded rate limit. Remaining and reset are only
+// meaningful if known is true.
+func (r *rateLimiter) state() (known bool, remaining int, reset time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.known && !time.Now().Before(r.reset) {
+		return false, 0, time.Time{}
+	}
+	return r.known, r.remaining, r.reset
+}
+
+// formatTime formats t for the status response, with zero time as empty
+// string.
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+func (b *backend) pathStatus() *framework.Path {
+	return &framework.Path{
+		Pattern: "status",
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.ReadOperation: b.operationStatusRead,
+		},
+		HelpSynopsis:    pathStatusHelpSyn,
+		HelpDescription: pathStatusHelpDesc,
+	}
+}
+
+func (b *backend) operationStatusRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	conf, err := readConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	status := map[string]interface{}{
+		"config_present": conf != nil,
+	}
+
+	if conf != nil {
+		var user *packngo.User
+		err := b.apiCall(ctx, req.Storage, priorityIssue, "Users.Current", func(c *packngo.Client) (resp *packngo.Response, err error) {
+			user, resp, err = c.Users.Current()
+			return resp, err
+		})
+		errResp, _ := err.(*packngo.ErrorResponse)
+		switch {
+		case err == nil:
+			status["authenticated"] = true
+			status["token_scope"] = TypeUser
+			status["token_owner_id"] = user.ID
+			status["token_owner_email"] = user.Email
+		case errResp != nil && errResp.Response != nil && errResp.Response.StatusCode == http.StatusForbidden:
+			// Project keys can't read the user
+			status["authenticated"] = true
+			status["token_scope"] = TypeProject
+		default:
+			status["authenticated"] = false
+			status["auth_error"] = err.Error()
+		}
+	}
+
+	// The mount-wide rate limit is the one of the token with most remaining
+	// requests
+	status["rate_limit_known"] = false
+	b.lock.RLock()
+	clients := b.clients
+	b.lock.RUnlock()
+	tokens := []map[string]interface{}{}
+	best := -1
+	for _, c := range clients {
+		b.lock.RLock()
+		token := map[string]interface{}{
+			"index":          c.index,
+			"fingerprint":    c.fingerprint,
+			"active":         !c.disabled,
+			"disabled_at":    formatTime(c.disabledAt),
+			"disabled_error": c.disabledError,
+		}
+		b.lock.RUnlock()
+		known, remaining, reset := c.limiter.state()
+		token["rate_limit_known"] = known
+		if known {
+			token["rate_limit_remaining"] = remaining
+			token["rate_limit_reset"] = formatTime(reset)
+			if token["active"] == true && remaining > best {
+				best = remaining
+				status["rate_limit_known"] = true
+				status["rate_limit_remaining"] = remaining
+				status["rate_limit_reset"] = formatTime(reset)
+			}
+		}
+		tokens = append(tokens, token)
+	}
+	if conf != nil {
+		status["api_tokens"] = tokens
+	}
+
+	for state, prefix := range revocationPrefixes {
+		keyIDs, err := req.Storage.List(ctx, prefix)
+		if err != nil {
+			return nil, err
+		}
+		status["revocations_"+state] = len(keyIDs)
+	}
+	outbox, err := req.Storage.List(ctx, webhookOutboxPrefix)
+	if err != nil {
+		return nil, err
+	}
+	status["webhook_outbox"] = len(outbox)
+
+	b.health.mu.Lock()
+	status["last_api_success"] = formatTime(b.health.lastSuccess)
+	status["last_api_failure"] = formatTime(b.health.lastFailure)
+	status["last_api_failure_endpoint"] = b.health.lastFailureEndpoint
+	status["last_api_error"] = b.health.lastError
+	status["last_periodic_run"] = formatTime(b.health.lastPeriodicRun)
+	status["last_periodic_error"] = b.health.lastPeriodicError
+	b.health.mu.Unlock()
+
+	return &logical.Response{Data: status}, nil
+}
+
+const pathStatusHelpSyn = `Report health of the Packet secrets engine.`
+
+const pathStatusHelpDesc = `This path reports whether the config is present and its API token still
+authenticates to Packet, the scope and owner of the token, the rate-limit
+state of the Packet API, the configured API tokens identified by index and
+SHA-256 fingerprint with their rate limits and whether Packet rejected them,
+the number of API keys whose revocation is pending retry or failed, the
+number of webhook events waiting for delivery, the last successful and failed
+Packet API calls, and the result of the last periodic run, which retries
+revocations, maintains pools of API keys and retries webhook deliveries.
+
+The API call and periodic run history is kept in memory of the Vault node
+serving the request, since the plugin started.`
@@ -0,0 +1,147 @@
+package packet
+
+import (
+	"context"
+	"fmt"
+
+	uuid "github.com/hashicorp/go-uuid"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/packethost/packngo"
+)
+
+const (
+	secretTypeVPN = "packet_vpn"
+
+	// vpnLeasePrefix is the storage prefix of outstanding VPN leases. VPN is
+	// disabled when the last of them is revoked.
+	vpnLeasePrefix = "vpn-lease/"
+)
+
+func (b *backend) pathVPN() *framework.Path {
+	return &framework.Path{
+		Pattern: "vpn/" + framework.GenericNameRegex("facility"),
+		Fields: map[string]*framework.FieldSchema{
+			"facility": {
+				Type:        framework.TypeLowerCaseString,
+				Description: "Code of the facility to get VPN config for.",
+			},
+		},
+		// VPN leases are tracked in replicated storage, as VPN is enabled for
+		// the whole Packet account
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ReadOperation: &framework.PathOperation{
+				Callback:                    b.operationVPNRead,
+				ForwardPerformanceStandby:   true,
+				ForwardPerformanceSecondary: true,
+			},
+		},
+		HelpSynopsis:    pathVPNHelpSyn,
+		HelpDescription: pathVPNHelpDesc,
+	}
+}
+
+func (b *backend) pathSecretsVPN() *framework.Secret {
+	return &framework.Secret{
+		Type: secretTypeVPN,
+		Fields: map[string]*framework.FieldSchema{
+			"config": {
+				Type:        framework.TypeString,
+				Description: "OpenVPN client config",
+			},
+		},
+		Renew:  b.operationRenew,
+		Revoke: b.operationVPNRevoke,
+	}
+}
+
+func (b *backend) operationVPNRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	facility := data.Get("facility").(string)
+	if facility == "" {
+		return logical.ErrorResponse("missing facility"), nil
+	}
+
+	leaseID, err := uuid.GenerateUUID()
+	if err != nil {
+		return nil, err
+	}
+
+	b.vpnLock.Lock()
+	defer b.vpnLock.Unlock()
+
+	// Record the lease before enabling VPN, so that a concurrent revocation
+	// of the last other lease doesn't disable it under us.
+	if err := req.Storage.Put(ctx, &logical.StorageEntry{Key: vpnLeasePrefix + leaseID}); err != nil {
+		return nil, err
+	}
+
+	var conf *packngo.VPNConfig
+	err = b.apiCall(ctx, req.Storage, priorityIssue, "VPN.Enable", func(c *packngo.Client) (resp *packngo.Response, err error) {
+		resp, err = c.VPN.Enable()
+		return resp, err
+	})
+	if err == nil {
+		err = b.apiCall(ctx, req.Storage, priorityIssue, "VPN.Get", func(c *packngo.Client) (resp *packngo.Response, err error) {
+			conf, resp, err = c.VPN.Get(facility, nil)
+			return resp, err
+		})
+	}
+	if err != nil {
+		if relErr := b.releaseVPNLease(ctx, req.Storage, leaseID); relErr != nil {
+			return nil, relErr
+		}
+		return apiErrorResponse(err, "get VPN config from Packet")
+	}
+	b.Logger().Info("enabled VPN", "facility", facility, "vpn_lease_id", leaseID, "operation", req.Operation)
+
+	return b.Secret(secretTypeVPN).Response(map[string]interface{}{
+		"config": conf.Config,
+	}, map[string]interface{}{
+		"vpn_lease_id": leaseID,
+		"facility":     facility,
+	}), nil
+}
+
+// releaseVPNLease removes an outstanding VPN lease and disables VPN when it
+// was the last one. Callers must hold vpnLock.
+func (b *backend) releaseVPNLease(ctx context.Context, s logical.Storage, leaseID string) error {
+	if err := s.Delete(ctx, vpnLeasePrefix+leaseID); err != nil {
+		return err
+	}
+	leases, err := s.List(ctx, vpnLeasePrefix)
+	if err != nil {
+		return err
+	}
+	if len(leases) > 0 {
+		return nil
+	}
+	err = b.apiCall(ctx, s, priorityRevoke, "VPN.Disable", func(c *packngo.Client) (resp *packngo.Response, err error) {
+		resp, err = c.VPN.Disable()
+		return resp, err
+	})
+	if err == nil {
+		b.Logger().Info("disabled VPN after its last lease was released")
+	}
+	return err
+}
+
+func (b *backend) operationVPNRevoke(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	idRaw, ok := req.Secret.InternalData["vpn_lease_id"]
+	if !ok {
+		return nil, fmt.Errorf("secret is missing ID of the VPN lease")
+	}
+
+	b.vpnLock.Lock()
+	defer b.vpnLock.Unlock()
+
+	if err := b.releaseVPNLease(ctx, req.Storage, idRaw.(string)); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+const pathVPNHelpSyn = `Enable Packet Doorman VPN and get client config for a facility.`
+
+const pathVPNHelpDesc = `This path enables the VPN of the user owning the configured API token and
+returns the OpenVPN client config for the given facility. VPN is disabled again
+when the last outstanding VPN lease is revoked.`
@@ -0,0 +1,140 @@
+package packet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/strutil"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func (b *backend) pathConfigWebhooks() *framework.Path {
+	return &framework.Path{
+		Pattern: "config/webhooks",
+		Fields: map[string]*framework.FieldSchema{
+			"urls": {
+				Type:        framework.TypeCommaStringSlice,
+				Description: "HTTP(S) URLs to POST credential lifecycle events to.",
+			},
+			"secret": {
+				Type:        framework.TypeString,
+				Description: "Secret keying the HMAC-SHA256 signature of events. Required when the webhook config is first written.",
+			},
+			"events": {
+				Type:        framework.TypeCommaStringSlice,
+				Description: "Event types to send, any of issue, renew, revoke, rollback and sweep. Defaults to all of them.",
+			},
+			"outbox_size": {
+				Type:        framework.TypeInt,
+				Description: "Maximum number of undelivered events kept for retry, counting an event once per URL. The oldest are dropped when it's exceeded.",
+				Default:     defaultWebhookOutboxSize,
+			},
+		},
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ReadOperation: &framework.PathOperation{Callback: b.operationWebhooksRead},
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback:                    b.operationWebhooksUpdate,
+				ForwardPerformanceStandby:   true,
+				ForwardPerformanceSecondary: true,
+			},
+			logical.DeleteOperation: &framework.PathOperation{
+				Callback:                    b.operationWebhooksDelete,
+				ForwardPerformanceStandby:   true,
+				ForwardPerformanceSecondary: true,
+			},
+		},
+		HelpSynopsis:    pathConfigWebhooksHelpSyn,
+		HelpDescription: pathConfigWebhooksHelpDesc,
+	}
+}
+
+func (b *backend) operationWebhooksUpdate(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	conf, err := readWebhookConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if conf == nil {
+		conf = &webhookConfig{OutboxSize: defaultWebhookOutboxSize}
+	}
+	if raw, ok := data.GetOk("urls"); ok {
+		conf.URLs = raw.([]string)
+		for _, u := range conf.URLs {
+			parsed, err := url.Parse(u)
+			if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+				return nil, fmt.Errorf("urls must be HTTP or HTTPS URLs, %q isn't", u)
+			}
+		}
+	}
+	if raw, ok := data.GetOk("secret"); ok {
+		conf.Secret = strings.TrimSpace(raw.(string))
+	}
+	if conf.Secret == "" {
+		return nil, errors.New("secret is required")
+	}
+	if raw, ok := data.GetOk("events"); ok {
+		conf.Events = raw.([]string)
+		for _, e := range conf.Events {
+			if !strutil.StrListContains(webhookEvents, e) {
+				return nil, fmt.Errorf("events must be any of %s, %q isn't", strings.Join(webhookEvents, ", "), e)
+			}
+		}
+	}
+	if raw, ok := data.GetOk("outbox_size"); ok {
+		conf.OutboxSize = raw.(int)
+		if conf.OutboxSize < 1 {
+			return nil, errors.New("outbox_size must be positive")
+		}
+	}
+
+	entry, err := logical.StorageEntryJSON(webhookConfigKey, conf)
+	if err != nil {
+		return nil, err
+	}
+	return nil, req.Storage.Put(ctx, entry)
+}
+
+func (b *backend) operationWebhooksRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	conf, err := readWebhookConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if conf == nil {
+		return nil, nil
+	}
+	events := conf.Events
+	if len(events) == 0 {
+		events = webhookEvents
+	}
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"urls":        conf.URLs,
+			"events":      events,
+			"outbox_size": conf.OutboxSize,
+		},
+	}, nil
+}
+
+func (b *backend) operationWebhooksDelete(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	return nil, req.Storage.Delete(ctx, webhookConfigKey)
+}
+
+const pathConfigWebhooksHelpSyn = `Configure webhooks notified of credential lifecycle events.`
+
+const pathConfigWebhooksHelpDesc = `Events are POSTed as JSON to every URL when API keys are issued, renewed,
+revoked, rolled back after a failed issuance, or deleted from a pool by the
+periodic function (sweep). They carry the event ID and type, the role, key
+IDs, project, whether the role is read-only, the requester entity and display
+name, and timestamps.
+
+The X-Vault-Packet-Signature header holds "sha256=" and the hex HMAC-SHA256
+of the body keyed with secret. X-Vault-Packet-Event holds the event type and
+X-Vault-Packet-Delivery an ID which stays the same across retries.
+
+Events are queued in an outbox in storage, so delivery survives restarts.
+Failed deliveries are retried by the periodic function with exponential
+backoff, and dropped after 8 attempts. When the outbox holds outbox_size
+events, the oldest are dropped. The secret is never returned on read.`
@@ -0,0 +1,155 @@
+package packet
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/helper/strutil"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/packethost/packngo"
+)
+
+// rolePolicy is the mount-wide policy in config, limiting what roles may
+// grant. Its zero value allows everything, so configs written before the
+// policy existed keep working. Permissions are stored negated for that
+// reason, and MaxRoleTTL is in seconds.
+type rolePolicy struct {
+	AllowedOrganizationIDs []string `json:"allowed_organization_ids"`
+	AllowedProjectIDs      []string `json:"allowed_project_ids"`
+	DenyReadWrite          bool     `json:"deny_read_write"`
+	DenyUserRoles          bool     `json:"deny_user_roles"`
+	MaxRoleTTL             int64    `json:"max_role_ttl"`
+}
+
+// restrictsProjects reports whether the policy limits the projects roles may
+// target.
+func (p *rolePolicy) restrictsProjects() bool {
+	return len(p.AllowedOrganizationIDs) > 0 || len(p.AllowedProjectIDs) > 0
+}
+
+// targetProjects returns the projects a role operates in. Templated project
+// IDs are left out, they're known only once resolved at issuance.
+func (r *roleEntry) targetProjects() []string {
+	var projects []string
+	if ok, _ := isTemplated(r.ProjectID); !ok && r.ProjectID != "" {
+		projects = append(projects, r.ProjectID)
+	}
+	if r.PoolProjectID != "" {
+		projects = append(projects, r.PoolProjectID)
+	}
+	return projects
+}
+
+// readPolicy returns the policy from config, the zero policy if the backend
+// isn't configured.
+func readPolicy(ctx context.Context, s logical.Storage) (*rolePolicy, error) {
+	conf, err := readConfig(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+	if conf == nil {
+		return &rolePolicy{}, nil
+	}
+	return &conf.Policy, nil
+}
+
+// checkPolicy checks a role against the mount policy. The returned error
+// explains the violation. Checking allowed organizations takes a Packet API
+// call per project the role targets.
+func (b *backend) checkPolicy(ctx context.Context, s logical.Storage, policy *rolePolicy, role *roleEntry) error {
+	if policy.DenyUserRoles && role.Type == TypeUser {
+		return fmt.Errorf("the mount policy doesn't allow %s roles", TypeUser)
+	}
+	if policy.DenyReadWrite && (role.Type == TypeUser || role.Type == TypeProject) && !role.ReadOnly {
+		return fmt.Errorf("the mount policy doesn't allow roles with read_only=false")
+	}
+	if policy.MaxRoleTTL > 0 {
+		ceiling := time.Duration(policy.MaxRoleTTL) * time.Second
+		if role.MaxTTL == 0 || role.MaxTTL > ceiling {
+			return fmt.Errorf("the mount policy requires max_ttl of roles to be set and at most %d seconds", policy.MaxRoleTTL)
+		}
+		if role.TTL > ceiling {
+			return fmt.Errorf("the mount policy requires ttl of roles to be at most %d seconds", policy.MaxRoleTTL)
+		}
+	}
+
+	// User keys aren't tied to a project, they're limited by DenyUserRoles
+	if !policy.restrictsProjects() || role.Type == TypeUser {
+		return nil
+	}
+	if role.Type == TypeDeviceUnlock && role.ProjectID == "" {
+		return fmt.Errorf("the mount policy restricts projects, so device-unlock roles need project_id")
+	}
+	for _, projectID := range role.targetProjects() {
+		if len(policy.AllowedProjectIDs) > 0 && !strutil.StrListContains(policy.AllowedProjectIDs, projectID) {
+			return fmt.Errorf("the mount policy doesn't allow project %s", projectID)
+		}
+		if len(policy.AllowedOrganizationIDs) == 0 {
+			continue
+		}
+		orgID, err := b.projectOrganization(ctx, s, projectID)
+		if err != nil {
+			return fmt.Errorf("failed to look up organization of project %s: %v", projectID, err)
+		}
+		if !strutil.StrListContains(policy.AllowedOrganizationIDs, orgID) {
+			return fmt.Errorf("the mount policy doesn't allow organization %s of project %s", orgID, projectID)
+		}
+	}
+	return nil
+}
+
+func (b *backend) projectOrganization(ctx context.Context, s logical.Storage, projectID string) (string, error) {
+	var project *packngo.Project
+	err := b.apiCall(ctx, s, priorityIssue, "Projects.Get", func(c *packngo.Client) (resp *packngo.Response, err error) {
+		project, resp, err = c.Projects.Get(projectID, &packngo.GetOptions{Includes: []string{"organization"}})
+		return resp, err
+	})
+	if err != nil {
+		return "", err
+	}
+	if project.Organization.ID != "" {
+		return project.Organization.ID, nil
+	}
+	// Without the include, the organization is only referenced by href
+	return project.Organization.URL[strings.LastIndex(project.Organization.URL, "/")+1:], nil
+}
+
+// enforcePolicy checks a role against the mount policy before issuance, so
+// that roles written before the policy was tightened refuse to issue. A
+// violation is returned as error response.
+func (b *backend) enforcePolicy(ctx context.Context, s logical.Storage, roleName string, role *roleEntry) (*logical.Response, error) {
+	policy, err := readPolicy(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+	if err := b.checkPolicy(ctx, s, policy, role); err != nil {
+		b.Logger().Warn("role violates mount policy", "role", roleName, "error", err)
+		return logical.ErrorResponse(fmt.Sprintf("role %s violates the mount policy: %v", roleName, err)), nil
+	}
+	return nil, nil
+}
+
+// policyViolations checks all roles against a policy and returns the
+// violations by role name.
+func (b *backend) policyViolations(ctx context.Context, s logical.Storage, policy *rolePolicy) (map[string]string, error) {
+	roleNames, err := s.List(ctx, "role/")
+	if err != nil {
+		return nil, err
+	}
+	violations := map[string]string{}
+	for _, roleName := range roleNames {
+		role, err := readRole(ctx, s, roleName)
+		if err != nil {
+			return nil, err
+		}
+		if role == nil {
+			continue
+		}
+		if err := b.checkPolicy(ctx, s, policy, role); err != nil {
+			violations[roleName] = err.Error()
+		}
+	}
+	return violations, nil
+}
@@ -0,0 +1,307 @@
+package packet
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/helper/locksutil"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/packethost/packngo"
+)
+
+// poolPrefix is the storage prefix of API keys created ahead of issuance,
+// "pool/<role>/<key ID>". The entries hold tokens, so they're seal-wrapped.
+const poolPrefix = "pool/"
+
+// pooledKey is an API key created for a role but not issued yet. The role
+// parameters it was created with are kept, so that keys which no longer
+// match the role are never issued.
+type pooledKey struct {
+	KeyID     string    `json:"key_id"`
+	Token     string    `json:"token"`
+	ReadOnly  bool      `json:"read_only"`
+	ProjectID string    `json:"project_id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// usable reports whether the pooled key can be issued for the role.
+func (k *pooledKey) usable(role *roleEntry) bool {
+	if k.ReadOnly != role.ReadOnly || k.ProjectID != role.ProjectID {
+		return false
+	}
+	return role.PoolMaxAge == 0 || time.Since(k.CreatedAt) < role.PoolMaxAge
+}
+
+func readPooledKey(ctx context.Context, s logical.Storage, roleName, keyID string) (*pooledKey, error) {
+	entry, err := s.Get(ctx, poolPrefix+roleName+"/"+keyID)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, nil
+	}
+	result := &pooledKey{}
+	if err := entry.DecodeJSON(result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// takePooledKey removes a usable key from the pool of the role and returns
+// it. It returns nil if there's no usable key in the pool.
+func (b *backend) takePooledKey(ctx context.Context, s logical.Storage, roleName string, role *roleEntry) (*pooledKey, error) {
+	lock := locksutil.LockForKey(b.poolLocks, roleName)
+	lock.Lock()
+	defer lock.Unlock()
+
+	keyIDs, err := s.List(ctx, poolPrefix+roleName+"/")
+	if err != nil {
+		return nil, err
+	}
+	for _, keyID := range keyIDs {
+		k, err := readPooledKey(ctx, s, roleName, keyID)
+		if err != nil {
+			return nil, err
+		}
+		if k == nil || !k.usable(role) {
+			// Left for maintainPools to delete
+			continue
+		}
+		if err := s.Delete(ctx, poolPrefix+roleName+"/"+keyID); err != nil {
+			return nil, err
+		}
+		return k, nil
+	}
+	return nil, nil
+}
+
+// issuePooledKey issues an API key from the pool of the role within the
+// limits of the role, and refills the pool in the background. It returns nil
+// if the pool is empty.
+func (b *backend) issuePooledKey(ctx context.Context, s logical.Storage, roleName string, role *roleEntry, who *requester) (*packngo.APIKey, error) {
+	slots, err := b.reserveIssuance(ctx, s, roleName, role, 1)
+	if err != nil {
+		return nil, err
+	}
+	k, err := b.takePooledKey(ctx, s, roleName, role)
+	var apiKey *packngo.APIKey
+	if err == nil && k != nil {
+		apiKey = &packngo.APIKey{ID: k.KeyID, Token: k.Token, ReadOnly: k.ReadOnly}
+		if err = b.recordIssuedKey(ctx, s, slots[0], b.newIssuedKey(roleName, role, apiKey, who)); err != nil {
+			b.returnPooledKey(ctx, s, roleName, k)
+		}
+	}
+	if err != nil || k == nil {
+		if relErr := b.releaseSlot(ctx, s, roleName, slots[0]); relErr != nil {
+			return nil, relErr
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	b.background.Add(1)
+	go func() {
+		defer b.background.Done()
+		// A failed refill is retried by maintainPools
+		if err := b.refillPool(context.Background(), s, roleName, role); err != nil {
+			b.Logger().Warn("failed to refill pool", "role", roleName, "error", err)
+		}
+	}()
+
+	return apiKey, nil
+}
+
+// returnPooledKey puts a key taken from the pool back after its issuance
+// failed, dropping whatever part of its issuance record was written. If that
+// fails too, the key is deleted, so that no key is left behind which is
+// neither pooled nor issued.
+func (b *backend) returnPooledKey(ctx context.Context, s logical.Storage, roleName string, k *pooledKey) {
+	err := b.forgetIssuedKey(ctx, s, roleName, k.KeyID)
+	if err == nil {
+		lock := locksutil.LockForKey(b.poolLocks, roleName)
+		lock.Lock()
+		err = writePooledKey(ctx, s, roleName, k)
+		lock.Unlock()
+	}
+	if err == nil {
+		b.Logger().Info("returned API key to pool after failed issuance", "role", roleName, "key_id", k.KeyID)
+		return
+	}
+	b.Logger().Warn("failed to return API key to pool, deleting it", "role", roleName, "key_id", k.KeyID, "error", err)
+	if err := b.deleteAPIKeys(ctx, s, []string{k.KeyID}); err != nil {
+		b.Logger().Error("failed to delete API key taken from pool", "role", roleName, "key_id", k.KeyID, "error", err)
+	}
+}
+
+func writePooledKey(ctx context.Context, s logical.Storage, roleName string, k *pooledKey) error {
+	entry, err := logical.StorageEntryJSON(poolPrefix+roleName+"/"+k.KeyID, k)
+	if err != nil {
+		return err
+	}
+	return s.Put(ctx, entry)
+}
+
+// usablePooledKeys returns the number of keys in the pool of the role which
+// can be issued for it. The pool lock of the role must be held.
+func usablePooledKeys(ctx context.Context, s logical.Storage, roleName string, role *roleEntry) (int, error) {
+	keyIDs, err := s.List(ctx, poolPrefix+roleName+"/")
+	if err != nil {
+		return 0, err
+	}
+	usable := 0
+	for _, keyID := range keyIDs {
+		k, err := readPooledKey(ctx, s, roleName, keyID)
+		if err != nil {
+			return 0, err
+		}
+		if k != nil && k.usable(role) {
+			usable++
+		}
+	}
+	return usable, nil
+}
+
+// refillPool creates API keys until the pool of the role has pool_size keys
+// usable for the role. Concurrent refills of the same pool are skipped. The
+// pool lock is held while counting and adding keys, but not while creating
+// them, so that issuance from the pool doesn't wait for Packet. A key created
+// after the pool was filled by other means is deleted.
+func (b *backend) refillPool(ctx context.Context, s logical.Storage, roleName string, role *roleEntry) error {
+	if _, busy := b.poolRefills.LoadOrStore(roleName, true); busy {
+		return nil
+	}
+	defer b.poolRefills.Delete(roleName)
+
+	lock := locksutil.LockForKey(b.poolLocks, roleName)
+	for {
+		lock.Lock()
+		usable, err := usablePooledKeys(ctx, s, roleName, role)
+		lock.Unlock()
+		if err != nil || usable >= role.PoolSize {
+			return err
+		}
+
+		apiKey, err := b.createAPIKey(ctx, s, roleName, role)
+		if err != nil {
+			return err
+		}
+		if added, err := b.addPooledKey(ctx, s, roleName, role, apiKey); err != nil || !added {
+			if delErr := b.deleteAPIKeys(ctx, s, []string{apiKey.ID}); delErr != nil {
+				b.Logger().Error("failed to delete API key not added to pool", "role", roleName, "key_id", apiKey.ID, "error", delErr)
+			}
+			return err
+		}
+		b.Logger().Debug("added API key to pool", "role", roleName, "key_id", apiKey.ID, "project", role.ProjectID)
+	}
+}
+
+// addPooledKey adds a created API key to the pool of the role unless the pool
+// is full already.
+func (b *backend) addPooledKey(ctx context.Context, s logical.Storage, roleName string, role *roleEntry, apiKey *packngo.APIKey) (bool, error) {
+	lock := locksutil.LockForKey(b.poolLocks, roleName)
+	lock.Lock()
+	defer lock.Unlock()
+
+	usable, err := usablePooledKeys(ctx, s, roleName, role)
+	if err != nil || usable >= role.PoolSize {
+		return false, err
+	}
+	err = writePooledKey(ctx, s, roleName, &pooledKey{
+		KeyID:     apiKey.ID,
+		Token:     apiKey.Token,
+		ReadOnly:  role.ReadOnly,
+		ProjectID: role.ProjectID,
+		CreatedAt: time.Now(),
+	})
+	return err == nil, err
+}
+
+// prunePool deletes pooled keys which can't be issued for the role anymore,
+// because they're too old or the role changed. With nil role, i.e. when the
+// role was deleted or has no pool, all pooled keys are deleted.
+func (b *backend) prunePool(ctx context.Context, s logical.Storage, roleName string, role *roleEntry) error {
+	lock := locksutil.LockForKey(b.poolLocks, roleName)
+	lock.Lock()
+	defer lock.Unlock()
+
+	keyIDs, err := s.List(ctx, poolPrefix+roleName+"/")
+	if err != nil {
+		return err
+	}
+	for _, keyID := range keyIDs {
+		k, err := readPooledKey(ctx, s, roleName, keyID)
+		if err != nil {
+			return err
+		}
+		if k != nil && role != nil && k.usable(role) {
+			continue
+		}
+		if err := b.deleteAPIKeys(ctx, s, []string{keyID}); err != nil {
+			return err
+		}
+		if err := s.Delete(ctx, poolPrefix+roleName+"/"+keyID); err != nil {
+			return err
+		}
+		b.Logger().Info("deleted stale pooled API key", "role", roleName, "key_id", keyID)
+		reason := "role has no pool"
+		if k != nil && role != nil {
+			reason = "pooled API key no longer matches the role or is too old"
+		}
+		event := &webhookEvent{Type: eventSweep, Role: roleName, KeyIDs: []string{keyID}, Reason: reason}
+		if k != nil {
+			event.ProjectID = k.ProjectID
+			event.ReadOnly = &k.ReadOnly
+		}
+		b.notify(ctx, s, event)
+	}
+	return nil
+}
+
+// maintainPools prunes and refills the pools of all roles.
+func (b *backend) maintainPools(ctx context.Context, s logical.Storage) error {
+	pools, err := s.List(ctx, poolPrefix)
+	if err != nil {
+		return err
+	}
+	roleNames, err := s.List(ctx, "role/")
+	if err != nil {
+		return err
+	}
+	policy, err := readPolicy(ctx, s)
+	if err != nil {
+		return err
+	}
+	for _, p := range pools {
+		roleName := strings.TrimSuffix(p, "/")
+		role, err := readRole(ctx, s, roleName)
+		if err != nil {
+			return err
+		}
+		if role != nil && role.PoolSize == 0 {
+			role = nil
+		}
+		if err := b.prunePool(ctx, s, roleName, role); err != nil {
+			return err
+		}
+	}
+	for _, roleName := range roleNames {
+		role, err := readRole(ctx, s, roleName)
+		if err != nil {
+			return err
+		}
+		if role == nil || role.PoolSize == 0 {
+			continue
+		}
+		if err := b.checkPolicy(ctx, s, policy, role); err != nil {
+			// Keys of the role wouldn't be issued
+			b.Logger().Warn("not refilling pool of role violating mount policy", "role", roleName, "error", err)
+			continue
+		}
+		if err := b.refillPool(ctx, s, roleName, role); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,296 @@
+package packet
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	uuid "github.com/hashicorp/go-uuid"
+	"github.com/hashicorp/vault/sdk/helper/locksutil"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	// issuedKeyPrefix is the storage prefix of records of API keys issued
+	// through a role, "issued/<role>/<key ID>". Records of keys which are
+	// being created are stored under a temporary slot ID instead.
+	issuedKeyPrefix = "issued/"
+
+	// issuanceLogPrefix is the storage prefix of per-role logs of recent
+	// issuances, used to enforce max_issuance_per_hour.
+	issuanceLogPrefix = "issuance-log/"
+
+	issuanceWindow = time.Hour
+)
+
+// slotTimeout is how long a reserved slot waits for its API key to be
+// recorded. Slots left behind by requests which never finished, e.g. because
+// Vault stopped in the middle, are expired by the periodic function after it.
+var slotTimeout = 15 * time.Minute
+
+// issuedKey is the storage record of an API key issued by the backend.
+type issuedKey struct {
+	KeyID    string    `json:"key_id"`
+	Role     string    `json:"role"`
+	IssuedAt time.Time `json:"issued_at"`
+
+	// Fingerprint, Requester and the lease TTLs in seconds granted at
+	// issuance are reported by the lookup endpoint. Records of keys issued
+	// before the lookup endpoint existed don't have them.
+	Fingerprint string     `json:"fingerprint,omitempty"`
+	Requester   *requester `json:"requester,omitempty"`
+	TTL         int64      `json:"ttl,omitempty"`
+	MaxTTL      int64      `json:"max_ttl,omitempty"`
+	// ProjectID is the project of a project key, with templates resolved.
+	// It's used to find the key in Packet when reconciling. Records of keys
+	// issued before it was recorded don't have it.
+	ProjectID string `json:"project_id,omitempty"`
+	// Batch is set for keys issued under the lease of a batch, and Claimed
+	// once such a key is taken out of the batch lease under a lease of its
+	// own. Revoking the batch lease leaves claimed keys alone.
+	Batch   bool `json:"batch,omitempty"`
+	Claimed bool `json:"claimed,omitempty"`
+	// ReservedAt is set on reserved slots only. Slots reserved before it
+	// was recorded have IssuedAt set to the time of reservation instead.
+	ReservedAt time.Time `json:"reserved_at,omitempty"`
+}
+
+// stale reports whether the record is a reserved slot older than
+// slotTimeout.
+func (k *issuedKey) stale(now time.Time) bool {
+	if k.KeyID != "" {
+		return false
+	}
+	reservedAt := k.ReservedAt
+	if reservedAt.IsZero() {
+		reservedAt = k.IssuedAt
+	}
+	return now.Sub(reservedAt) > slotTimeout
+}
+
+func readIssuedKey(ctx context.Context, s logical.Storage, roleName, keyID string) (*issuedKey, error) {
+	entry, err := s.Get(ctx, issuedKeyPrefix+roleName+"/"+keyID)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, nil
+	}
+	result := &issuedKey{}
+	if err := entry.DecodeJSON(result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func writeIssuedKey(ctx context.Context, s logical.Storage, record *issuedKey) error {
+	entry, err := logical.StorageEntryJSON(issuedKeyPrefix+record.Role+"/"+record.KeyID, record)
+	if err != nil {
+		return err
+	}
+	return s.Put(ctx, entry)
+}
+
+type issuanceLogEntry struct {
+	Slot string    `json:"slot"`
+	Time time.Time `json:"time"`
+}
+
+type issuanceLog struct {
+	Entries []issuanceLogEntry `json:"entries"`
+}
+
+// quotaError is returned when issuance would exceed a limit of the role.
+type quotaError struct {
+	msg string
+}
+
+func (e *quotaError) Error() string {
+	return e.msg
+}
+
+func readIssuanceLog(ctx context.Context, s logical.Storage, roleName string) (*issuanceLog, error) {
+	entry, err := s.Get(ctx, issuanceLogPrefix+roleName)
+	if err != nil {
+		return nil, err
+	}
+	result := &issuanceLog{}
+	if entry == nil {
+		return result, nil
+	}
+	if err := entry.DecodeJSON(result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func writeIssuanceLog(ctx context.Context, s logical.Storage, roleName string, l *issuanceLog) error {
+	entry, err := logical.StorageEntryJSON(issuanceLogPrefix+roleName, l)
+	if err != nil {
+		return err
+	}
+	return s.Put(ctx, entry)
+}
+
+// reserveIssuance checks the limits of the role and reserves count slots for
+// API keys to be created. Every slot has to be either turned into a record of
+// an issued key by recordIssuedKey, or released by releaseSlot.
+func (b *backend) reserveIssuance(ctx context.Context, s logical.Storage, roleName string, role *roleEntry, count int) ([]string, error) {
+	lock := locksutil.LockForKey(b.roleLocks, roleName)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if role.MaxActiveKeys > 0 {
+		active, err := s.List(ctx, issuedKeyPrefix+roleName+"/")
+		if err != nil {
+			return nil, err
+		}
+		if len(active)+count > role.MaxActiveKeys {
+			return nil, &quotaError{fmt.Sprintf("role %s has %d active API keys, issuing %d more would exceed max_active_keys of %d",
+				roleName, len(active), count, role.MaxActiveKeys)}
+		}
+	}
+
+	var log *issuanceLog
+	now := time.Now()
+	if role.MaxIssuancePerHour > 0 {
+		var err error
+		log, err = readIssuanceLog(ctx, s, roleName)
+		if err != nil {
+			return nil, err
+		}
+		recent := log.Entries[:0]
+		for _, e := range log.Entries {
+			if now.Sub(e.Time) < issuanceWindow {
+				recent = append(recent, e)
+			}
+		}
+		log.Entries = recent
+		if len(log.Entries)+count > role.MaxIssuancePerHour {
+			return nil, &quotaError{fmt.Sprintf("role %s issued %d API keys in the last hour, issuing %d more would exceed max_issuance_per_hour of %d",
+				roleName, len(log.Entries), count, role.MaxIssuancePerHour)}
+		}
+	}
+
+	slots := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		slot, err := uuid.GenerateUUID()
+		if err != nil {
+			return nil, err
+		}
+		entry, err := logical.StorageEntryJSON(issuedKeyPrefix+roleName+"/"+slot, issuedKey{
+			Role:       roleName,
+			IssuedAt:   now,
+			ReservedAt: now,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err := s.Put(ctx, entry); err != nil {
+			return nil, err
+		}
+		slots = append(slots, slot)
+		if log != nil {
+			log.Entries = append(log.Entries, issuanceLogEntry{Slot: slot, Time: now})
+		}
+	}
+	if log != nil {
+		if err := writeIssuanceLog(ctx, s, roleName, log); err != nil {
+			return nil, err
+		}
+	}
+	return slots, nil
+}
+
+// recordIssuedKey replaces a reserved slot by the record of the API key
+// created for it, and indexes the record by fingerprint of the token.
+func (b *backend) recordIssuedKey(ctx context.Context, s logical.Storage, slot string, record *issuedKey) error {
+	record.IssuedAt = time.Now()
+	if err := writeIssuedKey(ctx, s, record); err != nil {
+		return err
+	}
+	if err := writeFingerprintIndex(ctx, s, record); err != nil {
+		return err
+	}
+	return s.Delete(ctx, issuedKeyPrefix+record.Role+"/"+slot)
+}
+
+// releaseSlot gives back a reserved slot whose API key wasn't created, so
+// that the failed attempt doesn't count against the limits of the role.
+func (b *backend) releaseSlot(ctx context.Context, s logical.Storage, roleName, slot string) error {
+	lock := locksutil.LockForKey(b.roleLocks, roleName)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if err := s.Delete(ctx, issuedKeyPrefix+roleName+"/"+slot); err != nil {
+		return err
+	}
+	log, err := readIssuanceLog(ctx, s, roleName)
+	if err != nil {
+		return err
+	}
+	for i, e := range log.Entries {
+		if e.Slot == slot {
+			log.Entries = append(log.Entries[:i], log.Entries[i+1:]...)
+			return writeIssuanceLog(ctx, s, roleName, log)
+		}
+	}
+	return nil
+}
+
+// forgetIssuedKey removes the record of a revoked API key and its index.
+func (b *backend) forgetIssuedKey(ctx context.Context, s logical.Storage, roleName, keyID string) error {
+	record, err := readIssuedKey(ctx, s, roleName, keyID)
+	if err != nil {
+		return err
+	}
+	if record != nil && record.Fingerprint != "" {
+		if err := s.Delete(ctx, fingerprintPrefix+record.Fingerprint); err != nil {
+			return err
+		}
+	}
+	return s.Delete(ctx, issuedKeyPrefix+roleName+"/"+keyID)
+}
+
+// expireSlots deletes reserved slots older than slotTimeout, so that they
+// stop counting against max_active_keys. An API key may have been created
+// for such a slot without being recorded, reconcile reports it as unknown.
+// Issuance log entries of the slots are kept until they leave the window.
+func (b *backend) expireSlots(ctx context.Context, s logical.Storage) error {
+	roleDirs, err := s.List(ctx, issuedKeyPrefix)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, dir := range roleDirs {
+		roleName := strings.TrimSuffix(dir, "/")
+		ids, err := s.List(ctx, issuedKeyPrefix+dir)
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			if err := b.expireSlot(ctx, s, roleName, id, now); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (b *backend) expireSlot(ctx context.Context, s logical.Storage, roleName, id string, now time.Time) error {
+	lock := locksutil.LockForKey(b.roleLocks, roleName)
+	lock.Lock()
+	defer lock.Unlock()
+
+	record, err := readIssuedKey(ctx, s, roleName, id)
+	if err != nil {
+		return err
+	}
+	if record == nil || !record.stale(now) {
+		return nil
+	}
+	b.Logger().Warn("expiring reserved slot whose API key was never recorded", "role", roleName, "slot", id,
+		"reserved_at", record.IssuedAt)
+	return s.Delete(ctx, issuedKeyPrefix+roleName+"/"+id)
+}
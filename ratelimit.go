@@ -0,0 +1,178 @@
+package packet
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/packethost/packngo"
+)
+
+type callPriority int
+
+const (
+	// priorityIssue is for calls creating or looking up resources. They
+	// leave part of the quota to revocations.
+	priorityIssue callPriority = iota
+	// priorityRevoke is for calls cleaning up resources. They may use up the
+	// whole quota.
+	priorityRevoke
+)
+
+const (
+	// rateLimitReserve is the number of requests left for revocations
+	// when the quota is running out.
+	rateLimitReserve = 20
+
+	// maxRateLimitWait caps the time a call waits for the quota to reset
+	// when the request has no deadline.
+	maxRateLimitWait = time.Minute
+)
+
+// rateLimiter delays Packet API calls when the quota reported in
+// X-RateLimit-* headers is running low, so that a burst of requests doesn't
+// exhaust the quota shared with other tools using the same account.
+type rateLimiter struct {
+	mu sync.Mutex
+
+	// known is false until a response reports the rate limit, and again
+	// after the reported reset time passes.
+	known     bool
+	remaining int
+	reset     time.Time
+}
+
+func rateLimitedError(reset time.Time) error {
+	return logical.CodedError(http.StatusTooManyRequests,
+		fmt.Sprintf("Packet API rate limit is exhausted, retry after %s", reset.Format(time.RFC3339)))
+}
+
+// isRetryable reports whether err should be passed to the client as is,
+// rather than wrapped in an error response.
+func isRetryable(err error) bool {
+	_, ok := err.(logical.HTTPCodedError)
+	return ok
+}
+
+// apiErrorResponse turns the error of a failed Packet API call into an error
+// response. Retryable errors are returned as errors, so that Vault reports
+// them with their HTTP status.
+func apiErrorResponse(err error, action string) (*logical.Response, error) {
+	if isRetryable(err) {
+		return nil, err
+	}
+	return logical.ErrorResponse(fmt.Sprintf("err '%s' when attempting to %s", err, action)), nil
+}
+
+// wait blocks until a call with given priority fits into the quota. It fails
+// with a retryable error if the quota wouldn't reset before ctx is done.
+func (r *rateLimiter) wait(ctx context.Context, prio callPriority) error {
+	floor := 0
+	if prio == priorityIssue {
+		floor = rateLimitReserve
+	}
+	for {
+		r.mu.Lock()
+		if r.known && !time.Now().Before(r.reset) {
+			r.known = false
+		}
+		if !r.known || r.remaining > floor {
+			if r.known {
+				r.remaining--
+			}
+			r.mu.Unlock()
+			return nil
+		}
+		reset := r.reset
+		r.mu.Unlock()
+
+		delay := time.Until(reset)
+		deadline, ok := ctx.Deadline()
+		if (ok && deadline.Before(reset)) || (!ok && delay > maxRateLimitWait) {
+			return rateLimitedError(reset)
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return rateLimitedError(reset)
+		case <-timer.C:
+		}
+	}
+}
+
+// update records the rate-limit state reported by a response.
+func (r *rateLimiter) update(rate packngo.Rate) {
+	if rate.RequestLimit == 0 {
+		// Response didn't carry rate-limit headers
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.known = true
+	r.remaining = rate.RequestsRemaining
+	r.reset = rate.Reset.Time
+}
+
+// requestIDHeader carries the ID Packet assigns to every API request, which
+// Packet support asks for when investigating failures.
+const requestIDHeader = "X-Request-Id"
+
+// apiErrorFields returns log fields describing the failed Packet API call.
+func apiErrorFields(err error) []interface{} {
+	errResp, ok := err.(*packngo.ErrorResponse)
+	if !ok || errResp.Response == nil {
+		return nil
+	}
+	return []interface{}{
+		"status", errResp.Response.StatusCode,
+		"request_id", errResp.Response.Header.Get(requestIDHeader),
+	}
+}
+
+// apiCall runs fn with a Packet API client once the rate limit of its token
+// allows a call with given priority. fn returns the response of its call,
+// which updates the rate limit of the token. The endpoint names the packngo
+// method called by fn, e.g. "APIKeys.Create". If Packet rejects the token,
+// it's taken out of rotation and fn is retried with another token.
+func (b *backend) apiCall(ctx context.Context, s logical.Storage, prio callPriority, endpoint string, fn func(*packngo.Client) (*packngo.Response, error)) error {
+	for {
+		client, err := b.Client(ctx, s)
+		if err != nil {
+			return err
+		}
+		if err := client.limiter.wait(ctx, prio); err != nil {
+			b.Logger().Warn("Packet API call throttled", "endpoint", endpoint, "token_index", client.index, "error", err)
+			return err
+		}
+		c, err := b.tokenClient(client.token)
+		if err != nil {
+			return err
+		}
+		start := time.Now()
+		resp, err := fn(c)
+		var rate packngo.Rate
+		if resp != nil {
+			rate = resp.Rate
+		}
+		client.limiter.update(rate)
+		recordAPICall(endpoint, start, err, rate, client.fingerprint)
+		b.health.recordCall(endpoint, err)
+		if err != nil && isUnauthorized(err) && b.disableClient(client, err) {
+			continue
+		}
+		if err != nil {
+			fields := append([]interface{}{"endpoint", endpoint, "error", err}, apiErrorFields(err)...)
+			if isNotFound(err) {
+				// Often expected, e.g. when revoking a key deleted in Packet
+				b.Logger().Debug("Packet API call failed", fields...)
+			} else {
+				b.Logger().Warn("Packet API call failed", fields...)
+			}
+		}
+		return err
+	}
+}
@@ -0,0 +1,211 @@
+package packet
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	// revocationsPrefix is the storage prefix of both lists below.
+	revocationsPrefix = "revocations/"
+
+	// revocationPendingPrefix is the storage prefix of API keys whose
+	// deletion failed and is retried by the periodic function,
+	// "revocations/pending/<key ID>".
+	revocationPendingPrefix = revocationsPrefix + "pending/"
+
+	// revocationFailedPrefix is the storage prefix of API keys whose
+	// deletion failed maxRevocationAttempts times and isn't retried
+	// anymore, "revocations/failed/<key ID>". They're retried or
+	// acknowledged manually.
+	revocationFailedPrefix = revocationsPrefix + "failed/"
+
+	maxRevocationAttempts = 8
+)
+
+// revocationBackoff is the delay before the first retry of a failed
+// revocation. It doubles with every attempt up to revocationMaxBackoff.
+var (
+	revocationBackoff    = time.Minute
+	revocationMaxBackoff = time.Hour
+)
+
+// failedRevocation is the storage record of an API key whose deletion
+// failed.
+type failedRevocation struct {
+	KeyID         string    `json:"key_id"`
+	Role          string    `json:"role"`
+	Attempts      int       `json:"attempts"`
+	LastError     string    `json:"last_error"`
+	FirstFailedAt time.Time `json:"first_failed_at"`
+	LastAttemptAt time.Time `json:"last_attempt_at"`
+	NextAttemptAt time.Time `json:"next_attempt_at,omitempty"`
+}
+
+func readFailedRevocation(ctx context.Context, s logical.Storage, prefix, keyID string) (*failedRevocation, error) {
+	entry, err := s.Get(ctx, prefix+keyID)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, nil
+	}
+	result := &failedRevocation{}
+	if err := entry.DecodeJSON(result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func writeFailedRevocation(ctx context.Context, s logical.Storage, prefix string, r *failedRevocation) error {
+	entry, err := logical.StorageEntryJSON(prefix+r.KeyID, r)
+	if err != nil {
+		return err
+	}
+	return s.Put(ctx, entry)
+}
+
+// queueRevocations records a failed attempt to delete API keys of a role.
+// Keys are retried with exponential backoff, and moved to the dead-letter
+// list after maxRevocationAttempts attempts. Failures of keys queued and not
+// due yet, i.e. of Vault retrying the revocation of their lease on its own
+// schedule, don't count as attempts.
+func (b *backend) queueRevocations(ctx context.Context, s logical.Storage, roleName string, keyIDs []string, cause error) error {
+	b.revocationLock.Lock()
+	defer b.revocationLock.Unlock()
+
+	now := time.Now()
+	for _, keyID := range keyIDs {
+		r, err := readFailedRevocation(ctx, s, revocationPendingPrefix, keyID)
+		if err != nil {
+			return err
+		}
+		if r == nil {
+			if r, err = readFailedRevocation(ctx, s, revocationFailedPrefix, keyID); err != nil {
+				return err
+			}
+			if r != nil {
+				// Already given up on, e.g. Vault retried the lease
+				r.LastError = cause.Error()
+				r.LastAttemptAt = now
+				if err := writeFailedRevocation(ctx, s, revocationFailedPrefix, r); err != nil {
+					return err
+				}
+				continue
+			}
+			r = &failedRevocation{KeyID: keyID, Role: roleName, FirstFailedAt: now}
+		} else if now.Before(r.NextAttemptAt) {
+			r.LastError = cause.Error()
+			r.LastAttemptAt = now
+			if err := writeFailedRevocation(ctx, s, revocationPendingPrefix, r); err != nil {
+				return err
+			}
+			continue
+		}
+		r.Attempts++
+		r.LastError = cause.Error()
+		r.LastAttemptAt = now
+
+		if r.Attempts >= maxRevocationAttempts {
+			r.NextAttemptAt = time.Time{}
+			if err := writeFailedRevocation(ctx, s, revocationFailedPrefix, r); err != nil {
+				return err
+			}
+			if err := s.Delete(ctx, revocationPendingPrefix+keyID); err != nil {
+				return err
+			}
+			b.Logger().Error("giving up revoking API key", "role", roleName, "key_id", keyID,
+				"attempts", r.Attempts, "error", cause)
+			continue
+		}
+
+		backoff := revocationBackoff << uint(r.Attempts-1)
+		if backoff > revocationMaxBackoff || backoff <= 0 {
+			backoff = revocationMaxBackoff
+		}
+		r.NextAttemptAt = now.Add(backoff)
+		if err := writeFailedRevocation(ctx, s, revocationPendingPrefix, r); err != nil {
+			return err
+		}
+		b.Logger().Debug("queued API key for revocation retry", "role", roleName, "key_id", keyID,
+			"attempts", r.Attempts, "next_attempt", r.NextAttemptAt)
+	}
+	return nil
+}
+
+// dequeueRevocations removes deleted API keys from the retry queue and the
+// dead-letter list.
+func (b *backend) dequeueRevocations(ctx context.Context, s logical.Storage, keyIDs []string) error {
+	b.revocationLock.Lock()
+	defer b.revocationLock.Unlock()
+
+	for _, keyID := range keyIDs {
+		if err := s.Delete(ctx, revocationPendingPrefix+keyID); err != nil {
+			return err
+		}
+		if err := s.Delete(ctx, revocationFailedPrefix+keyID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// retryRevocations retries deletion of queued API keys which are due. Keys
+// failing again are requeued by revokeAPIKeys, so only storage errors are
+// returned.
+func (b *backend) retryRevocations(ctx context.Context, s logical.Storage) error {
+	keyIDs, err := s.List(ctx, revocationPendingPrefix)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, keyID := range keyIDs {
+		r, err := readFailedRevocation(ctx, s, revocationPendingPrefix, keyID)
+		if err != nil {
+			return err
+		}
+		if r == nil || now.Before(r.NextAttemptAt) {
+			continue
+		}
+		event := b.queuedRevocationEvent(ctx, s, r)
+		err = b.revokeAPIKeys(ctx, s, r.Role, []string{keyID})
+		recordRevocation(r.Role, b.roleScope(ctx, s, r.Role), 1, err)
+		if err == nil {
+			b.Logger().Info("revoked queued API key", "role", r.Role, "key_id", keyID, "attempts", r.Attempts+1)
+			b.notify(ctx, s, event)
+		}
+	}
+	return nil
+}
+
+// queuedRevocationEvent returns the revoke event of a queued API key, with
+// the requester it was issued to.
+func (b *backend) queuedRevocationEvent(ctx context.Context, s logical.Storage, r *failedRevocation) *webhookEvent {
+	event := &webhookEvent{
+		Type:   eventRevoke,
+		Role:   r.Role,
+		KeyIDs: []string{r.KeyID},
+		Reason: fmt.Sprintf("revocation retried after %d failed attempts", r.Attempts),
+	}
+	if record, err := readIssuedKey(ctx, s, r.Role, r.KeyID); err == nil && record != nil {
+		event.ProjectID = record.ProjectID
+		if record.Requester != nil {
+			event.EntityID = record.Requester.EntityID
+			event.DisplayName = record.Requester.DisplayName
+		}
+	}
+	return event
+}
+
+// roleScope returns the type of a role for labeling metrics, empty if the
+// role doesn't exist anymore.
+func (b *backend) roleScope(ctx context.Context, s logical.Storage, roleName string) string {
+	role, err := readRole(ctx, s, roleName)
+	if err != nil || role == nil {
+		return ""
+	}
+	return role.Type
+}
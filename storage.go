@@ -0,0 +1,156 @@
+package packet
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// Storage schema versions. Version 1 is the layout from before versioning,
+// when role durations were stored as nanoseconds and entries didn't record
+// their version. Version 2 stores durations as seconds, and every role and
+// config entry records the version it was written with.
+const (
+	roleVersion   = 2
+	configVersion = 2
+
+	// storageVersionKey holds the schema version of the whole mount, so that
+	// the migration doesn't scan all roles once they're upgraded.
+	storageVersionKey = "storage-version"
+	storageVersion    = 2
+)
+
+type storageVersionEntry struct {
+	Version int `json:"version"`
+}
+
+// roleEntryAlias has the fields of roleEntry without its JSON methods.
+type roleEntryAlias roleEntry
+
+// storedRoleEntry is the stored form of roleEntry. Durations shadow the
+// time.Duration fields of the role, so that they're stored as seconds.
+type storedRoleEntry struct {
+	*roleEntryAlias
+	TTL           int64 `json:"ttl"`
+	MaxTTL        int64 `json:"max_ttl"`
+	PoolMaxAge    int64 `json:"pool_max_age"`
+	VerifyTimeout int64 `json:"verify_timeout"`
+}
+
+func (r *roleEntry) MarshalJSON() ([]byte, error) {
+	return json.Marshal(storedRoleEntry{
+		roleEntryAlias: (*roleEntryAlias)(r),
+		TTL:            int64(r.TTL / time.Second),
+		MaxTTL:         int64(r.MaxTTL / time.Second),
+		PoolMaxAge:     int64(r.PoolMaxAge / time.Second),
+		VerifyTimeout:  int64(r.VerifyTimeout / time.Second),
+	})
+}
+
+func (r *roleEntry) UnmarshalJSON(data []byte) error {
+	stored := storedRoleEntry{roleEntryAlias: (*roleEntryAlias)(r)}
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return err
+	}
+	unit := time.Second
+	if r.Version < 2 {
+		unit = time.Nanosecond
+	}
+	r.TTL = time.Duration(stored.TTL) * unit
+	r.MaxTTL = time.Duration(stored.MaxTTL) * unit
+	r.PoolMaxAge = time.Duration(stored.PoolMaxAge) * unit
+	r.VerifyTimeout = time.Duration(stored.VerifyTimeout) * unit
+	return nil
+}
+
+func writeRole(ctx context.Context, s logical.Storage, roleName string, role *roleEntry) error {
+	role.Version = roleVersion
+	entry, err := logical.StorageEntryJSON("role/"+roleName, role)
+	if err != nil {
+		return err
+	}
+	return s.Put(ctx, entry)
+}
+
+func readConfig(ctx context.Context, s logical.Storage) (*packetSecretsEngineConfig, error) {
+	entry, err := s.Get(ctx, "config")
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, nil
+	}
+	result := &packetSecretsEngineConfig{}
+	if err := entry.DecodeJSON(result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func writeConfig(ctx context.Context, s logical.Storage, conf *packetSecretsEngineConfig) error {
+	conf.Version = configVersion
+	entry, err := logical.StorageEntryJSON("config", conf)
+	if err != nil {
+		return err
+	}
+	return s.Put(ctx, entry)
+}
+
+// migrateStorage upgrades config and role entries written by older versions
+// of the plugin to the current schema. Entries are rewritten one by one and
+// the mount version is recorded last, so an interrupted migration is resumed
+// on the next start.
+func (b *backend) migrateStorage(ctx context.Context, s logical.Storage) error {
+	entry, err := s.Get(ctx, storageVersionKey)
+	if err != nil {
+		return err
+	}
+	var current storageVersionEntry
+	if entry != nil {
+		if err := entry.DecodeJSON(&current); err != nil {
+			return err
+		}
+	}
+	if current.Version >= storageVersion {
+		return nil
+	}
+
+	conf, err := readConfig(ctx, s)
+	if err != nil {
+		return err
+	}
+	if conf != nil && conf.Version < configVersion {
+		from := conf.Version
+		if err := writeConfig(ctx, s, conf); err != nil {
+			return err
+		}
+		b.Logger().Info("migrated config", "from_version", from, "to_version", configVersion)
+	}
+
+	roleNames, err := s.List(ctx, "role/")
+	if err != nil {
+		return err
+	}
+	for _, roleName := range roleNames {
+		role, err := readRole(ctx, s, roleName)
+		if err != nil {
+			return err
+		}
+		if role == nil || role.Version >= roleVersion {
+			continue
+		}
+		from := role.Version
+		if err := writeRole(ctx, s, roleName, role); err != nil {
+			return err
+		}
+		b.Logger().Info("migrated role", "role", roleName, "from_version", from, "to_version", roleVersion)
+	}
+
+	entry, err = logical.StorageEntryJSON(storageVersionKey, storageVersionEntry{Version: storageVersion})
+	if err != nil {
+		return err
+	}
+	return s.Put(ctx, entry)
+}
@@ -0,0 +1,78 @@
+package packet
+
+import (
+	"time"
+
+	metrics "github.com/armon/go-metrics"
+	"github.com/packethost/packngo"
+)
+
+// Metrics are emitted through the global go-metrics sink. Vault sets it up
+// for builtin plugins, the plugin binary sets it up from its environment.
+var (
+	// metricKeysIssued, metricKeysRevoked and metricKeysFailed count API
+	// keys by role and scope, i.e. user or project.
+	metricKeysIssued  = []string{"packet", "keys", "issued"}
+	metricKeysRevoked = []string{"packet", "keys", "revoked"}
+	metricKeysFailed  = []string{"packet", "keys", "failed"}
+
+	// metricAPICall measures the latency of Packet API calls by endpoint.
+	metricAPICall = []string{"packet", "api", "call"}
+
+	// metricRateLimitRemaining is the remaining Packet API quota.
+	metricRateLimitRemaining = []string{"packet", "api", "rate_limit_remaining"}
+)
+
+func keyLabels(roleName, scope string) []metrics.Label {
+	if scope == "" {
+		// Lease issued before the scope was recorded
+		scope = "unknown"
+	}
+	return []metrics.Label{
+		{Name: "role", Value: roleName},
+		{Name: "scope", Value: scope},
+	}
+}
+
+// recordIssuance counts count API keys issued through a role, or failed to be
+// issued if err isn't nil. Refusals over role limits aren't failures.
+func recordIssuance(roleName, scope string, count int, err error) {
+	if _, ok := err.(*quotaError); ok {
+		return
+	}
+	name := metricKeysIssued
+	if err != nil {
+		name = metricKeysFailed
+	}
+	metrics.IncrCounterWithLabels(name, float32(count), append(keyLabels(roleName, scope),
+		metrics.Label{Name: "operation", Value: "issue"}))
+}
+
+// recordRevocation counts count API keys revoked, or failed to be revoked if
+// err isn't nil.
+func recordRevocation(roleName, scope string, count int, err error) {
+	name := metricKeysRevoked
+	if err != nil {
+		name = metricKeysFailed
+	}
+	metrics.IncrCounterWithLabels(name, float32(count), append(keyLabels(roleName, scope),
+		metrics.Label{Name: "operation", Value: "revoke"}))
+}
+
+// recordAPICall measures a Packet API call which started at start, and the
+// quota reported by its response for the token with given fingerprint.
+func recordAPICall(endpoint string, start time.Time, err error, rate packngo.Rate, tokenFingerprint string) {
+	status := "ok"
+	if err != nil {
+		status = "error"
+	}
+	metrics.MeasureSinceWithLabels(metricAPICall, start, []metrics.Label{
+		{Name: "endpoint", Value: endpoint},
+		{Name: "status", Value: status},
+	})
+	if rate.RequestLimit != 0 {
+		metrics.SetGaugeWithLabels(metricRateLimitRemaining, float32(rate.RequestsRemaining), []metrics.Label{
+			{Name: "token_fingerprint", Value: tokenFingerprint},
+		})
+	}
+}
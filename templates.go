@@ -0,0 +1,56 @@
+package packet
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/vault/sdk/framework"
+)
+
+// isTemplated reports whether a role parameter uses identity templating,
+// e.g. {{identity.entity.metadata.packet_project}}. Malformed templates are
+// an error.
+func isTemplated(value string) (bool, error) {
+	return framework.ValidateIdentityTemplate(value)
+}
+
+// templated reports whether any identity-templated parameter of the role
+// needs resolving at issuance.
+func (r *roleEntry) templated() bool {
+	projectTemplated, _ := isTemplated(r.ProjectID)
+	descTemplated, _ := isTemplated(r.Description)
+	return projectTemplated || descTemplated
+}
+
+// resolveTemplates returns a copy of the role with identity templates in
+// project_id and description resolved for the requesting entity. It fails
+// closed: without an entity, or with a template which doesn't resolve to a
+// valid value, no credentials are issued.
+func (b *backend) resolveTemplates(role *roleEntry, entityID string) (*roleEntry, error) {
+	if !role.templated() {
+		return role, nil
+	}
+	if entityID == "" {
+		return nil, fmt.Errorf("role parameters use identity templates, but the request has no entity")
+	}
+	resolved := *role
+	var err error
+	if ok, _ := isTemplated(role.ProjectID); ok {
+		if resolved.ProjectID, err = b.resolveTemplate(role.ProjectID, entityID); err != nil {
+			return nil, fmt.Errorf("failed to resolve project_id template: %v", err)
+		}
+		if !IsValidUUID(resolved.ProjectID) {
+			return nil, fmt.Errorf("project_id template resolved to %q, which isn't a valid Packet API project ID", resolved.ProjectID)
+		}
+	}
+	if resolved.Description, err = b.resolveTemplate(role.Description, entityID); err != nil {
+		return nil, fmt.Errorf("failed to resolve description template: %v", err)
+	}
+	return &resolved, nil
+}
+
+func (b *backend) resolveTemplate(value, entityID string) (string, error) {
+	if ok, _ := isTemplated(value); !ok {
+		return value, nil
+	}
+	return framework.PopulateIdentityTemplate(value, entityID, b.system)
+}
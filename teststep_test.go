@@ -1,10 +1,20 @@
 package packet
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	metrics "github.com/armon/go-metrics"
+	"github.com/hashicorp/vault/sdk/helper/consts"
+	"github.com/hashicorp/vault/sdk/helper/strutil"
 	"github.com/hashicorp/vault/sdk/logical"
 	"github.com/packethost/packngo"
 )
@@ -125,7 +135,7 @@ func (e *testEnv) RevokeCreds(t *testing.T) {
 
 func (e *testEnv) CreatePacketProject(t *testing.T) {
 	pcr := packngo.ProjectCreateRequest{Name: "Vault-testing-project"}
-	c := packngo.NewClientWithAuth("Hashicorp Vault Test", e.APIToken, nil)
+	c := e.packetClient()
 	p, _, err := c.Projects.Create(&pcr)
 	if err != nil {
 		t.Fatal(err)
@@ -134,19 +144,25 @@ func (e *testEnv) CreatePacketProject(t *testing.T) {
 }
 
 func (e *testEnv) RemovePacketProject(t *testing.T) {
-	c := packngo.NewClientWithAuth("Hashicorp Vault Test", e.APIToken, nil)
+	c := e.packetClient()
 	_, err := c.Projects.Delete(e.TestProjectID)
 	if err != nil {
 		t.Fatal(err)
 	}
 }
 
-func GetPacketProjectAPIKey(projectID, keyID string) (*packngo.APIKey, error) {
-	c, err := packngo.NewClient()
-	if err != nil {
-		return nil, err
+// packetClient returns a client of the Packet API the backend talks to, for
+// preparing and checking state outside of the backend.
+func (e *testEnv) packetClient() *packngo.Client {
+	if e.Mock != nil {
+		c, _ := packngo.NewClientWithBaseURL("Hashicorp Vault Test", e.APIToken, nil, e.Mock.URL)
+		return c
 	}
-	return c.APIKeys.ProjectGet(projectID, keyID, nil)
+	return packngo.NewClientWithAuth("Hashicorp Vault Test", e.APIToken, nil)
+}
+
+func (e *testEnv) GetPacketProjectAPIKey(projectID, keyID string) (*packngo.APIKey, error) {
+	return e.packetClient().APIKeys.ProjectGet(projectID, keyID, nil)
 }
 
 func (e *testEnv) AddProjectRole(t *testing.T) {
@@ -196,7 +212,7 @@ func (e *testEnv) ReadProjectCreds(t *testing.T) {
 	}
 	keyID := resp.Secret.InternalData["api_key_id"].(string)
 
-	apiKey, err := GetPacketProjectAPIKey(e.TestProjectID, keyID)
+	apiKey, err := e.GetPacketProjectAPIKey(e.TestProjectID, keyID)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -235,19 +251,22 @@ func (e *testEnv) AddUserRole(t *testing.T) {
 	}
 }
 
-func GetPacketUserAPIKey(id string) (*packngo.APIKey, error) {
-	c, err := packngo.NewClient()
-	if err != nil {
-		return nil, err
-	}
-	return c.APIKeys.UserGet(id, nil)
+func (e *testEnv) GetPacketUserAPIKey(id string) (*packngo.APIKey, error) {
+	return e.packetClient().APIKeys.UserGet(id, nil)
 }
 
+const (
+	testEntityID    = "6f2c1a2e-5a0e-4b8e-9d6b-1c2a3b4c5d6e"
+	testDisplayName = "token-ci"
+)
+
 func (e *testEnv) ReadUserCreds(t *testing.T) {
 	req := &logical.Request{
-		Operation: logical.ReadOperation,
-		Path:      fmt.Sprintf("creds/%s", e.RoleName),
-		Storage:   e.Storage,
+		Operation:   logical.ReadOperation,
+		Path:        fmt.Sprintf("creds/%s", e.RoleName),
+		Storage:     e.Storage,
+		EntityID:    testEntityID,
+		DisplayName: testDisplayName,
 	}
 	resp, err := e.Backend.HandleRequest(e.Context, req)
 	if err != nil || (resp != nil && resp.IsError()) {
@@ -264,8 +283,14 @@ func (e *testEnv) ReadUserCreds(t *testing.T) {
 		t.Fatal("failed to receive api_key_id")
 	}
 	keyID := resp.Secret.InternalData["api_key_id"].(string)
+	if resp.Data["api_key_id"] != keyID {
+		t.Fatal("api_key_id should be returned with the token")
+	}
+	if resp.Data["api_key_fingerprint"] != fingerprint(resp.Data["api_key_token"].(string)) {
+		t.Fatal("api_key_fingerprint should be returned with the token")
+	}
 
-	apiKey, err := GetPacketUserAPIKey(keyID)
+	apiKey, err := e.GetPacketUserAPIKey(keyID)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -281,4 +306,2430 @@ func (e *testEnv) ReadUserCreds(t *testing.T) {
 	}
 
 	e.MostRecentSecret = resp.Secret
+	e.IssuedSecrets = append(e.IssuedSecrets, resp.Secret)
+	e.IssuedTokens = append(e.IssuedTokens, apiKey.Token)
+}
+
+func (e *testEnv) LockPacketDevice(t *testing.T) {
+	c := e.packetClient()
+	_, err := c.Devices.Lock(e.TestDeviceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (e *testEnv) CheckPacketDeviceLocked(t *testing.T) {
+	c := e.packetClient()
+	d, _, err := c.Devices.Get(e.TestDeviceID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !d.Locked {
+		t.Fatal("Device should be locked after revocation")
+	}
+}
+
+func (e *testEnv) AddPacketDevice(t *testing.T) {
+	e.TestDeviceID = e.Mock.AddDevice("", false).ID
+}
+
+func (e *testEnv) CheckPacketDeviceUnlocked(t *testing.T) {
+	c := e.packetClient()
+	d, _, err := c.Devices.Get(e.TestDeviceID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Locked {
+		t.Fatal("Device should stay unlocked")
+	}
+}
+
+func (e *testEnv) AddDeviceUnlockRole(t *testing.T) {
+	if e.TestDeviceID == "" {
+		t.Fatal("You must supply a testing device before testing device-unlock role")
+	}
+	req := &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      fmt.Sprintf("role/%s", e.RoleName),
+		Storage:   e.Storage,
+		Data: map[string]interface{}{
+			"type":               "device-unlock",
+			"allowed_device_ids": e.TestDeviceID,
+			"ttl":                20,
+			"max_ttl":            60,
+		},
+	}
+	resp, err := e.Backend.HandleRequest(e.Context, req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("bad: resp: %#v\nerr:%v", resp, err)
+	}
+	if resp != nil {
+		t.Fatal("expected nil response to represent a 204")
+	}
+}
+
+func (e *testEnv) ReadDeviceUnlockCreds(t *testing.T) {
+	req := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      fmt.Sprintf("creds/%s", e.RoleName),
+		Storage:   e.Storage,
+		Data: map[string]interface{}{
+			"device_id": e.TestDeviceID,
+		},
+	}
+	resp, err := e.Backend.HandleRequest(e.Context, req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("bad: resp: %#v\nerr:%v", resp, err)
+	}
+	if resp == nil {
+		t.Fatal("expected a response")
+	}
+	if resp.Secret.InternalData["device_id"] != e.TestDeviceID {
+		t.Fatal("failed to receive device_id")
+	}
+
+	c := e.packetClient()
+	d, _, err := c.Devices.Get(e.TestDeviceID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Locked {
+		t.Fatal("Device should be unlocked")
+	}
+
+	e.MostRecentSecret = resp.Secret
+}
+
+// ReadDeviceUnlockCredsUpstreamFailure fails unlocking of the device in
+// Packet, which must leave both the device and its record of leases as they
+// were.
+func (e *testEnv) ReadDeviceUnlockCredsUpstreamFailure(t *testing.T) {
+	before, err := readDeviceUnlock(e.Context, e.Storage, e.TestDeviceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	locked := e.Mock.DeviceLocked(e.TestDeviceID)
+	patches := e.Mock.CallCount("PATCH", "/devices/"+e.TestDeviceID)
+	e.Mock.FailNext("PATCH", "/devices/"+e.TestDeviceID, http.StatusUnprocessableEntity, 1)
+
+	req := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      fmt.Sprintf("creds/%s", e.RoleName),
+		Storage:   e.Storage,
+		Data: map[string]interface{}{
+			"device_id": e.TestDeviceID,
+		},
+	}
+	resp, err := e.Backend.HandleRequest(e.Context, req)
+	if err == nil && (resp == nil || !resp.IsError()) {
+		t.Fatal("expected unlocking to fail")
+	}
+	if n := e.Mock.CallCount("PATCH", "/devices/"+e.TestDeviceID) - patches; n != 1 {
+		t.Fatalf("expected only the failed unlock call, got %d updates of the device", n)
+	}
+	if e.Mock.DeviceLocked(e.TestDeviceID) != locked {
+		t.Fatal("failed unlock shouldn't change the lock of the device")
+	}
+	after, err := readDeviceUnlock(e.Context, e.Storage, e.TestDeviceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(before, after) {
+		t.Fatalf("failed unlock shouldn't leave a lease behind, record was %v, is %v", before, after)
+	}
+}
+
+func (e *testEnv) ReadOverlappingDeviceUnlockCreds(t *testing.T) {
+	e.EarlierSecret = e.MostRecentSecret
+	e.ReadDeviceUnlockCreds(t)
+}
+
+func (e *testEnv) RevokeEarlierCreds(t *testing.T) {
+	req := &logical.Request{
+		Operation: logical.RevokeOperation,
+		Storage:   e.Storage,
+		Secret:    e.EarlierSecret,
+	}
+	resp, err := e.Backend.HandleRequest(e.Context, req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("bad: resp: %#v\nerr:%v", resp, err)
+	}
+}
+
+func (e *testEnv) AddReservationRole(t *testing.T) {
+	if e.TestProjectID == "" || e.TestPoolProjectID == "" {
+		t.Fatal("You must create a testing project and supply a pool project before testing hardware-reservation role")
+	}
+	req := &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      fmt.Sprintf("role/%s", e.RoleName),
+		Storage:   e.Storage,
+		Data: map[string]interface{}{
+			"type":            "hardware-reservation",
+			"project_id":      e.TestProjectID,
+			"pool_project_id": e.TestPoolProjectID,
+			"delete_devices":  true,
+			"ttl":             20,
+			"max_ttl":         60,
+		},
+	}
+	resp, err := e.Backend.HandleRequest(e.Context, req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("bad: resp: %#v\nerr:%v", resp, err)
+	}
+	if resp != nil {
+		t.Fatal("expected nil response to represent a 204")
+	}
+}
+
+func (e *testEnv) ReadReservationCreds(t *testing.T) {
+	req := &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      fmt.Sprintf("creds/%s", e.RoleName),
+		Storage:   e.Storage,
+	}
+	resp, err := e.Backend.HandleRequest(e.Context, req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("bad: resp: %#v\nerr:%v", resp, err)
+	}
+	if resp == nil {
+		t.Fatal("expected a response")
+	}
+	reservationID, _ := resp.Data["reservation_id"].(string)
+	if reservationID == "" {
+		t.Fatal("failed to receive reservation_id")
+	}
+
+	c := e.packetClient()
+	r, _, err := c.HardwareReservations.Get(reservationID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Project.ID != e.TestProjectID {
+		t.Fatal("Hardware reservation should be moved to the testing project")
+	}
+
+	e.MostRecentSecret = resp.Secret
+}
+
+func (e *testEnv) AddPacketReservation(t *testing.T) {
+	pcr := packngo.ProjectCreateRequest{Name: "Vault-testing-pool-project"}
+	p, _, err := e.packetClient().Projects.Create(&pcr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.TestPoolProjectID = p.ID
+	e.Mock.AddReservation(p.ID)
+}
+
+func (e *testEnv) ReadReservationCredsConcurrently(t *testing.T) {
+	// Let both requests list the pool before either moves the reservation
+	e.Mock.SetLatency(50 * time.Millisecond)
+	defer e.Mock.SetLatency(0)
+
+	const requests = 2
+	var wg sync.WaitGroup
+	secrets := make(chan *logical.Secret, requests)
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := &logical.Request{
+				Operation: logical.ReadOperation,
+				Path:      fmt.Sprintf("creds/%s", e.RoleName),
+				Storage:   e.Storage,
+			}
+			resp, err := e.Backend.HandleRequest(e.Context, req)
+			if err == nil && resp != nil && !resp.IsError() {
+				secrets <- resp.Secret
+			}
+		}()
+	}
+	wg.Wait()
+	close(secrets)
+
+	if len(secrets) != 1 {
+		t.Fatalf("expected 1 successful loan of the only reservation, got %d", len(secrets))
+	}
+	e.MostRecentSecret = <-secrets
+}
+
+func (e *testEnv) ReadReservationCredsStaleList(t *testing.T) {
+	// Packet still lists the loaned reservation in the pool project
+	e.Mock.SetStaleReservations(true)
+	defer e.Mock.SetStaleReservations(false)
+
+	reservationID := e.MostRecentSecret.InternalData["reservation_id"].(string)
+	moves := e.Mock.CallCount("POST", "/hardware-reservations/"+reservationID+"/move")
+	req := &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      fmt.Sprintf("creds/%s", e.RoleName),
+		Storage:   e.Storage,
+	}
+	resp, err := e.Backend.HandleRequest(e.Context, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp == nil || !resp.IsError() {
+		t.Fatalf("expected loaned reservation to be refused, got: %#v", resp)
+	}
+	if n := e.Mock.CallCount("POST", "/hardware-reservations/"+reservationID+"/move"); n != moves {
+		t.Fatalf("expected loaned reservation not to be moved, got %d moves", n-moves)
+	}
+	if p := e.Mock.ReservationProjectID(reservationID); p != e.TestProjectID {
+		t.Fatalf("expected reservation to stay in the testing project, got %s", p)
+	}
+}
+
+func (e *testEnv) CheckReservationReturned(t *testing.T) {
+	reservationID := e.MostRecentSecret.InternalData["reservation_id"].(string)
+	if p := e.Mock.ReservationProjectID(reservationID); p != e.TestPoolProjectID {
+		t.Fatalf("expected reservation to be back in the pool project, got %s", p)
+	}
+	loans, err := e.Storage.List(e.Context, reservationLoanPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loans) != 0 {
+		t.Fatalf("expected no recorded loans, got %v", loans)
+	}
+}
+
+func (e *testEnv) AddSpotMarketRole(t *testing.T) {
+	if e.TestProjectID == "" {
+		t.Fatal("You must create a testing project before testing spot-market-request role")
+	}
+	req := &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      fmt.Sprintf("role/%s", e.RoleName),
+		Storage:   e.Storage,
+		Data: map[string]interface{}{
+			"type":               "spot-market-request",
+			"project_id":         e.TestProjectID,
+			"max_bid_price":      "0.05",
+			"max_devices":        1,
+			"allowed_plans":      e.TestSpotPlan,
+			"allowed_facilities": e.TestSpotFacility,
+			"ttl":                20,
+			"max_ttl":            60,
+		},
+	}
+	resp, err := e.Backend.HandleRequest(e.Context, req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("bad: resp: %#v\nerr:%v", resp, err)
+	}
+	if resp != nil {
+		t.Fatal("expected nil response to represent a 204")
+	}
+}
+
+func (e *testEnv) readSpotMarketCreds(data map[string]interface{}) (*logical.Response, error) {
+	data["operating_system"] = "ubuntu_18_04"
+	req := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      fmt.Sprintf("creds/%s", e.RoleName),
+		Storage:   e.Storage,
+		Data:      data,
+	}
+	return e.Backend.HandleRequest(e.Context, req)
+}
+
+// checkSpotMarketCredsRefused checks that reading spot-market-request creds
+// with given parameters fails without a request to Packet.
+func (e *testEnv) checkSpotMarketCredsRefused(t *testing.T, data map[string]interface{}) {
+	resp, err := e.readSpotMarketCreds(data)
+	if err != nil {
+		t.Fatalf("bad: resp: %#v\nerr:%v", resp, err)
+	}
+	if resp == nil || !resp.IsError() {
+		t.Fatalf("expected an error response for %v", data)
+	}
+	if e.Mock != nil {
+		if n := e.Mock.CallCount("POST", "/projects/"+e.TestProjectID+"/spot-market-requests"); n != 0 {
+			t.Fatalf("expected no spot market request sent to Packet, got %d", n)
+		}
+	}
+}
+
+func (e *testEnv) ReadSpotMarketCredsOverBid(t *testing.T) {
+	e.checkSpotMarketCredsRefused(t, map[string]interface{}{"max_bid_price": "1.00"})
+}
+
+func (e *testEnv) ReadSpotMarketCredsBadBid(t *testing.T) {
+	for _, bid := range []string{"NaN", "Inf", "-Inf", "0", "-0.01"} {
+		e.checkSpotMarketCredsRefused(t, map[string]interface{}{"max_bid_price": bid})
+	}
+}
+
+func (e *testEnv) ReadSpotMarketCredsOverDevices(t *testing.T) {
+	for _, devices := range []map[string]interface{}{
+		{"devices_max": 2},
+		{"devices_min": 2},
+		{"devices_min": 2, "devices_max": 1},
+		{"devices_min": -1},
+	} {
+		e.checkSpotMarketCredsRefused(t, devices)
+	}
+}
+
+func (e *testEnv) AddSpotMarketRoleBadBid(t *testing.T) {
+	for _, bid := range []string{"NaN", "Inf", "-1"} {
+		req := &logical.Request{
+			Operation: logical.CreateOperation,
+			Path:      fmt.Sprintf("role/%s-badbid", e.RoleName),
+			Storage:   e.Storage,
+			Data: map[string]interface{}{
+				"type":               "spot-market-request",
+				"project_id":         e.TestProjectID,
+				"max_bid_price":      bid,
+				"max_devices":        1,
+				"allowed_plans":      e.TestSpotPlan,
+				"allowed_facilities": e.TestSpotFacility,
+			},
+		}
+		_, err := e.Backend.HandleRequest(e.Context, req)
+		if err == nil {
+			t.Fatalf("expected an error for max_bid_price %s", bid)
+		}
+	}
+}
+
+func (e *testEnv) ReadSpotMarketCreds(t *testing.T) {
+	req := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      fmt.Sprintf("creds/%s", e.RoleName),
+		Storage:   e.Storage,
+		Data: map[string]interface{}{
+			"operating_system": "ubuntu_18_04",
+		},
+	}
+	resp, err := e.Backend.HandleRequest(e.Context, req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("bad: resp: %#v\nerr:%v", resp, err)
+	}
+	if resp == nil {
+		t.Fatal("expected a response")
+	}
+	if resp.Secret.InternalData["spot_market_request_id"] == "" {
+		t.Fatal("failed to receive spot_market_request_id")
+	}
+
+	e.MostRecentSecret = resp.Secret
+}
+
+func (e *testEnv) ReadVPNCreds(t *testing.T) {
+	req := &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      fmt.Sprintf("vpn/%s", e.TestVPNFacility),
+		Storage:   e.Storage,
+	}
+	resp, err := e.Backend.HandleRequest(e.Context, req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("bad: resp: %#v\nerr:%v", resp, err)
+	}
+	if resp == nil {
+		t.Fatal("expected a response")
+	}
+	if resp.Data["config"] == "" {
+		t.Fatal("failed to receive VPN config")
+	}
+
+	e.MostRecentSecret = resp.Secret
+}
+
+func (e *testEnv) ReadUserCredsRateLimited(t *testing.T) {
+	e.Mock.FailNext("POST", "/user/api-keys", http.StatusTooManyRequests, 1)
+	e.Mock.SetLatency(50 * time.Millisecond)
+	defer e.Mock.SetLatency(0)
+
+	req := &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      fmt.Sprintf("creds/%s", e.RoleName),
+		Storage:   e.Storage,
+	}
+	resp, err := e.Backend.HandleRequest(e.Context, req)
+	if err != nil {
+		t.Fatalf("bad: resp: %#v\nerr:%v", resp, err)
+	}
+	if resp == nil || !resp.IsError() {
+		t.Fatal("expected an error response")
+	}
+	errStr := resp.Data["error"].(string)
+	if !strings.Contains(errStr, "429") {
+		t.Fatalf("error should report the rate-limit response. Err was %#v", errStr)
+	}
+}
+
+func (e *testEnv) RevokeCredsUpstreamFailure(t *testing.T) {
+	e.Mock.FailNext("DELETE", "/user/api-keys", http.StatusServiceUnavailable, 1)
+
+	req := &logical.Request{
+		Operation: logical.RevokeOperation,
+		Storage:   e.Storage,
+		Secret:    e.MostRecentSecret,
+		Data: map[string]interface{}{
+			"lease_id": "foo",
+		},
+	}
+	_, err := e.Backend.HandleRequest(e.Context, req)
+	if err == nil {
+		t.Fatal("expected revocation to fail")
+	}
+	keyID := e.MostRecentSecret.InternalData["api_key_id"].(string)
+	if !e.Mock.APIKeyExists(keyID) {
+		t.Fatal("API key should survive failed revocation")
+	}
+}
+
+func (e *testEnv) RenewCredsUpstreamFailure(t *testing.T) {
+	e.Mock.FailNext("GET", "/user/api-keys", http.StatusUnprocessableEntity, 1)
+
+	resp, err := e.Backend.HandleRequest(e.Context, &logical.Request{
+		Operation: logical.RenewOperation,
+		Storage:   e.Storage,
+		Secret:    e.MostRecentSecret,
+	})
+	if err == nil && (resp == nil || !resp.IsError()) {
+		t.Fatalf("expected renewal to fail when the keys can't be checked, got resp: %#v", resp)
+	}
+}
+
+func (e *testEnv) CheckAPIKeyDeleted(t *testing.T) {
+	keyID := e.MostRecentSecret.InternalData["api_key_id"].(string)
+	if e.Mock.APIKeyExists(keyID) {
+		t.Fatal("API key should be deleted after revocation")
+	}
+}
+
+func (e *testEnv) ExhaustRateLimit(t *testing.T) {
+	// Reset is reported in whole seconds, keep it well ahead of the deadline
+	// in ReadUserCredsThrottled
+	e.Mock.SetRateLimit(rateLimitReserve/2, time.Now().Add(2*time.Second))
+	e.ReadUserCreds(t)
+}
+
+func (e *testEnv) ReadUserCredsThrottled(t *testing.T) {
+	ctx, cancel := context.WithTimeout(e.Context, 100*time.Millisecond)
+	defer cancel()
+	calls := e.Mock.CallCount("POST", "/user/api-keys")
+
+	req := &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      fmt.Sprintf("creds/%s", e.RoleName),
+		Storage:   e.Storage,
+	}
+	_, err := e.Backend.HandleRequest(ctx, req)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	codedErr, ok := err.(logical.HTTPCodedError)
+	if !ok || codedErr.Code() != http.StatusTooManyRequests {
+		t.Fatalf("expected retryable rate-limit error, got %#v", err)
+	}
+	if e.Mock.CallCount("POST", "/user/api-keys") != calls {
+		t.Fatal("throttled request shouldn't reach Packet API")
+	}
+}
+
+const testBatchSize = 5
+
+func (e *testEnv) AddBatchUserRole(t *testing.T) {
+	req := &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      fmt.Sprintf("role/%s", e.RoleName),
+		Storage:   e.Storage,
+		Data: map[string]interface{}{
+			"type":           "user",
+			"read_only":      true,
+			"ttl":            20,
+			"max_ttl":        60,
+			"max_batch_size": testBatchSize,
+		},
+	}
+	resp, err := e.Backend.HandleRequest(e.Context, req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("bad: resp: %#v\nerr:%v", resp, err)
+	}
+	if resp != nil {
+		t.Fatal("expected nil response to represent a 204")
+	}
+}
+
+func (e *testEnv) readBatchCreds(count int) (*logical.Response, error) {
+	req := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      fmt.Sprintf("creds/%s/batch", e.RoleName),
+		Storage:   e.Storage,
+		Data: map[string]interface{}{
+			"count": count,
+		},
+	}
+	return e.Backend.HandleRequest(e.Context, req)
+}
+
+func (e *testEnv) ReadBatchCredsOverLimit(t *testing.T) {
+	resp, err := e.readBatchCreds(testBatchSize + 1)
+	if err != nil {
+		t.Fatalf("bad: resp: %#v\nerr:%v", resp, err)
+	}
+	if resp == nil || !resp.IsError() {
+		t.Fatal("expected an error response")
+	}
+}
+
+func (e *testEnv) ReadBatchCreds(t *testing.T) {
+	resp, err := e.readBatchCreds(testBatchSize)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("bad: resp: %#v\nerr:%v", resp, err)
+	}
+	if resp == nil {
+		t.Fatal("expected a response")
+	}
+	tokens := resp.Data["api_key_tokens"].([]string)
+	keyIDs := resp.Secret.InternalData["api_key_ids"].([]string)
+	if len(tokens) != testBatchSize || len(keyIDs) != testBatchSize {
+		t.Fatalf("expected %d API keys, got %d tokens and %d IDs", testBatchSize, len(tokens), len(keyIDs))
+	}
+	for i, keyID := range keyIDs {
+		apiKey, err := e.GetPacketUserAPIKey(keyID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if apiKey.Token != tokens[i] {
+			t.Fatal("mismatch in api tokens")
+		}
+	}
+
+	e.MostRecentSecret = resp.Secret
+	e.BatchTokens = tokens
+	e.EarlierSecret = nil
+}
+
+func (e *testEnv) claimBatchCreds(token string) (*logical.Response, error) {
+	req := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      fmt.Sprintf("creds/%s/claim", e.RoleName),
+		Storage:   e.Storage,
+		Data: map[string]interface{}{
+			"api_key_token": token,
+		},
+	}
+	return e.Backend.HandleRequest(e.Context, req)
+}
+
+func (e *testEnv) ClaimBatchCreds(t *testing.T) {
+	resp, err := e.claimBatchCreds(e.BatchTokens[0])
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("bad: resp: %#v\nerr:%v", resp, err)
+	}
+	if resp == nil || resp.Secret == nil {
+		t.Fatal("expected a lease of the claimed API key")
+	}
+	keyID := e.MostRecentSecret.InternalData["api_key_ids"].([]string)[0]
+	if resp.Secret.InternalData["api_key_id"] != keyID || resp.Data["api_key_id"] != keyID {
+		t.Fatalf("expected lease of API key %s, got %v", keyID, resp.Secret.InternalData)
+	}
+	e.EarlierSecret = resp.Secret
+
+	for _, token := range []string{e.BatchTokens[0], "not-issued-by-vault"} {
+		resp, err := e.claimBatchCreds(token)
+		if err != nil {
+			t.Fatalf("bad: resp: %#v\nerr:%v", resp, err)
+		}
+		if resp == nil || !resp.IsError() {
+			t.Fatal("expected an error response for a claimed or unknown API token")
+		}
+	}
+}
+
+func (e *testEnv) RevokeBatchCreds(t *testing.T) {
+	var claimed string
+	if e.EarlierSecret != nil {
+		claimed = e.EarlierSecret.InternalData["api_key_id"].(string)
+	}
+	e.RevokeCreds(t)
+	for _, keyID := range e.MostRecentSecret.InternalData["api_key_ids"].([]string) {
+		_, err := e.GetPacketUserAPIKey(keyID)
+		if keyID == claimed && err != nil {
+			t.Fatalf("claimed API key %s should outlive revocation of its batch: %v", keyID, err)
+		}
+		if keyID != claimed && err == nil {
+			t.Fatalf("API key %s should be deleted after revocation", keyID)
+		}
+	}
+}
+
+func (e *testEnv) RevokeClaimedCreds(t *testing.T) {
+	e.RevokeEarlierCreds(t)
+	keyID := e.EarlierSecret.InternalData["api_key_id"].(string)
+	if _, err := e.GetPacketUserAPIKey(keyID); err == nil {
+		t.Fatalf("API key %s should be deleted after revocation of its lease", keyID)
+	}
+}
+
+func (e *testEnv) ReadBatchCredsPartialFailure(t *testing.T) {
+	keysBefore := e.Mock.APIKeyCount()
+	e.Mock.FailNext("POST", "/user/api-keys", http.StatusInternalServerError, 1)
+
+	resp, err := e.readBatchCreds(testBatchSize)
+	if err != nil {
+		t.Fatalf("bad: resp: %#v\nerr:%v", resp, err)
+	}
+	if resp == nil || !resp.IsError() {
+		t.Fatal("expected an error response")
+	}
+	if e.Mock.APIKeyCount() != keysBefore {
+		t.Fatal("API keys of a failed batch should be deleted")
+	}
+}
+
+const (
+	testMaxActiveKeys      = 2
+	testMaxIssuancePerHour = 3
+)
+
+func (e *testEnv) AddQuotaUserRole(t *testing.T) {
+	req := &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      fmt.Sprintf("role/%s", e.RoleName),
+		Storage:   e.Storage,
+		Data: map[string]interface{}{
+			"type":                  "user",
+			"read_only":             true,
+			"ttl":                   20,
+			"max_ttl":               60,
+			"max_active_keys":       testMaxActiveKeys,
+			"max_issuance_per_hour": testMaxIssuancePerHour,
+		},
+	}
+	resp, err := e.Backend.HandleRequest(e.Context, req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("bad: resp: %#v\nerr:%v", resp, err)
+	}
+	if resp != nil {
+		t.Fatal("expected nil response to represent a 204")
+	}
+}
+
+func (e *testEnv) ReadUserCredsQuotaExceeded(t *testing.T) {
+	req := &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      fmt.Sprintf("creds/%s", e.RoleName),
+		Storage:   e.Storage,
+	}
+	resp, err := e.Backend.HandleRequest(e.Context, req)
+	if err != nil {
+		t.Fatalf("bad: resp: %#v\nerr:%v", resp, err)
+	}
+	if resp == nil || !resp.IsError() {
+		t.Fatal("expected an error response")
+	}
+	errStr := resp.Data["error"].(string)
+	if !strings.Contains(errStr, "would exceed max_") {
+		t.Fatalf("error should describe the exceeded limit. Err was %#v", errStr)
+	}
+}
+
+// AddLeakedSlots stores reserved slots as left behind by requests which
+// never finished, all but the last of them stale.
+func (e *testEnv) AddLeakedSlots(t *testing.T) {
+	for i := 0; i < testMaxActiveKeys; i++ {
+		reservedAt := time.Now().Add(-2 * slotTimeout)
+		if i == testMaxActiveKeys-1 {
+			reservedAt = time.Now()
+		}
+		entry, err := logical.StorageEntryJSON(fmt.Sprintf("%s%s/slot-%d", issuedKeyPrefix, e.RoleName, i), issuedKey{
+			Role:       e.RoleName,
+			IssuedAt:   reservedAt,
+			ReservedAt: reservedAt,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := e.Storage.Put(e.Context, entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func (e *testEnv) CheckStaleSlotsExpired(t *testing.T) {
+	ids, err := e.Storage.List(e.Context, issuedKeyPrefix+e.RoleName+"/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fresh := fmt.Sprintf("slot-%d", testMaxActiveKeys-1)
+	if len(ids) != 1 || ids[0] != fresh {
+		t.Fatalf("expected only slot %s left, got %v", fresh, ids)
+	}
+}
+
+func (e *testEnv) ReadUserCredsConcurrently(t *testing.T) {
+	const requests = 10
+	var wg sync.WaitGroup
+	secrets := make(chan *logical.Secret, requests)
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := &logical.Request{
+				Operation: logical.ReadOperation,
+				Path:      fmt.Sprintf("creds/%s", e.RoleName),
+				Storage:   e.Storage,
+			}
+			resp, err := e.Backend.HandleRequest(e.Context, req)
+			if err == nil && resp != nil && !resp.IsError() {
+				secrets <- resp.Secret
+			}
+		}()
+	}
+	wg.Wait()
+	close(secrets)
+
+	if len(secrets) != testMaxActiveKeys {
+		t.Fatalf("expected %d successful requests, got %d", testMaxActiveKeys, len(secrets))
+	}
+	for secret := range secrets {
+		e.MostRecentSecret = secret
+		e.RevokeCreds(t)
+	}
+}
+
+func (e *testEnv) RevokeAllCreds(t *testing.T) {
+	for _, secret := range e.IssuedSecrets {
+		e.MostRecentSecret = secret
+		e.RevokeCreds(t)
+	}
+}
+
+const testPoolSize = 2
+
+func (e *testEnv) AddPoolUserRole(t *testing.T) {
+	req := &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      fmt.Sprintf("role/%s", e.RoleName),
+		Storage:   e.Storage,
+		Data: map[string]interface{}{
+			"type":         "user",
+			"read_only":    true,
+			"ttl":          20,
+			"max_ttl":      60,
+			"pool_size":    testPoolSize,
+			"pool_max_age": 3600,
+		},
+	}
+	resp, err := e.Backend.HandleRequest(e.Context, req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("bad: resp: %#v\nerr:%v", resp, err)
+	}
+	if resp != nil {
+		t.Fatal("expected nil response to represent a 204")
+	}
+}
+
+// RunPeriodic triggers the periodic function of the backend, as Vault does
+// every minute.
+func (e *testEnv) RunPeriodic(t *testing.T) {
+	req := &logical.Request{
+		Operation: logical.RollbackOperation,
+		Path:      "",
+		Storage:   e.Storage,
+	}
+	if _, err := e.Backend.HandleRequest(e.Context, req); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (e *testEnv) listPooledKeys(t *testing.T) []string {
+	keyIDs, err := e.Storage.List(e.Context, poolPrefix+e.RoleName+"/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keyIDs
+}
+
+func (e *testEnv) FillPool(t *testing.T) {
+	e.RunPeriodic(t)
+	e.PooledKeyIDs = e.listPooledKeys(t)
+	if len(e.PooledKeyIDs) != testPoolSize {
+		t.Fatalf("expected %d pooled keys, got %d", testPoolSize, len(e.PooledKeyIDs))
+	}
+	for _, keyID := range e.PooledKeyIDs {
+		if _, err := e.GetPacketUserAPIKey(keyID); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func (e *testEnv) ReadUserCredsFromPool(t *testing.T) {
+	e.ReadUserCreds(t)
+	keyID := e.MostRecentSecret.InternalData["api_key_id"].(string)
+	if !strutil.StrListContains(e.PooledKeyIDs, keyID) {
+		t.Fatal("API key should be issued from the pool")
+	}
+	for _, pooledID := range e.listPooledKeys(t) {
+		if pooledID == keyID {
+			t.Fatal("issued API key should be removed from the pool")
+		}
+	}
+}
+
+func (e *testEnv) CheckPoolRefilled(t *testing.T) {
+	e.Backend.(*backend).background.Wait()
+	e.PooledKeyIDs = e.listPooledKeys(t)
+	if len(e.PooledKeyIDs) != testPoolSize {
+		t.Fatalf("expected %d pooled keys after refill, got %d", testPoolSize, len(e.PooledKeyIDs))
+	}
+}
+
+// faultyStorage fails writes of keys with prefix failPut.
+type faultyStorage struct {
+	logical.Storage
+	failPut string
+}
+
+func (s *faultyStorage) Put(ctx context.Context, entry *logical.StorageEntry) error {
+	if strings.HasPrefix(entry.Key, s.failPut) {
+		return fmt.Errorf("injected failure writing %s", entry.Key)
+	}
+	return s.Storage.Put(ctx, entry)
+}
+
+func (e *testEnv) ReadUserCredsFromPoolRecordFailure(t *testing.T) {
+	req := &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      fmt.Sprintf("creds/%s", e.RoleName),
+		Storage:   &faultyStorage{Storage: e.Storage, failPut: fingerprintPrefix},
+	}
+	resp, err := e.Backend.HandleRequest(e.Context, req)
+	if err == nil && (resp == nil || !resp.IsError()) {
+		t.Fatal("expected issuance to fail")
+	}
+	keyIDs := e.listPooledKeys(t)
+	sort.Strings(keyIDs)
+	sort.Strings(e.PooledKeyIDs)
+	if !reflect.DeepEqual(keyIDs, e.PooledKeyIDs) {
+		t.Fatalf("expected pool %v after failed issuance, got %v", e.PooledKeyIDs, keyIDs)
+	}
+	for _, keyID := range keyIDs {
+		record, err := readIssuedKey(e.Context, e.Storage, e.RoleName, keyID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if record != nil {
+			t.Fatalf("pooled API key %s shouldn't have an issuance record", keyID)
+		}
+		if _, err := e.GetPacketUserAPIKey(keyID); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// AgePooledKeys makes the pooled keys older than pool_max_age of the role,
+// as if the periodic function hadn't pruned them yet.
+func (e *testEnv) AgePooledKeys(t *testing.T) {
+	for _, keyID := range e.listPooledKeys(t) {
+		k, err := readPooledKey(e.Context, e.Storage, e.RoleName, keyID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		k.CreatedAt = k.CreatedAt.Add(-2 * time.Hour)
+		if err := writePooledKey(e.Context, e.Storage, e.RoleName, k); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func (e *testEnv) ReadUserCredsRefillsUsable(t *testing.T) {
+	aged := e.listPooledKeys(t)
+	e.ReadUserCreds(t)
+	keyID := e.MostRecentSecret.InternalData["api_key_id"].(string)
+	if strutil.StrListContains(aged, keyID) {
+		t.Fatal("API key older than pool_max_age shouldn't be issued")
+	}
+	e.Backend.(*backend).background.Wait()
+	e.PooledKeyIDs = e.listPooledKeys(t)
+	if len(e.PooledKeyIDs) != len(aged)+testPoolSize {
+		t.Fatalf("expected %d usable pooled keys next to %d aged ones, got %d keys", testPoolSize, len(aged), len(e.PooledKeyIDs))
+	}
+}
+
+func (e *testEnv) DisablePool(t *testing.T) {
+	req := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      fmt.Sprintf("role/%s", e.RoleName),
+		Storage:   e.Storage,
+		Data: map[string]interface{}{
+			"pool_size": 0,
+		},
+	}
+	resp, err := e.Backend.HandleRequest(e.Context, req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("bad: resp: %#v\nerr:%v", resp, err)
+	}
+}
+
+func (e *testEnv) CheckPoolPruned(t *testing.T) {
+	e.RunPeriodic(t)
+	for _, keyID := range e.PooledKeyIDs {
+		if _, err := e.GetPacketUserAPIKey(keyID); err == nil {
+			t.Fatal("pooled API key should be deleted when the role no longer has a pool")
+		}
+	}
+	if keyIDs := e.listPooledKeys(t); len(keyIDs) != 0 {
+		t.Fatalf("expected empty pool, got %d keys", len(keyIDs))
+	}
+}
+
+func (e *testEnv) WriteLegacyEntries(t *testing.T) {
+	entries := map[string]string{
+		"config": fmt.Sprintf(`{"api_token":%q}`, e.APIToken),
+		"role/" + e.RoleName: `{"type":"user","read_only":true,"project_id":"",` +
+			`"ttl":20000000000,"max_ttl":60000000000}`,
+	}
+	for key, value := range entries {
+		if err := e.Storage.Put(e.Context, &logical.StorageEntry{Key: key, Value: []byte(value)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func (e *testEnv) Initialize(t *testing.T) {
+	err := e.Backend.Initialize(e.Context, &logical.InitializationRequest{Storage: e.Storage})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (e *testEnv) CheckMigratedEntries(t *testing.T) {
+	conf, err := readConfig(e.Context, e.Storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.Version != configVersion || conf.APIToken != e.APIToken {
+		t.Fatalf("config wasn't migrated: %#v", conf)
+	}
+
+	entry, err := e.Storage.Get(e.Context, "role/"+e.RoleName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stored map[string]interface{}
+	if err := entry.DecodeJSON(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored["version"] != json.Number(fmt.Sprint(roleVersion)) || stored["ttl"] != json.Number("20") || stored["max_ttl"] != json.Number("60") {
+		t.Fatalf("role wasn't migrated: %v", stored)
+	}
+
+	req := &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      fmt.Sprintf("role/%s", e.RoleName),
+		Storage:   e.Storage,
+	}
+	resp, err := e.Backend.HandleRequest(e.Context, req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("bad: resp: %#v\nerr:%v", resp, err)
+	}
+	if resp.Data["ttl"] != time.Duration(20) || resp.Data["max_ttl"] != time.Duration(60) {
+		t.Fatalf("bad TTLs of migrated role: %v", resp.Data)
+	}
+}
+
+func (e *testEnv) CheckLogs(t *testing.T) {
+	logs := e.Logs.String()
+	keyID := e.MostRecentSecret.InternalData["api_key_id"].(string)
+	for _, expected := range []string{
+		"issued API key: role=" + e.RoleName + " key_id=" + keyID,
+		"revoked API keys: role=" + e.RoleName,
+		"Packet API call failed: endpoint=APIKeys.Delete",
+		"status=503 request_id=",
+	} {
+		if !strings.Contains(logs, expected) {
+			t.Fatalf("logs should contain %q, were:\n%s", expected, logs)
+		}
+	}
+	for _, token := range e.IssuedTokens {
+		if strings.Contains(logs, token) {
+			t.Fatal("logs must not contain issued API tokens")
+		}
+	}
+	if strings.Contains(logs, e.APIToken) {
+		t.Fatal("logs must not contain the configured API token")
+	}
+}
+
+func (e *testEnv) CollectMetrics(t *testing.T) {
+	conf := metrics.DefaultConfig("vault")
+	conf.EnableHostname = false
+	conf.EnableRuntimeMetrics = false
+	e.Metrics = metrics.NewInmemSink(time.Hour, time.Hour)
+	if _, err := metrics.NewGlobal(conf, e.Metrics); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (e *testEnv) CheckMetrics(t *testing.T) {
+	data := e.Metrics.Data()
+	current := data[len(data)-1]
+
+	labels := fmt.Sprintf(";role=%s;scope=user", e.RoleName)
+	for key, expected := range map[string]int{
+		"vault.packet.keys.issued" + labels + ";operation=issue":   1,
+		"vault.packet.keys.failed" + labels + ";operation=revoke":  1,
+		"vault.packet.keys.revoked" + labels + ";operation=revoke": 1,
+	} {
+		if current.Counters[key].Count != expected {
+			t.Fatalf("expected counter %s to be %d, counters were %v", key, expected, current.Counters)
+		}
+	}
+	for _, key := range []string{
+		"vault.packet.api.call;endpoint=APIKeys.Create;status=ok",
+		"vault.packet.api.call;endpoint=APIKeys.Delete;status=error",
+		"vault.packet.api.call;endpoint=APIKeys.Delete;status=ok",
+	} {
+		if current.Samples[key].Count != 1 {
+			t.Fatalf("expected one sample of %s, samples were %v", key, current.Samples)
+		}
+	}
+	if _, ok := current.Gauges["vault.packet.api.rate_limit_remaining;token_fingerprint="+fingerprint(e.APIToken)[:8]]; !ok {
+		t.Fatal("expected rate limit gauge to be set")
+	}
+}
+
+func (e *testEnv) readStatus(t *testing.T) map[string]interface{} {
+	req := &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "status",
+		Storage:   e.Storage,
+	}
+	resp, err := e.Backend.HandleRequest(e.Context, req)
+	if err != nil || resp == nil || resp.IsError() {
+		t.Fatalf("bad: resp: %#v\nerr:%v", resp, err)
+	}
+	return resp.Data
+}
+
+func (e *testEnv) CheckStatusWithoutConfig(t *testing.T) {
+	status := e.readStatus(t)
+	if status["config_present"] != false {
+		t.Fatalf("config shouldn't be present, status was %v", status)
+	}
+	if _, ok := status["authenticated"]; ok {
+		t.Fatalf("authentication shouldn't be checked without config, status was %v", status)
+	}
+}
+
+func (e *testEnv) CheckStatus(t *testing.T) {
+	status := e.readStatus(t)
+	if status["config_present"] != true || status["authenticated"] != true {
+		t.Fatalf("config token should authenticate, status was %v", status)
+	}
+	if status["token_scope"] != TypeUser || status["token_owner_id"] != e.Mock.User.ID {
+		t.Fatalf("bad token scope or owner, status was %v", status)
+	}
+	if status["rate_limit_known"] != true {
+		t.Fatalf("rate limit should be known after an API call, status was %v", status)
+	}
+	if status["last_api_success"] == "" || status["last_api_failure"] != "" {
+		t.Fatalf("bad API call history, status was %v", status)
+	}
+	if status["last_periodic_run"] == "" || status["last_periodic_error"] != "" {
+		t.Fatalf("bad periodic run history, status was %v", status)
+	}
+}
+
+func (e *testEnv) CheckStatusAfterFailure(t *testing.T) {
+	status := e.readStatus(t)
+	if status["last_api_failure"] == "" || status["last_api_failure_endpoint"] != "APIKeys.Delete" {
+		t.Fatalf("failed call should be recorded, status was %v", status)
+	}
+	if !strings.Contains(status["last_api_error"].(string), "injected failure") {
+		t.Fatalf("error of failed call should be recorded, status was %v", status)
+	}
+}
+
+func (e *testEnv) CheckStatusUnauthenticated(t *testing.T) {
+	status := e.readStatus(t)
+	if status["authenticated"] != false || status["auth_error"] == "" {
+		t.Fatalf("bad token shouldn't authenticate, status was %v", status)
+	}
+}
+
+func (e *testEnv) lookupCreds(data map[string]interface{}) (*logical.Response, error) {
+	req := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "lookup",
+		Storage:   e.Storage,
+		Data:      data,
+	}
+	return e.Backend.HandleRequest(e.Context, req)
+}
+
+func (e *testEnv) checkLookup(t *testing.T, data map[string]interface{}) {
+	resp, err := e.lookupCreds(data)
+	if err != nil || resp == nil || resp.IsError() {
+		t.Fatalf("bad: resp: %#v\nerr:%v", resp, err)
+	}
+	keyID := e.MostRecentSecret.InternalData["api_key_id"].(string)
+	if resp.Data["role"] != e.RoleName || resp.Data["api_key_id"] != keyID {
+		t.Fatalf("bad role or key ID: %v", resp.Data)
+	}
+	if resp.Data["entity_id"] != testEntityID || resp.Data["display_name"] != testDisplayName {
+		t.Fatalf("bad requester: %v", resp.Data)
+	}
+	if resp.Data["ttl"] != int64(20) || resp.Data["max_ttl"] != int64(60) {
+		t.Fatalf("bad lease TTLs: %v", resp.Data)
+	}
+}
+
+func (e *testEnv) LookupCredsByToken(t *testing.T) {
+	e.checkLookup(t, map[string]interface{}{
+		"token": e.IssuedTokens[len(e.IssuedTokens)-1],
+	})
+}
+
+func (e *testEnv) LookupCredsByFingerprint(t *testing.T) {
+	e.checkLookup(t, map[string]interface{}{
+		"fingerprint": fingerprint(e.IssuedTokens[len(e.IssuedTokens)-1]),
+	})
+}
+
+func (e *testEnv) LookupRevokedCreds(t *testing.T) {
+	resp, err := e.lookupCreds(map[string]interface{}{
+		"token": e.IssuedTokens[len(e.IssuedTokens)-1],
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp == nil || !resp.IsError() {
+		t.Fatal("expected an error response for a revoked token")
+	}
+}
+
+func (e *testEnv) readCredsFormat(format string) (*logical.Response, error) {
+	req := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      fmt.Sprintf("creds/%s", e.RoleName),
+		Storage:   e.Storage,
+		Data: map[string]interface{}{
+			"format": format,
+		},
+	}
+	return e.Backend.HandleRequest(e.Context, req)
+}
+
+func (e *testEnv) ReadProjectCredsFormats(t *testing.T) {
+	for _, format := range []string{FormatEnv, FormatPacketCLI, FormatTerraform, FormatKubernetes} {
+		resp, err := e.readCredsFormat(format)
+		if err != nil || resp == nil || resp.IsError() {
+			t.Fatalf("bad: resp: %#v\nerr:%v", resp, err)
+		}
+		e.IssuedSecrets = append(e.IssuedSecrets, resp.Secret)
+		token := resp.Data["api_key_token"].(string)
+		config, _ := resp.Data["config"].(string)
+
+		var expected []string
+		switch format {
+		case FormatEnv:
+			expected = []string{
+				fmt.Sprintf("export PACKET_AUTH_TOKEN='%s'\n", token),
+				fmt.Sprintf("export PACKET_PROJECT_ID='%s'\n", e.TestProjectID),
+			}
+		case FormatPacketCLI:
+			expected = []string{
+				fmt.Sprintf("token: %q\n", token),
+				fmt.Sprintf("project-id: %q\n", e.TestProjectID),
+			}
+		case FormatTerraform:
+			expected = []string{
+				fmt.Sprintf("packet_auth_token = %q\n", token),
+				fmt.Sprintf("packet_project_id = %q\n", e.TestProjectID),
+			}
+		case FormatKubernetes:
+			var secret map[string]string
+			if err := json.Unmarshal([]byte(config), &secret); err != nil {
+				t.Fatal(err)
+			}
+			if secret["apiKey"] != token || secret["projectID"] != e.TestProjectID {
+				t.Fatalf("bad %s config: %s", format, config)
+			}
+		}
+		for _, line := range expected {
+			if !strings.Contains(config, line) {
+				t.Fatalf("%s config should contain %q, was %q", format, line, config)
+			}
+		}
+	}
+}
+
+func (e *testEnv) ReadCredsBadFormat(t *testing.T) {
+	resp, err := e.readCredsFormat("ini")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp == nil || !resp.IsError() {
+		t.Fatal("expected an error response for unknown format")
+	}
+}
+
+const testEntityName = "team-a"
+
+func (e *testEnv) AddTemplatedProjectRole(t *testing.T) {
+	req := &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      fmt.Sprintf("role/%s", e.RoleName),
+		Storage:   e.Storage,
+		Data: map[string]interface{}{
+			"type":        "project",
+			"project_id":  "{{identity.entity.metadata.packet_project}}",
+			"description": "Vault-{{identity.entity.name}}",
+			"read_only":   true,
+			"ttl":         20,
+			"max_ttl":     60,
+		},
+	}
+	resp, err := e.Backend.HandleRequest(e.Context, req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("bad: resp: %#v\nerr:%v", resp, err)
+	}
+}
+
+// setEntity makes the identity store return an entity with given metadata
+// for any entity ID.
+func (e *testEnv) setEntity(metadata map[string]string) {
+	e.Backend.(*backend).system = &logical.StaticSystemView{
+		DefaultLeaseTTLVal: time.Hour,
+		MaxLeaseTTLVal:     time.Hour,
+		EntityVal: &logical.Entity{
+			ID:       testEntityID,
+			Name:     testEntityName,
+			Metadata: metadata,
+		},
+	}
+}
+
+func (e *testEnv) readTemplatedCreds(entityID string) (*logical.Response, error) {
+	req := &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      fmt.Sprintf("creds/%s", e.RoleName),
+		Storage:   e.Storage,
+		EntityID:  entityID,
+	}
+	return e.Backend.HandleRequest(e.Context, req)
+}
+
+func (e *testEnv) ReadTemplatedCreds(t *testing.T) {
+	e.setEntity(map[string]string{"packet_project": e.TestProjectID})
+	resp, err := e.readTemplatedCreds(testEntityID)
+	if err != nil || resp == nil || resp.IsError() {
+		t.Fatalf("bad: resp: %#v\nerr:%v", resp, err)
+	}
+	e.IssuedSecrets = append(e.IssuedSecrets, resp.Secret)
+
+	apiKey, err := e.GetPacketProjectAPIKey(e.TestProjectID, resp.Data["api_key_id"].(string))
+	if err != nil {
+		t.Fatalf("API key should be created in the project from entity metadata: %v", err)
+	}
+	if apiKey.Description != "Vault-"+testEntityName {
+		t.Fatalf("description template should be resolved, was %q", apiKey.Description)
+	}
+}
+
+func (e *testEnv) ReadTemplatedCredsWithoutEntity(t *testing.T) {
+	resp, err := e.readTemplatedCreds("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp == nil || !resp.IsError() {
+		t.Fatal("expected an error response without entity")
+	}
+}
+
+func (e *testEnv) ReadTemplatedCredsUnresolvable(t *testing.T) {
+	e.setEntity(nil)
+	resp, err := e.readTemplatedCreds(testEntityID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp == nil || !resp.IsError() {
+		t.Fatal("expected an error response when the template doesn't resolve")
+	}
+}
+
+const (
+	testBoundCIDR     = "10.20.0.0/16"
+	testGroupName     = "deployers"
+	testMountAccessor = "auth_approle_0123abcd"
+)
+
+func (e *testEnv) AddBoundUserRole(t *testing.T) {
+	req := &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      fmt.Sprintf("role/%s", e.RoleName),
+		Storage:   e.Storage,
+		Data: map[string]interface{}{
+			"type":                          "user",
+			"read_only":                     true,
+			"ttl":                           20,
+			"max_ttl":                       60,
+			"bound_cidrs":                   testBoundCIDR,
+			"allowed_group_names":           testGroupName,
+			"allowed_alias_mount_accessors": testMountAccessor,
+		},
+	}
+	resp, err := e.Backend.HandleRequest(e.Context, req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("bad: resp: %#v\nerr:%v", resp, err)
+	}
+
+	req.Operation = logical.ReadOperation
+	req.Data = nil
+	resp, err = e.Backend.HandleRequest(e.Context, req)
+	if err != nil || resp == nil || resp.IsError() {
+		t.Fatalf("bad: resp: %#v\nerr:%v", resp, err)
+	}
+	if cidrs := resp.Data["bound_cidrs"].([]string); len(cidrs) != 1 || cidrs[0] != testBoundCIDR {
+		t.Fatalf("bound_cidrs should be read back, was %v", cidrs)
+	}
+}
+
+func (e *testEnv) AddRoleWithBadCIDR(t *testing.T) {
+	req := &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      fmt.Sprintf("role/%s-badcidr", e.RoleName),
+		Storage:   e.Storage,
+		Data: map[string]interface{}{
+			"type":        "user",
+			"bound_cidrs": "10.20.0.0",
+		},
+	}
+	_, err := e.Backend.HandleRequest(e.Context, req)
+	if err == nil {
+		t.Fatal("expected an error for a bound_cidrs entry which isn't a CIDR block")
+	}
+}
+
+// setBoundEntity makes the identity store return an entity in given groups,
+// with an alias in given auth mount.
+func (e *testEnv) setBoundEntity(groupName, mountAccessor string) {
+	e.Backend.(*backend).system = &logical.StaticSystemView{
+		DefaultLeaseTTLVal: time.Hour,
+		MaxLeaseTTLVal:     time.Hour,
+		EntityVal: &logical.Entity{
+			ID:   testEntityID,
+			Name: testEntityName,
+			Aliases: []*logical.Alias{
+				{MountAccessor: mountAccessor, Name: testEntityName},
+			},
+		},
+		GroupsVal: []*logical.Group{
+			{ID: "group-id", Name: groupName},
+		},
+	}
+}
+
+func (e *testEnv) readBoundCreds(entityID, remoteAddr string) (*logical.Response, error) {
+	req := &logical.Request{
+		Operation:  logical.ReadOperation,
+		Path:       fmt.Sprintf("creds/%s", e.RoleName),
+		Storage:    e.Storage,
+		EntityID:   entityID,
+		Connection: &logical.Connection{RemoteAddr: remoteAddr},
+	}
+	return e.Backend.HandleRequest(e.Context, req)
+}
+
+func (e *testEnv) ReadBoundCreds(t *testing.T) {
+	e.setBoundEntity(testGroupName, testMountAccessor)
+	resp, err := e.readBoundCreds(testEntityID, "10.20.1.2")
+	if err != nil || resp == nil || resp.IsError() {
+		t.Fatalf("bad: resp: %#v\nerr:%v", resp, err)
+	}
+	e.IssuedSecrets = append(e.IssuedSecrets, resp.Secret)
+}
+
+func (e *testEnv) checkCallerDenied(t *testing.T, resp *logical.Response, err error) {
+	if err != logical.ErrPermissionDenied {
+		t.Fatalf("expected permission denied, got resp: %#v\nerr:%v", resp, err)
+	}
+	if resp == nil || !resp.IsError() {
+		t.Fatal("expected an error response explaining the denial")
+	}
+}
+
+func (e *testEnv) ReadBoundCredsOutsideCIDRs(t *testing.T) {
+	e.setBoundEntity(testGroupName, testMountAccessor)
+	resp, err := e.readBoundCreds(testEntityID, "192.0.2.1")
+	e.checkCallerDenied(t, resp, err)
+	resp, err = e.readBoundCreds(testEntityID, "")
+	e.checkCallerDenied(t, resp, err)
+}
+
+func (e *testEnv) ReadBoundCredsWithoutEntity(t *testing.T) {
+	e.setBoundEntity(testGroupName, testMountAccessor)
+	resp, err := e.readBoundCreds("", "10.20.1.2")
+	e.checkCallerDenied(t, resp, err)
+}
+
+func (e *testEnv) ReadBoundCredsOutsideGroups(t *testing.T) {
+	e.setBoundEntity("other", testMountAccessor)
+	resp, err := e.readBoundCreds(testEntityID, "10.20.1.2")
+	e.checkCallerDenied(t, resp, err)
+}
+
+func (e *testEnv) ReadBoundCredsFromOtherMount(t *testing.T) {
+	e.setBoundEntity(testGroupName, "auth_userpass_0123abcd")
+	resp, err := e.readBoundCreds(testEntityID, "10.20.1.2")
+	e.checkCallerDenied(t, resp, err)
+}
+
+func (e *testEnv) AddReadWriteUserRole(t *testing.T) {
+	req := &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      fmt.Sprintf("role/%s-user", e.RoleName),
+		Storage:   e.Storage,
+		Data: map[string]interface{}{
+			"type":      "user",
+			"read_only": false,
+			"ttl":       20,
+			"max_ttl":   60,
+		},
+	}
+	resp, err := e.Backend.HandleRequest(e.Context, req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("bad: resp: %#v\nerr:%v", resp, err)
+	}
+}
+
+func (e *testEnv) writePolicy(t *testing.T, policy map[string]interface{}) *logical.Response {
+	req := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "config",
+		Storage:   e.Storage,
+		Data:      policy,
+	}
+	resp, err := e.Backend.HandleRequest(e.Context, req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("bad: resp: %#v\nerr:%v", resp, err)
+	}
+	return resp
+}
+
+func (e *testEnv) readViolations(t *testing.T) map[string]string {
+	req := &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "config",
+		Storage:   e.Storage,
+	}
+	resp, err := e.Backend.HandleRequest(e.Context, req)
+	if err != nil || resp == nil || resp.IsError() {
+		t.Fatalf("bad: resp: %#v\nerr:%v", resp, err)
+	}
+	if _, ok := resp.Data["api_token"]; ok {
+		t.Fatal("config read must not return the API token")
+	}
+	return resp.Data["roles_violating_policy"].(map[string]string)
+}
+
+func (e *testEnv) TightenPolicy(t *testing.T) {
+	resp := e.writePolicy(t, map[string]interface{}{
+		"allow_user_roles":    false,
+		"allow_read_write":    false,
+		"allowed_project_ids": mockUUID(),
+	})
+	if resp == nil || len(resp.Warnings) != 2 {
+		t.Fatalf("expected warnings about both roles, got resp: %#v", resp)
+	}
+	violations := e.readViolations(t)
+	if _, ok := violations[e.RoleName]; !ok {
+		t.Fatalf("project role outside allowed projects should be reported, was %v", violations)
+	}
+	if _, ok := violations[e.RoleName+"-user"]; !ok {
+		t.Fatalf("user role should be reported, was %v", violations)
+	}
+}
+
+func (e *testEnv) ReadCredsViolatingPolicy(t *testing.T) {
+	req := &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      fmt.Sprintf("creds/%s", e.RoleName),
+		Storage:   e.Storage,
+	}
+	resp, err := e.Backend.HandleRequest(e.Context, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp == nil || !resp.IsError() {
+		t.Fatal("expected an error response for a role violating the mount policy")
+	}
+}
+
+func (e *testEnv) AddRoleViolatingPolicy(t *testing.T) {
+	req := &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      fmt.Sprintf("role/%s-violating", e.RoleName),
+		Storage:   e.Storage,
+		Data: map[string]interface{}{
+			"type":       "project",
+			"project_id": e.TestProjectID,
+			"read_only":  false,
+		},
+	}
+	if _, err := e.Backend.HandleRequest(e.Context, req); err == nil {
+		t.Fatal("expected an error writing a role which violates the mount policy")
+	}
+}
+
+func (e *testEnv) AllowProjectOrganization(t *testing.T) {
+	project, _, err := e.packetClient().Projects.Get(e.TestProjectID, &packngo.GetOptions{Includes: []string{"organization"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := e.writePolicy(t, map[string]interface{}{
+		"allowed_project_ids":      e.TestProjectID,
+		"allowed_organization_ids": project.Organization.ID,
+		"max_role_ttl":             60,
+	})
+	if resp == nil || len(resp.Warnings) != 1 {
+		t.Fatalf("expected a warning about the user role only, got resp: %#v", resp)
+	}
+	violations := e.readViolations(t)
+	if _, ok := violations[e.RoleName]; ok {
+		t.Fatalf("project role should comply, was %v", violations)
+	}
+}
+
+const (
+	testVerifyTimeout = 2
+	testPropagation   = 700 * time.Millisecond
+)
+
+func (e *testEnv) AddVerifiedProjectRole(t *testing.T) {
+	req := &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      fmt.Sprintf("role/%s", e.RoleName),
+		Storage:   e.Storage,
+		Data: map[string]interface{}{
+			"type":           "project",
+			"project_id":     e.TestProjectID,
+			"read_only":      true,
+			"ttl":            20,
+			"max_ttl":        60,
+			"verify_timeout": testVerifyTimeout,
+		},
+	}
+	resp, err := e.Backend.HandleRequest(e.Context, req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("bad: resp: %#v\nerr:%v", resp, err)
+	}
+}
+
+func (e *testEnv) ReadVerifiedCreds(t *testing.T) {
+	e.Mock.SetPropagation(testPropagation)
+	defer e.Mock.SetPropagation(0)
+
+	start := time.Now()
+	resp, err := e.Backend.HandleRequest(e.Context, &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      fmt.Sprintf("creds/%s", e.RoleName),
+		Storage:   e.Storage,
+	})
+	if err != nil || resp == nil || resp.IsError() {
+		t.Fatalf("bad: resp: %#v\nerr:%v", resp, err)
+	}
+	if time.Since(start) < testPropagation {
+		t.Fatal("creds should be returned only once the API key is usable")
+	}
+	e.IssuedSecrets = append(e.IssuedSecrets, resp.Secret)
+
+	c, _ := packngo.NewClientWithBaseURL("Hashicorp Vault Test", resp.Data["api_key_token"].(string), nil, e.Mock.URL)
+	if _, _, err := c.Projects.Get(e.TestProjectID, nil); err != nil {
+		t.Fatalf("returned API key should be usable: %v", err)
+	}
+}
+
+// CheckProbesRecorded checks that probes of new API keys are recorded like
+// other API calls, and that their rejection doesn't take config tokens out of
+// rotation.
+func (e *testEnv) CheckProbesRecorded(t *testing.T) {
+	status, tokens := e.statusTokens(t)
+	if status["last_api_failure_endpoint"] != "Projects.Get" {
+		t.Fatalf("expected rejected probes to be recorded, status was %v", status)
+	}
+	if tokens[0]["active"] != true || tokens[1]["active"] != true {
+		t.Fatalf("rejected probes shouldn't disable tokens, tokens were %v", tokens)
+	}
+}
+
+func (e *testEnv) ReadUnverifiableCreds(t *testing.T) {
+	e.Mock.SetPropagation(time.Hour)
+	defer e.Mock.SetPropagation(0)
+
+	keys := e.Mock.APIKeyCount()
+	resp, err := e.Backend.HandleRequest(e.Context, &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      fmt.Sprintf("creds/%s", e.RoleName),
+		Storage:   e.Storage,
+	})
+	if err == nil && (resp == nil || !resp.IsError()) {
+		t.Fatalf("expected an error for an API key which doesn't become usable, got resp: %#v", resp)
+	}
+	if e.Mock.APIKeyCount() != keys {
+		t.Fatal("API key which didn't become usable should be deleted")
+	}
+}
+
+func (e *testEnv) DeleteKeyOutsideVault(t *testing.T) {
+	keyID := e.MostRecentSecret.InternalData["api_key_id"].(string)
+	if _, err := e.packetClient().APIKeys.Delete(keyID); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (e *testEnv) RenewDeletedCreds(t *testing.T) {
+	resp, err := e.Backend.HandleRequest(e.Context, &logical.Request{
+		Operation: logical.RenewOperation,
+		Storage:   e.Storage,
+		Secret:    e.MostRecentSecret,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp == nil || !resp.IsError() {
+		t.Fatal("expected an error response renewing a lease of a deleted API key")
+	}
+}
+
+func (e *testEnv) SkipRenewCheck(t *testing.T) {
+	resp, err := e.Backend.HandleRequest(e.Context, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      fmt.Sprintf("role/%s", e.RoleName),
+		Storage:   e.Storage,
+		Data: map[string]interface{}{
+			"skip_renew_check": true,
+		},
+	})
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("bad: resp: %#v\nerr:%v", resp, err)
+	}
+}
+
+func (e *testEnv) ReadReconcileCreds(t *testing.T) {
+	for i := 0; i < 2; i++ {
+		resp, err := e.Backend.HandleRequest(e.Context, &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      fmt.Sprintf("creds/%s", e.RoleName),
+			Storage:   e.Storage,
+		})
+		if err != nil || resp == nil || resp.IsError() {
+			t.Fatalf("bad: resp: %#v\nerr:%v", resp, err)
+		}
+		e.IssuedSecrets = append(e.IssuedSecrets, resp.Secret)
+	}
+	// The first key is deleted outside of Vault
+	e.MostRecentSecret = e.IssuedSecrets[0]
+}
+
+func (e *testEnv) CreateStrayKey(t *testing.T) {
+	apiKey, _, err := e.packetClient().APIKeys.Create(&packngo.APIKeyCreateRequest{
+		Description: fmt.Sprintf("Vault-%s-stray", e.RoleName),
+		ProjectID:   e.TestProjectID,
+		ReadOnly:    true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.StrayKeyID = apiKey.ID
+}
+
+func (e *testEnv) DeleteStrayKey(t *testing.T) {
+	if _, err := e.packetClient().APIKeys.Delete(e.StrayKeyID); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (e *testEnv) MakeRoleReadWrite(t *testing.T) {
+	resp, err := e.Backend.HandleRequest(e.Context, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      fmt.Sprintf("role/%s", e.RoleName),
+		Storage:   e.Storage,
+		Data: map[string]interface{}{
+			"read_only": false,
+		},
+	})
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("bad: resp: %#v\nerr:%v", resp, err)
+	}
+}
+
+func (e *testEnv) reconcile(t *testing.T, apply bool) *logical.Response {
+	req := &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "reconcile",
+		Storage:   e.Storage,
+	}
+	if apply {
+		req.Operation = logical.UpdateOperation
+		req.Data = map[string]interface{}{"apply": true}
+	}
+	resp, err := e.Backend.HandleRequest(e.Context, req)
+	if err != nil || resp == nil || resp.IsError() {
+		t.Fatalf("bad: resp: %#v\nerr:%v", resp, err)
+	}
+	return resp
+}
+
+// reportedKeyIDs returns IDs of the API keys in a group of the reconcile
+// report.
+func reportedKeyIDs(resp *logical.Response, group string) []string {
+	var ids []string
+	for _, k := range resp.Data[group].([]map[string]interface{}) {
+		ids = append(ids, k["api_key_id"].(string))
+	}
+	return ids
+}
+
+func (e *testEnv) ReconcileReport(t *testing.T) {
+	deleted := e.IssuedSecrets[0].InternalData["api_key_id"].(string)
+	remaining := e.IssuedSecrets[1].InternalData["api_key_id"].(string)
+
+	resp := e.reconcile(t, false)
+	if ids := reportedKeyIDs(resp, "missing_upstream"); len(ids) != 1 || ids[0] != deleted {
+		t.Fatalf("key deleted outside of Vault should be missing upstream, was %v", ids)
+	}
+	if ids := reportedKeyIDs(resp, "unknown_to_vault"); !strutil.StrListContains(ids, e.StrayKeyID) {
+		t.Fatalf("stray key should be unknown to Vault, was %v", ids)
+	}
+	if ids := reportedKeyIDs(resp, "drifted"); len(ids) != 1 || ids[0] != remaining {
+		t.Fatalf("read-only key of read-write role should drift, was %v", ids)
+	}
+	if len(resp.Data["fixed"].([]string)) != 0 {
+		t.Fatal("reading the report shouldn't fix anything")
+	}
+}
+
+func (e *testEnv) ReconcileApply(t *testing.T) {
+	deleted := e.IssuedSecrets[0].InternalData["api_key_id"].(string)
+
+	resp := e.reconcile(t, true)
+	if fixed := resp.Data["fixed"].([]string); len(fixed) != 1 || fixed[0] != deleted {
+		t.Fatalf("key missing upstream should be fixed, was %v", fixed)
+	}
+	record, err := readIssuedKey(e.Context, e.Storage, e.RoleName, deleted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record != nil {
+		t.Fatal("record of key missing upstream should be forgotten")
+	}
+
+	resp = e.reconcile(t, false)
+	if ids := reportedKeyIDs(resp, "missing_upstream"); len(ids) != 0 {
+		t.Fatalf("no key should be missing upstream after applying, was %v", ids)
+	}
+	if ids := reportedKeyIDs(resp, "unknown_to_vault"); !strutil.StrListContains(ids, e.StrayKeyID) {
+		t.Fatal("stray key should be left alone")
+	}
+}
+
+func (e *testEnv) listRevocations(t *testing.T, state string) []string {
+	resp, err := e.Backend.HandleRequest(e.Context, &logical.Request{
+		Operation: logical.ListOperation,
+		Path:      "revocations/" + state + "/",
+		Storage:   e.Storage,
+	})
+	if err != nil || resp == nil || resp.IsError() {
+		t.Fatalf("bad: resp: %#v\nerr:%v", resp, err)
+	}
+	keys, _ := resp.Data["keys"].([]string)
+	return keys
+}
+
+func (e *testEnv) readRevocation(t *testing.T, state, keyID string) *logical.Response {
+	resp, err := e.Backend.HandleRequest(e.Context, &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "revocations/" + state + "/" + keyID,
+		Storage:   e.Storage,
+	})
+	if err != nil || resp == nil || resp.IsError() {
+		t.Fatalf("bad: resp: %#v\nerr:%v", resp, err)
+	}
+	return resp
+}
+
+func (e *testEnv) CheckRevocationPending(t *testing.T) {
+	keyID := e.MostRecentSecret.InternalData["api_key_id"].(string)
+	if keys := e.listRevocations(t, "pending"); len(keys) != 1 || keys[0] != keyID {
+		t.Fatalf("failed revocation should be queued, was %v", keys)
+	}
+	resp := e.readRevocation(t, "pending", keyID)
+	if resp.Data["attempts"] != 1 || resp.Data["last_error"] == "" || resp.Data["next_attempt_at"] == "" {
+		t.Fatalf("unexpected queue entry: %#v", resp.Data)
+	}
+}
+
+// RevokeCredsUpstreamFailureNotDue fails the revocation of a queued lease
+// again before its retry is due, as when Vault retries it.
+func (e *testEnv) RevokeCredsUpstreamFailureNotDue(t *testing.T) {
+	keyID := e.MostRecentSecret.InternalData["api_key_id"].(string)
+	nextAttempt := e.readRevocation(t, "pending", keyID).Data["next_attempt_at"]
+	e.RevokeCredsUpstreamFailure(t)
+	e.CheckRevocationPending(t)
+	if next := e.readRevocation(t, "pending", keyID).Data["next_attempt_at"]; next != nextAttempt {
+		t.Fatalf("retry by Vault shouldn't move the next attempt from %v to %v", nextAttempt, next)
+	}
+}
+
+func (e *testEnv) CheckRevocationQueueEmpty(t *testing.T) {
+	if keys := e.listRevocations(t, "pending"); len(keys) != 0 {
+		t.Fatalf("revocation queue should be empty, was %v", keys)
+	}
+	if keys := e.listRevocations(t, "failed"); len(keys) != 0 {
+		t.Fatalf("failed revocations should be empty, was %v", keys)
+	}
+}
+
+// makeRevocationsDue moves the next attempt of queued revocations to now.
+func (e *testEnv) makeRevocationsDue(t *testing.T) {
+	keyIDs, err := e.Storage.List(e.Context, revocationPendingPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, keyID := range keyIDs {
+		r, err := readFailedRevocation(e.Context, e.Storage, revocationPendingPrefix, keyID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.NextAttemptAt = time.Now().Add(-time.Second)
+		if err := writeFailedRevocation(e.Context, e.Storage, revocationPendingPrefix, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func (e *testEnv) DeadLetterRevocation(t *testing.T) {
+	// RevokeCredsUpstreamFailure injects the first failure
+	e.Mock.FailNext("DELETE", "/user/api-keys", http.StatusServiceUnavailable, maxRevocationAttempts-1)
+	e.RevokeCredsUpstreamFailure(t)
+	for i := 1; i < maxRevocationAttempts; i++ {
+		e.makeRevocationsDue(t)
+		e.RunPeriodic(t)
+	}
+
+	keyID := e.MostRecentSecret.InternalData["api_key_id"].(string)
+	if keys := e.listRevocations(t, "pending"); len(keys) != 0 {
+		t.Fatalf("revocation given up on shouldn't be pending, was %v", keys)
+	}
+	if keys := e.listRevocations(t, "failed"); len(keys) != 1 || keys[0] != keyID {
+		t.Fatalf("revocation given up on should be failed, was %v", keys)
+	}
+	resp := e.readRevocation(t, "failed", keyID)
+	if resp.Data["attempts"] != maxRevocationAttempts || !strings.Contains(resp.Data["last_error"].(string), "503") {
+		t.Fatalf("unexpected dead-letter entry: %#v", resp.Data)
+	}
+	if !e.Mock.APIKeyExists(keyID) {
+		t.Fatal("API key should survive failed revocations")
+	}
+
+	// Further retries by the periodic function don't reach Packet
+	calls := e.Mock.CallCount("DELETE", "/user/api-keys/"+keyID)
+	e.makeRevocationsDue(t)
+	e.RunPeriodic(t)
+	if e.Mock.CallCount("DELETE", "/user/api-keys/"+keyID) != calls {
+		t.Fatal("revocation given up on shouldn't be retried")
+	}
+}
+
+func (e *testEnv) revocationAction(t *testing.T, action string) {
+	keyID := e.MostRecentSecret.InternalData["api_key_id"].(string)
+	resp, err := e.Backend.HandleRequest(e.Context, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "revocations/failed/" + keyID + "/" + action,
+		Storage:   e.Storage,
+	})
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("bad: resp: %#v\nerr:%v", resp, err)
+	}
+}
+
+func (e *testEnv) RetryFailedRevocation(t *testing.T) {
+	e.revocationAction(t, "retry")
+	keyID := e.MostRecentSecret.InternalData["api_key_id"].(string)
+	if e.Mock.APIKeyExists(keyID) {
+		t.Fatal("retried revocation should delete the API key")
+	}
+	e.CheckRevocationQueueEmpty(t)
+}
+
+func (e *testEnv) AcknowledgeFailedRevocation(t *testing.T) {
+	e.revocationAction(t, "acknowledge")
+	keyID := e.MostRecentSecret.InternalData["api_key_id"].(string)
+	e.CheckRevocationQueueEmpty(t)
+	record, err := readIssuedKey(e.Context, e.Storage, e.RoleName, keyID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record != nil {
+		t.Fatal("acknowledged API key should be forgotten")
+	}
+	// Left for the operator to delete
+	e.Mock.DeleteAPIKey(keyID)
+}
+
+func (e *testEnv) writeTokens(t *testing.T, selection string) {
+	if e.SecondToken == "" {
+		apiKey := e.Mock.AddAPIKey("", "second root token", false)
+		e.SecondToken, e.SecondTokenKeyID = apiKey.Token, apiKey.ID
+	}
+	req := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "config",
+		Storage:   e.Storage,
+		Data: map[string]interface{}{
+			"api_tokens":      []string{e.APIToken, e.SecondToken},
+			"token_selection": selection,
+		},
+	}
+	resp, err := e.Backend.HandleRequest(e.Context, req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("bad: resp: %#v\nerr:%v", resp, err)
+	}
+}
+
+func (e *testEnv) AddConfigWithTokens(t *testing.T) {
+	e.writeTokens(t, "round-robin")
+
+	req := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "config",
+		Storage:   e.Storage,
+		Data: map[string]interface{}{
+			"api_token":  e.APIToken,
+			"api_tokens": []string{e.APIToken},
+		},
+	}
+	resp, err := e.Backend.HandleRequest(e.Context, req)
+	if err == nil && (resp == nil || !resp.IsError()) {
+		t.Fatal("api_token and api_tokens together should be refused")
+	}
+
+	if e.Mock != nil {
+		req.Data = map[string]interface{}{
+			"api_tokens": []string{e.APIToken, e.Mock.OtherRootToken},
+		}
+		resp, err = e.Backend.HandleRequest(e.Context, req)
+		if err == nil || !strings.Contains(err.Error(), "same user") {
+			t.Fatalf("tokens of different users should be refused, got resp: %#v\nerr:%v", resp, err)
+		}
+	}
+
+	req.Data = map[string]interface{}{"token_selection": "random"}
+	resp, err = e.Backend.HandleRequest(e.Context, req)
+	if err == nil && (resp == nil || !resp.IsError()) {
+		t.Fatal("unknown token_selection should be refused")
+	}
+}
+
+func (e *testEnv) ReadConfigWithTokens(t *testing.T) {
+	req := &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "config",
+		Storage:   e.Storage,
+	}
+	resp, err := e.Backend.HandleRequest(e.Context, req)
+	if err != nil || resp == nil || resp.IsError() {
+		t.Fatalf("bad: resp: %#v\nerr:%v", resp, err)
+	}
+	if resp.Data["api_token_count"] != 2 || resp.Data["token_selection"] != "round-robin" {
+		t.Fatalf("bad token config: %v", resp.Data)
+	}
+	for _, v := range resp.Data {
+		if s, ok := v.(string); ok && (s == e.APIToken || s == e.SecondToken) {
+			t.Fatal("config read shouldn't return tokens")
+		}
+	}
+}
+
+func (e *testEnv) CheckTokensUsedInTurns(t *testing.T) {
+	// Writing the config looked up the owner of the token once
+	if e.Mock.TokenCallCount(e.SecondToken) <= 1 {
+		t.Fatal("second token should be used for issuing creds")
+	}
+
+	// Every status read makes one call
+	first, second := e.Mock.TokenCallCount(e.APIToken), e.Mock.TokenCallCount(e.SecondToken)
+	for i := 0; i < 4; i++ {
+		e.readStatus(t)
+	}
+	first, second = e.Mock.TokenCallCount(e.APIToken)-first, e.Mock.TokenCallCount(e.SecondToken)-second
+	if first != 2 || second != 2 {
+		t.Fatalf("calls should alternate between tokens, got %d and %d", first, second)
+	}
+}
+
+func (e *testEnv) RevokeSecondToken(t *testing.T) {
+	e.Mock.DeleteAPIKey(e.SecondTokenKeyID)
+}
+
+func (e *testEnv) statusTokens(t *testing.T) (map[string]interface{}, []map[string]interface{}) {
+	status := e.readStatus(t)
+	tokens, ok := status["api_tokens"].([]map[string]interface{})
+	if !ok || len(tokens) != 2 {
+		t.Fatalf("status should list both tokens, status was %v", status)
+	}
+	return status, tokens
+}
+
+func (e *testEnv) CheckTokenDisabled(t *testing.T) {
+	status, tokens := e.statusTokens(t)
+	if status["authenticated"] != true {
+		t.Fatalf("remaining token should authenticate, status was %v", status)
+	}
+	if tokens[0]["active"] != true || tokens[1]["active"] != false || tokens[1]["disabled_error"] == "" {
+		t.Fatalf("rejected token should be flagged, tokens were %v", tokens)
+	}
+	if tokens[1]["fingerprint"] != fingerprint(e.SecondToken)[:8] {
+		t.Fatalf("bad token fingerprint, tokens were %v", tokens)
+	}
+	if !strings.Contains(e.Logs.String(), "taking it out of rotation") {
+		t.Fatal("rejected token should be logged")
+	}
+
+	// Out of rotation, the rejected token isn't used anymore
+	calls := e.Mock.TokenCallCount(e.SecondToken)
+	e.readStatus(t)
+	e.readStatus(t)
+	if e.Mock.TokenCallCount(e.SecondToken) != calls {
+		t.Fatal("rejected token shouldn't be used")
+	}
+}
+
+func (e *testEnv) SelectTokenByRateLimit(t *testing.T) {
+	e.SecondToken, e.SecondTokenKeyID = "", ""
+	e.writeTokens(t, "rate-limit")
+
+	// Both tokens share the rate limit in the fake API, so the token of
+	// unknown state is preferred until both are known. Writing the config
+	// looked up the owner of each token.
+	calls := e.Mock.TokenCallCount(e.SecondToken)
+	e.readStatus(t)
+	e.readStatus(t)
+	if e.Mock.TokenCallCount(e.SecondToken)-calls != 1 {
+		t.Fatalf("token of unknown rate limit should be tried, got %d calls", e.Mock.TokenCallCount(e.SecondToken)-calls)
+	}
+}
+
+func (e *testEnv) CheckTokensActive(t *testing.T) {
+	_, tokens := e.statusTokens(t)
+	for _, token := range tokens {
+		if token["active"] != true || token["rate_limit_known"] != true {
+			t.Fatalf("tokens should be in rotation, tokens were %v", tokens)
+		}
+	}
+}
+
+func (e *testEnv) CheckLocalStorage(t *testing.T) {
+	local := e.Backend.SpecialPaths().LocalStorage
+	for _, prefix := range []string{issuedKeyPrefix, issuanceLogPrefix, fingerprintPrefix, poolPrefix, revocationPendingPrefix} {
+		found := false
+		for _, p := range local {
+			found = found || strings.HasPrefix(prefix, p)
+		}
+		if !found {
+			t.Fatalf("%s should be in local storage, local storage is %v", prefix, local)
+		}
+	}
+	for _, p := range local {
+		if strings.HasPrefix("config", p) || strings.HasPrefix("role/", p) {
+			t.Fatalf("config and roles should be replicated, local storage is %v", local)
+		}
+	}
+}
+
+func (e *testEnv) CheckSealWrapStorage(t *testing.T) {
+	wrapped := e.Backend.SpecialPaths().SealWrapStorage
+	for _, key := range []string{"config", webhookConfigKey, poolPrefix + e.RoleName + "/key"} {
+		found := false
+		for _, p := range wrapped {
+			// Like Vault, entries ending with a slash are prefixes
+			found = found || p == key || (strings.HasSuffix(p, "/") && strings.HasPrefix(key, p))
+		}
+		if !found {
+			t.Fatalf("%s should be seal-wrapped, seal-wrapped storage is %v", key, wrapped)
+		}
+	}
+}
+
+func (e *testEnv) setReplicationState(t *testing.T, state consts.ReplicationState, local bool) {
+	b := e.Backend.(*backend)
+	sys := &logical.StaticSystemView{
+		DefaultLeaseTTLVal:  time.Hour,
+		MaxLeaseTTLVal:      time.Hour,
+		ReplicationStateVal: state,
+		LocalMountVal:       local,
+	}
+	if err := b.Setup(e.Context, &logical.BackendConfig{Logger: b.Logger(), System: sys}); err != nil {
+		t.Fatal(err)
+	}
+	b.system = sys
+}
+
+func (e *testEnv) BecomePerfSecondary(t *testing.T) {
+	e.setReplicationState(t, consts.ReplicationPerformanceSecondary, false)
+}
+
+func (e *testEnv) BecomeLocalMountOnPerfSecondary(t *testing.T) {
+	e.setReplicationState(t, consts.ReplicationPerformanceSecondary, true)
+}
+
+func (e *testEnv) BecomePerfStandby(t *testing.T) {
+	e.setReplicationState(t, consts.ReplicationPerformancePrimary|consts.ReplicationPerformanceStandby, false)
+}
+
+func (e *testEnv) BecomePrimary(t *testing.T) {
+	e.setReplicationState(t, consts.ReplicationPerformancePrimary, false)
+}
+
+func (e *testEnv) checkForwarded(t *testing.T, req *logical.Request) {
+	req.Storage = e.Storage
+	resp, err := e.Backend.HandleRequest(e.Context, req)
+	if err != logical.ErrReadOnly {
+		t.Fatalf("%s %s should be forwarded: resp: %#v\nerr:%v", req.Operation, req.Path, resp, err)
+	}
+}
+
+func (e *testEnv) CheckGlobalWritesForwarded(t *testing.T) {
+	e.checkForwarded(t, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "config",
+		Data:      map[string]interface{}{"api_token": e.APIToken},
+	})
+	e.checkForwarded(t, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      fmt.Sprintf("role/%s", e.RoleName),
+		Data:      map[string]interface{}{"ttl": 30},
+	})
+	e.checkForwarded(t, &logical.Request{
+		Operation: logical.DeleteOperation,
+		Path:      fmt.Sprintf("role/%s", e.RoleName),
+	})
+}
+
+func (e *testEnv) CheckCredsForwarded(t *testing.T) {
+	e.checkForwarded(t, &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      fmt.Sprintf("creds/%s", e.RoleName),
+	})
+	e.checkForwarded(t, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      fmt.Sprintf("creds/%s/batch", e.RoleName),
+		Data:      map[string]interface{}{"count": 2},
+	})
+}
+
+func (e *testEnv) CheckPeriodicSkipped(t *testing.T) {
+	e.RunPeriodic(t)
+	if status := e.readStatus(t); status["last_periodic_run"] != "" {
+		t.Fatalf("periodic jobs shouldn't run on a standby or secondary, status was %v", status)
+	}
+}
+
+func (e *testEnv) CheckPeriodicRan(t *testing.T) {
+	e.RunPeriodic(t)
+	if status := e.readStatus(t); status["last_periodic_run"] == "" {
+		t.Fatalf("periodic jobs should run, status was %v", status)
+	}
+}
+
+const testWebhookSecret = "webhook-secret"
+
+func (e *testEnv) writeWebhookConfig(data map[string]interface{}) (*logical.Response, error) {
+	req := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "config/webhooks",
+		Storage:   e.Storage,
+		Data:      data,
+	}
+	return e.Backend.HandleRequest(e.Context, req)
+}
+
+func (e *testEnv) AddWebhookConfig(t *testing.T) {
+	e.Webhook = newWebhookReceiver()
+
+	for _, data := range []map[string]interface{}{
+		{"urls": e.Webhook.URL},
+		{"urls": "ftp://example.com", "secret": testWebhookSecret},
+		{"urls": e.Webhook.URL, "secret": testWebhookSecret, "events": "issue,create"},
+	} {
+		resp, err := e.writeWebhookConfig(data)
+		if err == nil && (resp == nil || !resp.IsError()) {
+			t.Fatalf("bad webhook config %v should be refused", data)
+		}
+	}
+
+	resp, err := e.writeWebhookConfig(map[string]interface{}{
+		"urls":   e.Webhook.URL,
+		"secret": testWebhookSecret,
+	})
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("bad: resp: %#v\nerr:%v", resp, err)
+	}
+}
+
+func (e *testEnv) ReadWebhookConfig(t *testing.T) {
+	req := &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "config/webhooks",
+		Storage:   e.Storage,
+	}
+	resp, err := e.Backend.HandleRequest(e.Context, req)
+	if err != nil || resp == nil || resp.IsError() {
+		t.Fatalf("bad: resp: %#v\nerr:%v", resp, err)
+	}
+	if _, ok := resp.Data["secret"]; ok {
+		t.Fatal("webhook secret shouldn't be returned")
+	}
+	if !strutil.EquivalentSlices(resp.Data["urls"].([]string), []string{e.Webhook.URL}) ||
+		len(resp.Data["events"].([]string)) != len(webhookEvents) || resp.Data["outbox_size"] != defaultWebhookOutboxSize {
+		t.Fatalf("bad webhook config: %v", resp.Data)
+	}
+}
+
+// lastEvent waits for background deliveries and returns the most recent
+// event, checking it's of given type and correctly signed.
+func (e *testEnv) lastEvent(t *testing.T, eventType string) *webhookEvent {
+	e.Backend.(*backend).background.Wait()
+	d := e.Webhook.Last()
+	if d == nil || d.Event.Type != eventType {
+		t.Fatalf("expected %s event, events were %v", eventType, e.Webhook.Events())
+	}
+	if d.Header.Get(webhookSignatureHeader) != signWebhook(testWebhookSecret, d.Body) {
+		t.Fatalf("bad signature %q of event %s", d.Header.Get(webhookSignatureHeader), d.Body)
+	}
+	if d.Header.Get(webhookEventHeader) != eventType || d.Header.Get(webhookDeliveryHeader) == "" {
+		t.Fatalf("bad event headers %v", d.Header)
+	}
+	if d.Event.ID == "" || d.Event.Time.IsZero() || d.Event.Role != e.RoleName {
+		t.Fatalf("bad event %s", d.Body)
+	}
+	return &d.Event
+}
+
+func (e *testEnv) CheckIssueEvent(t *testing.T) {
+	event := e.lastEvent(t, eventIssue)
+	keyID := e.MostRecentSecret.InternalData["api_key_id"].(string)
+	if len(event.KeyIDs) != 1 || event.KeyIDs[0] != keyID {
+		t.Fatalf("issue event should carry the key ID %s, was %v", keyID, event.KeyIDs)
+	}
+	if event.EntityID != testEntityID || event.DisplayName != testDisplayName {
+		t.Fatalf("issue event should carry the requester, was %+v", event)
+	}
+	if event.ReadOnly == nil || !*event.ReadOnly || event.IssuedAt == nil || event.ExpiresAt == nil {
+		t.Fatalf("bad issue event %+v", event)
+	}
+	if event.ExpiresAt.Sub(*event.IssuedAt) != 20*time.Second {
+		t.Fatalf("issue event should expire with the lease, was %+v", event)
+	}
+}
+
+func (e *testEnv) CheckRenewEvent(t *testing.T) {
+	event := e.lastEvent(t, eventRenew)
+	if event.EntityID != testEntityID || event.ExpiresAt == nil {
+		t.Fatalf("bad renew event %+v", event)
+	}
+}
+
+func (e *testEnv) CheckRevokeEvent(t *testing.T) {
+	event := e.lastEvent(t, eventRevoke)
+	keyID := e.MostRecentSecret.InternalData["api_key_id"].(string)
+	if len(event.KeyIDs) != 1 || event.KeyIDs[0] != keyID || event.EntityID != testEntityID {
+		t.Fatalf("bad revoke event %+v", event)
+	}
+}
+
+func (e *testEnv) CheckRollbackEvent(t *testing.T) {
+	event := e.lastEvent(t, eventRollback)
+	if len(event.KeyIDs) != testBatchSize-1 || !strings.Contains(event.Reason, "injected failure") {
+		t.Fatalf("bad rollback event %+v", event)
+	}
+}
+
+func (e *testEnv) outboxSize(t *testing.T) int {
+	e.Backend.(*backend).background.Wait()
+	status := e.readStatus(t)
+	return status["webhook_outbox"].(int)
+}
+
+func (e *testEnv) makeOutboxDue(t *testing.T) {
+	ids, err := e.Storage.List(e.Context, webhookOutboxPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range ids {
+		entry, err := readOutboxEntry(e.Context, e.Storage, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entry.NextAttemptAt = time.Now().Add(-time.Second)
+		if err := writeOutboxEntry(e.Context, e.Storage, entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func (e *testEnv) RetryWebhookDelivery(t *testing.T) {
+	e.Webhook.FailNext(1)
+	e.RenewCreds(t)
+	if e.outboxSize(t) != 1 || e.Webhook.Failed() != 1 {
+		t.Fatalf("failed delivery should stay in the outbox, %d deliveries failed", e.Webhook.Failed())
+	}
+	first := e.Webhook.Last()
+
+	// Not due yet
+	e.RunPeriodic(t)
+	if e.outboxSize(t) != 1 {
+		t.Fatal("delivery shouldn't be retried before its backoff passed")
+	}
+	e.makeOutboxDue(t)
+	e.RunPeriodic(t)
+	if e.outboxSize(t) != 0 {
+		t.Fatal("retried delivery should leave the outbox")
+	}
+	if e.Webhook.Last() == first {
+		t.Fatal("retried event should be delivered")
+	}
+	e.lastEvent(t, eventRenew)
+}
+
+func (e *testEnv) CheckOutboxBounded(t *testing.T) {
+	resp, err := e.writeWebhookConfig(map[string]interface{}{"outbox_size": 2})
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("bad: resp: %#v\nerr:%v", resp, err)
+	}
+	e.Webhook.FailNext(100)
+	for i := 0; i < 3; i++ {
+		e.RenewCreds(t)
+	}
+	if size := e.outboxSize(t); size != 2 {
+		t.Fatalf("outbox should hold 2 events, held %d", size)
+	}
+	if !strings.Contains(e.Logs.String(), "webhook outbox is full") {
+		t.Fatal("dropped event should be logged")
+	}
+}
+
+func (e *testEnv) DeleteWebhookConfig(t *testing.T) {
+	req := &logical.Request{
+		Operation: logical.DeleteOperation,
+		Path:      "config/webhooks",
+		Storage:   e.Storage,
+	}
+	resp, err := e.Backend.HandleRequest(e.Context, req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("bad: resp: %#v\nerr:%v", resp, err)
+	}
+	e.RunPeriodic(t)
+	if e.outboxSize(t) != 0 {
+		t.Fatal("events for removed webhooks should be dropped")
+	}
 }
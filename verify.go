@@ -0,0 +1,67 @@
+package packet
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/packethost/packngo"
+)
+
+// verifyInterval is the delay between probes of a new API key.
+const verifyInterval = 500 * time.Millisecond
+
+// verifyAPIKey probes a new API key of a role with a cheap authenticated call
+// until it succeeds, as new keys may be rejected for the first seconds after
+// they're created. It gives up after verify_timeout of the role. Probes go
+// through apiCall like any other call, but are made with the new key.
+func (b *backend) verifyAPIKey(ctx context.Context, s logical.Storage, role *roleEntry, apiKey *packngo.APIKey) error {
+	c, err := b.tokenClient(apiKey.Token)
+	if err != nil {
+		return err
+	}
+	endpoint := "Users.Current"
+	call := func() (*packngo.Response, error) {
+		_, resp, err := c.Users.Current()
+		return resp, err
+	}
+	if role.Type == TypeProject {
+		// Project keys can't read the user
+		endpoint = "Projects.Get"
+		call = func() (*packngo.Response, error) {
+			_, resp, err := c.Projects.Get(role.ProjectID, nil)
+			return resp, err
+		}
+	}
+	probe := func() error {
+		return b.apiCall(ctx, s, priorityIssue, endpoint, func(*packngo.Client) (*packngo.Response, error) {
+			resp, err := call()
+			if isUnauthorized(err) {
+				// The new key isn't usable yet, which mustn't take the
+				// token apiCall waited for out of rotation
+				return resp, fmt.Errorf("API key rejected: %v", err)
+			}
+			return resp, err
+		})
+	}
+
+	start := time.Now()
+	deadline := start.Add(role.VerifyTimeout)
+	for attempt := 1; ; attempt++ {
+		err := probe()
+		if err == nil {
+			b.Logger().Debug("verified API key", "key_id", apiKey.ID, "attempts", attempt, "elapsed", time.Since(start))
+			return nil
+		}
+		b.Logger().Debug("API key not usable yet", "key_id", apiKey.ID, "attempt", attempt, "error", err)
+		if time.Now().Add(verifyInterval).After(deadline) {
+			return fmt.Errorf("API key %s didn't become usable within %s: %v", apiKey.ID, role.VerifyTimeout, err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(verifyInterval):
+		}
+	}
+}
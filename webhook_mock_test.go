@@ -0,0 +1,90 @@
+package packet
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+)
+
+// webhookReceiver is a fake webhook endpoint recording the events POSTed to
+// it. It can reject deliveries.
+type webhookReceiver struct {
+	*httptest.Server
+
+	mu         sync.Mutex
+	failures   int
+	failed     int
+	Deliveries []*webhookDelivery
+}
+
+type webhookDelivery struct {
+	Header http.Header
+	Body   []byte
+	Event  webhookEvent
+}
+
+func newWebhookReceiver() *webhookReceiver {
+	r := &webhookReceiver{}
+	r.Server = httptest.NewServer(http.HandlerFunc(r.serveHTTP))
+	return r
+}
+
+// FailNext rejects the next times deliveries with status 500.
+func (r *webhookReceiver) FailNext(times int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.failures = times
+}
+
+// Failed returns the number of rejected deliveries.
+func (r *webhookReceiver) Failed() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.failed
+}
+
+// Events returns the types of delivered events in order.
+func (r *webhookReceiver) Events() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var types []string
+	for _, d := range r.Deliveries {
+		types = append(types, d.Event.Type)
+	}
+	return types
+}
+
+// Last returns the most recent delivery, nil if there was none.
+func (r *webhookReceiver) Last() *webhookDelivery {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.Deliveries) == 0 {
+		return nil
+	}
+	return r.Deliveries[len(r.Deliveries)-1]
+}
+
+func (r *webhookReceiver) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.failures > 0 {
+		r.failures--
+		r.failed++
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	d := &webhookDelivery{Header: req.Header, Body: body}
+	if err := json.Unmarshal(body, &d.Event); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	r.Deliveries = append(r.Deliveries, d)
+	w.WriteHeader(http.StatusNoContent)
+}
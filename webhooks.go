@@ -0,0 +1,387 @@
+package packet
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	uuid "github.com/hashicorp/go-uuid"
+	"github.com/hashicorp/vault/sdk/helper/strutil"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	// webhookConfigKey is the storage key of the webhook config. It's
+	// seal-wrapped, as it holds the signing secret.
+	webhookConfigKey = "config/webhooks"
+
+	// webhookOutboxPrefix is the storage prefix of events waiting for
+	// delivery, "webhooks/outbox/<time>-<delivery ID>", one entry per event
+	// and URL. Keys sort by the time the event was queued.
+	webhookOutboxPrefix = "webhooks/outbox/"
+
+	webhookEventHeader     = "X-Vault-Packet-Event"
+	webhookDeliveryHeader  = "X-Vault-Packet-Delivery"
+	webhookSignatureHeader = "X-Vault-Packet-Signature"
+
+	defaultWebhookOutboxSize = 1000
+	maxWebhookAttempts       = 8
+)
+
+// Lifecycle events of API keys sent to webhooks.
+const (
+	eventIssue    = "issue"
+	eventRenew    = "renew"
+	eventRevoke   = "revoke"
+	eventRollback = "rollback"
+	eventSweep    = "sweep"
+)
+
+var webhookEvents = []string{eventIssue, eventRenew, eventRevoke, eventRollback, eventSweep}
+
+// webhookBackoff is the delay before the first retry of a failed delivery.
+// It doubles with every attempt up to webhookMaxBackoff.
+var (
+	webhookBackoff    = 30 * time.Second
+	webhookMaxBackoff = time.Hour
+	webhookTimeout    = 10 * time.Second
+)
+
+type webhookConfig struct {
+	URLs   []string `json:"urls"`
+	Secret string   `json:"secret"`
+	// Events are the event types sent, empty means all of them
+	Events     []string `json:"events"`
+	OutboxSize int      `json:"outbox_size"`
+}
+
+// wants reports whether events of given type are sent.
+func (c *webhookConfig) wants(eventType string) bool {
+	if len(c.Events) == 0 {
+		return true
+	}
+	for _, e := range c.Events {
+		if e == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// webhookEvent is the JSON body POSTed to webhooks.
+type webhookEvent struct {
+	ID        string    `json:"id"`
+	Type      string    `json:"type"`
+	Time      time.Time `json:"time"`
+	Role      string    `json:"role"`
+	KeyIDs    []string  `json:"api_key_ids"`
+	ProjectID string    `json:"project_id,omitempty"`
+	ReadOnly  *bool     `json:"read_only,omitempty"`
+
+	// EntityID and DisplayName are of the requester the keys were issued
+	// to, if known
+	EntityID    string `json:"entity_id,omitempty"`
+	DisplayName string `json:"display_name,omitempty"`
+
+	IssuedAt  *time.Time `json:"issued_at,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+
+	// Reason explains rollbacks and sweep deletions
+	Reason string `json:"reason,omitempty"`
+}
+
+// outboxEntry is the storage record of an event waiting for delivery to a
+// webhook. The body is kept as sent, so that retries carry the same
+// signature.
+type outboxEntry struct {
+	ID            string          `json:"id"`
+	URL           string          `json:"url"`
+	EventType     string          `json:"event_type"`
+	Body          json.RawMessage `json:"body"`
+	Attempts      int             `json:"attempts"`
+	LastError     string          `json:"last_error"`
+	NextAttemptAt time.Time       `json:"next_attempt_at"`
+}
+
+func readWebhookConfig(ctx context.Context, s logical.Storage) (*webhookConfig, error) {
+	entry, err := s.Get(ctx, webhookConfigKey)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, nil
+	}
+	result := &webhookConfig{}
+	if err := entry.DecodeJSON(result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func readOutboxEntry(ctx context.Context, s logical.Storage, id string) (*outboxEntry, error) {
+	entry, err := s.Get(ctx, webhookOutboxPrefix+id)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, nil
+	}
+	result := &outboxEntry{}
+	if err := entry.DecodeJSON(result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func writeOutboxEntry(ctx context.Context, s logical.Storage, e *outboxEntry) error {
+	entry, err := logical.StorageEntryJSON(webhookOutboxPrefix+e.ID, e)
+	if err != nil {
+		return err
+	}
+	return s.Put(ctx, entry)
+}
+
+// signWebhook returns the signature header value of a body, the hex
+// HMAC-SHA256 of it keyed with the secret.
+func signWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// notify queues an event for every configured webhook and delivers it in the
+// background. Failures are logged, they never fail the operation the event
+// is about.
+func (b *backend) notify(ctx context.Context, s logical.Storage, event *webhookEvent) {
+	if err := b.queueEvent(ctx, s, event); err != nil {
+		b.Logger().Error("failed to queue webhook event", "type", event.Type, "role", event.Role,
+			"key_ids", event.KeyIDs, "error", err)
+		return
+	}
+	// One delivery waiting for its turn picks up all queued events
+	if !atomic.CompareAndSwapInt32(&b.deliveryQueued, 0, 1) {
+		return
+	}
+	b.background.Add(1)
+	go func() {
+		defer b.background.Done()
+		if err := b.deliverWebhooks(context.Background(), s); err != nil {
+			b.Logger().Error("failed to deliver webhook events", "error", err)
+		}
+	}()
+}
+
+func (b *backend) queueEvent(ctx context.Context, s logical.Storage, event *webhookEvent) error {
+	conf, err := readWebhookConfig(ctx, s)
+	if err != nil {
+		return err
+	}
+	if conf == nil || len(conf.URLs) == 0 || !conf.wants(event.Type) {
+		return nil
+	}
+
+	if event.ID, err = uuid.GenerateUUID(); err != nil {
+		return err
+	}
+	event.Time = time.Now().UTC()
+	if event.ReadOnly == nil && event.Role != "" {
+		if role, err := readRole(ctx, s, event.Role); err == nil && role != nil {
+			readOnly := role.ReadOnly
+			event.ReadOnly = &readOnly
+		}
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	b.outboxLock.Lock()
+	defer b.outboxLock.Unlock()
+
+	// Make room by dropping the oldest undelivered events
+	ids, err := s.List(ctx, webhookOutboxPrefix)
+	if err != nil {
+		return err
+	}
+	size := conf.OutboxSize
+	if size <= 0 {
+		size = defaultWebhookOutboxSize
+	}
+	for i := 0; i < len(ids) && len(ids)-i+len(conf.URLs) > size; i++ {
+		if err := s.Delete(ctx, webhookOutboxPrefix+ids[i]); err != nil {
+			return err
+		}
+		b.Logger().Warn("webhook outbox is full, dropped undelivered event", "delivery_id", ids[i])
+	}
+
+	for _, url := range conf.URLs {
+		deliveryID, err := uuid.GenerateUUID()
+		if err != nil {
+			return err
+		}
+		e := &outboxEntry{
+			ID:        fmt.Sprintf("%019d-%s", event.Time.UnixNano(), deliveryID),
+			URL:       url,
+			EventType: event.Type,
+			Body:      body,
+		}
+		if err := writeOutboxEntry(ctx, s, e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deliverWebhooks POSTs events which are due to their webhooks, oldest
+// first. After a failed delivery, the other events for the same URL wait for
+// the next run. Events failing maxWebhookAttempts times are dropped.
+func (b *backend) deliverWebhooks(ctx context.Context, s logical.Storage) error {
+	b.deliveryLock.Lock()
+	defer b.deliveryLock.Unlock()
+	atomic.StoreInt32(&b.deliveryQueued, 0)
+
+	conf, err := readWebhookConfig(ctx, s)
+	if err != nil {
+		return err
+	}
+	ids, err := s.List(ctx, webhookOutboxPrefix)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	failing := map[string]bool{}
+	for _, id := range ids {
+		e, err := readOutboxEntry(ctx, s, id)
+		if err != nil {
+			return err
+		}
+		if e == nil {
+			continue
+		}
+		if conf == nil || !strutil.StrListContains(conf.URLs, e.URL) {
+			// The webhook was removed from config
+			if err := s.Delete(ctx, webhookOutboxPrefix+id); err != nil {
+				return err
+			}
+			continue
+		}
+		if failing[e.URL] || now.Before(e.NextAttemptAt) {
+			continue
+		}
+
+		err = b.postWebhook(ctx, conf.Secret, e)
+		if err == nil {
+			b.Logger().Debug("delivered webhook event", "url", e.URL, "type", e.EventType, "delivery_id", e.ID)
+			if err := s.Delete(ctx, webhookOutboxPrefix+id); err != nil {
+				return err
+			}
+			continue
+		}
+
+		failing[e.URL] = true
+		e.Attempts++
+		e.LastError = err.Error()
+		if e.Attempts >= maxWebhookAttempts {
+			b.Logger().Error("giving up delivering webhook event", "url", e.URL, "type", e.EventType,
+				"delivery_id", e.ID, "attempts", e.Attempts, "error", err)
+			if err := s.Delete(ctx, webhookOutboxPrefix+id); err != nil {
+				return err
+			}
+			continue
+		}
+		backoff := webhookBackoff << uint(e.Attempts-1)
+		if backoff > webhookMaxBackoff || backoff <= 0 {
+			backoff = webhookMaxBackoff
+		}
+		e.NextAttemptAt = now.Add(backoff)
+		b.Logger().Warn("failed to deliver webhook event", "url", e.URL, "type", e.EventType,
+			"delivery_id", e.ID, "attempts", e.Attempts, "next_attempt", e.NextAttemptAt, "error", err)
+		if err := writeOutboxEntry(ctx, s, e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *backend) postWebhook(ctx context.Context, secret string, e *outboxEntry) error {
+	ctx, cancel := context.WithTimeout(ctx, webhookTimeout)
+	defer cancel()
+	req, err := http.NewRequest(http.MethodPost, e.URL, bytes.NewReader(e.Body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookEventHeader, e.EventType)
+	req.Header.Set(webhookDeliveryHeader, e.ID)
+	req.Header.Set(webhookSignatureHeader, signWebhook(secret, e.Body))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// issueEvent returns an event about API keys issued through a role for the
+// requester, under a lease of given TTL.
+func (b *backend) issueEvent(req *logical.Request, roleName string, role *roleEntry, keyIDs []string, ttl time.Duration) *webhookEvent {
+	if ttl == 0 {
+		ttl, _ = b.getDefaultAndMaxLease()
+	}
+	now := time.Now().UTC()
+	expires := now.Add(ttl)
+	readOnly := role.ReadOnly
+	return &webhookEvent{
+		Type:        eventIssue,
+		Role:        roleName,
+		KeyIDs:      keyIDs,
+		ProjectID:   role.ProjectID,
+		ReadOnly:    &readOnly,
+		EntityID:    req.EntityID,
+		DisplayName: req.DisplayName,
+		IssuedAt:    &now,
+		ExpiresAt:   &expires,
+	}
+}
+
+// issuedKeyRequester returns the requester recorded when an API key was
+// issued, nil if unknown.
+func issuedKeyRequester(ctx context.Context, s logical.Storage, roleName, keyID string) *requester {
+	record, err := readIssuedKey(ctx, s, roleName, keyID)
+	if err != nil || record == nil {
+		return nil
+	}
+	return record.Requester
+}
+
+// leaseEvent returns an event about the API keys of a lease, with the
+// requester they were issued to.
+func leaseEvent(ctx context.Context, s logical.Storage, eventType string, secret *logical.Secret) *webhookEvent {
+	roleName, _ := secret.InternalData["role"].(string)
+	projectID, _ := secret.InternalData["project_id"].(string)
+	event := &webhookEvent{
+		Type:      eventType,
+		Role:      roleName,
+		KeyIDs:    leaseKeyIDs(secret),
+		ProjectID: projectID,
+	}
+	if len(event.KeyIDs) > 0 {
+		if who := issuedKeyRequester(ctx, s, roleName, event.KeyIDs[0]); who != nil {
+			event.EntityID = who.EntityID
+			event.DisplayName = who.DisplayName
+		}
+	}
+	return event
+}